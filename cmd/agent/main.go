@@ -27,11 +27,14 @@ func main() {
 	}
 
 	// Get GPU information
-	gpuModel, vramMiB, err := hwinfo.GetNvidiaGPUInfo()
+	gpus, err := hwinfo.GetNvidiaGPUs()
 	if err != nil {
 		log.Fatalf("Failed to get GPU information: %v", err)
 	}
-	log.Printf("Detected GPU: %s with %d MiB VRAM", gpuModel, vramMiB)
+	for _, gpu := range gpus {
+		log.Printf("Detected GPU %d: %s with %d MiB VRAM (UUID: %s, bus: %s)",
+			gpu.Index, gpu.Name, gpu.MemoryTotalMiB, gpu.UUID, gpu.PCIBusID)
+	}
 
 	// Parse private key
 	privateKey, err := crypto.HexToECDSA(strings.TrimPrefix(cfg.AgentPrivateKey, "0x"))
@@ -50,25 +53,51 @@ func main() {
 	}
 
 	// Initialize Docker manager
-	dockerManager, err := docker.NewDockerManager()
+	security, err := docker.LoadSecurityProfile(cfg.JobUser, cfg.JobSeccompProfile, cfg.JobTmpfsSizeMB)
+	if err != nil {
+		log.Fatalf("Failed to load job security profile: %v", err)
+	}
+	dockerManager, err := docker.NewDockerManager(security)
 	if err != nil {
 		log.Fatalf("Failed to create Docker manager: %v", err)
 	}
 
 	// Initialize storage manager
-	storageManager, err := storage.NewIPFSManager(cfg)
+	storageManager, err := storage.NewManager(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create storage manager: %v", err)
 	}
 
 	// Initialize NATS client
-	natsClient, err := nats.NewNatsClient(cfg.NatsURL)
+	natsOptions := nats.ConnectOptions{
+		User:             cfg.NatsUser,
+		Password:         cfg.NatsPassword,
+		Token:            cfg.NatsToken,
+		NKeySeedFile:     cfg.NatsNKeySeedFile,
+		CredentialsFile:  cfg.NatsCredsFile,
+		TLSCertFile:      cfg.NatsTLSCertFile,
+		TLSKeyFile:       cfg.NatsTLSKeyFile,
+		TLSCAFile:        cfg.NatsTLSCAFile,
+		ReconnectWait:    cfg.NatsReconnectWait,
+		MaxReconnectWait: cfg.NatsMaxReconnectWait,
+	}
+	var natsClient nats.Client
+	if cfg.NatsJetStream {
+		natsClient, err = nats.NewJetStreamClient(cfg.NatsURL, natsOptions, nats.JetStreamOptions{
+			Stream:     cfg.NatsJobStream,
+			AckWait:    cfg.NatsAckWait,
+			MaxDeliver: cfg.NatsMaxDeliver,
+		})
+	} else {
+		natsClient, err = nats.NewNatsClient(cfg.NatsURL, natsOptions)
+	}
 	if err != nil {
 		log.Fatalf("Failed to create NATS client: %v", err)
 	}
 
 	// Create agent
 	agent := agent.NewAgent(
+		cfg,
 		blockchainClient,
 		dockerManager,
 		storageManager,
@@ -92,7 +121,7 @@ func main() {
 
 	// Run the agent
 	log.Printf("Starting lamda_node_agent...")
-	if err := agent.Run(ctx, gpuModel, vramMiB); err != nil {
+	if err := agent.Run(ctx, gpus); err != nil {
 		log.Fatalf("Agent failed: %v", err)
 	}
 
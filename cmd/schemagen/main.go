@@ -0,0 +1,43 @@
+// Command schemagen writes the JSON Schemas of the agent's NATS messages to a
+// directory, one <name>.schema.json file per message
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"lamda_node_agent/internal/agent"
+	"lamda_node_agent/internal/jsonschema"
+)
+
+func main() {
+	outDir := flag.String("out", "schema", "directory to write the schemas to")
+	flag.Parse()
+
+	statusUpdate := jsonschema.Generate(agent.StatusUpdate{}, "StatusUpdate")
+	statusUpdate["properties"].(jsonschema.Schema)["version"] = jsonschema.Schema{"const": agent.StatusSchemaVersion}
+
+	schemas := map[string]jsonschema.Schema{
+		"status_update":  statusUpdate,
+		"dispatch_reply": jsonschema.Generate(agent.DispatchReply{}, "DispatchReply"),
+		"presence":       jsonschema.Generate(agent.Presence{}, "Presence"),
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatalf("Failed to create schema directory: %v", err)
+	}
+	for name, schema := range schemas {
+		data, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to marshal %s schema: %v", name, err)
+		}
+		path := filepath.Join(*outDir, name+".schema.json")
+		if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+			log.Fatalf("Failed to write %s: %v", path, err)
+		}
+		log.Printf("Wrote %s", path)
+	}
+}
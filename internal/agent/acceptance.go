@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"strings"
+
+	"lamda_node_agent/internal/nats"
+)
+
+// RejectReason says why the agent turned a dispatched job away
+type RejectReason string
+
+const (
+	// RejectMalformed: the message is not a job, or lacks a job_id or image_name
+	RejectMalformed RejectReason = "malformed"
+	// RejectUnauthorized: the message is not signed by an allowed dispatcher
+	RejectUnauthorized RejectReason = "unauthorized"
+	// RejectInvalid: the job breaks the node's storage, encryption, resource or network policy
+	RejectInvalid RejectReason = "invalid"
+	// RejectImageNotAllowed: the image does not match ALLOWED_IMAGES
+	RejectImageNotAllowed RejectReason = "image_not_allowed"
+	// RejectInsufficientVRAM: too few of the node's GPUs have min_vram_mib
+	RejectInsufficientVRAM RejectReason = "insufficient_vram"
+	// RejectInsufficientGPUs: the node has fewer GPUs than gpu_count
+	RejectInsufficientGPUs RejectReason = "insufficient_gpus"
+	// RejectBusy: the job queue is full; the job may be dispatched again later
+	RejectBusy RejectReason = "busy"
+	// RejectUnsupportedVersion: the agent does not understand the job's spec_version
+	RejectUnsupportedVersion RejectReason = "unsupported_version"
+	// RejectExpired: the job's signed envelope expired before the agent received it
+	RejectExpired RejectReason = "expired"
+)
+
+// Enum lists every rejection reason
+func (RejectReason) Enum() []string {
+	return []string{
+		string(RejectMalformed), string(RejectUnauthorized), string(RejectInvalid),
+		string(RejectImageNotAllowed), string(RejectInsufficientVRAM), string(RejectInsufficientGPUs),
+		string(RejectBusy), string(RejectUnsupportedVersion), string(RejectExpired),
+	}
+}
+
+// DispatchReply answers a job message sent with a reply subject. A requeued
+// job was turned away for now but will be delivered to the agent again, so
+// it must not be dispatched elsewhere.
+type DispatchReply struct {
+	JobID  string       `json:"job_id,omitempty"`
+	Result string       `json:"result" enum:"accepted,rejected,requeued"`
+	Reason RejectReason `json:"reason,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// rejection is a validation error with the reason given to the dispatcher
+type rejection struct {
+	reason RejectReason
+	err    error
+}
+
+func (r *rejection) Error() string { return r.err.Error() }
+func (r *rejection) Unwrap() error { return r.err }
+
+// reject marks err as a rejection for reason
+func reject(reason RejectReason, err error) error {
+	return &rejection{reason: reason, err: err}
+}
+
+// rejectReason returns the reason a validation error was given, or
+// RejectInvalid for errors without one
+func rejectReason(err error) RejectReason {
+	var r *rejection
+	if errors.As(err, &r) {
+		return r.reason
+	}
+	return RejectInvalid
+}
+
+// acceptJob tells the dispatcher that a job was queued
+func acceptJob(delivery nats.JobDelivery, jobID string) {
+	replyToDispatch(delivery, DispatchReply{JobID: jobID, Result: "accepted"})
+}
+
+// rejectJob tells the dispatcher why a job was turned away
+func rejectJob(delivery nats.JobDelivery, jobID string, reason RejectReason, err error) {
+	replyToDispatch(delivery, DispatchReply{JobID: jobID, Result: "rejected", Reason: reason, Error: err.Error()})
+}
+
+// requeueJob tells the dispatcher that a job was turned away and handed back
+// to JetStream, which delivers it again
+func requeueJob(delivery nats.JobDelivery, jobID string, reason RejectReason, err error) {
+	replyToDispatch(delivery, DispatchReply{JobID: jobID, Result: "requeued", Reason: reason, Error: err.Error()})
+}
+
+// replyToDispatch sends reply if the job message asked for one
+func replyToDispatch(delivery nats.JobDelivery, reply DispatchReply) {
+	replyBytes, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("Failed to marshal dispatch reply: %v", err)
+		return
+	}
+	delivery.Respond(replyBytes)
+}
+
+// validateMessage checks the job's format version and the fields every job
+// must have
+func validateMessage(jobMsg JobMessage) error {
+	if jobMsg.SpecVersion != 0 && !slices.Contains(supportedJobSpecVersions, jobMsg.SpecVersion) {
+		return reject(RejectUnsupportedVersion, fmt.Errorf("job spec_version %d is not supported; this agent supports %v", jobMsg.SpecVersion, supportedJobSpecVersions))
+	}
+	switch {
+	case !validSubjectToken(jobMsg.JobID):
+		return reject(RejectMalformed, fmt.Errorf("job_id %q must be non-empty without dots, wildcards or whitespace", jobMsg.JobID))
+	case jobMsg.ImageName == "":
+		return reject(RejectMalformed, errors.New("job has no image_name"))
+	}
+	return nil
+}
+
+// validateImage checks a job's image against ALLOWED_IMAGES. Each pattern is
+// matched with path.Match against the image reference and against its
+// repository without tag or digest, so "ghcr.io/org/*" allows every image
+// under ghcr.io/org and "ghcr.io/org/model" allows every tag of it.
+func (a *Agent) validateImage(image string) error {
+	if len(a.cfg.AllowedImages) == 0 {
+		return nil
+	}
+	repository := imageRepository(image)
+	for _, pattern := range a.cfg.AllowedImages {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, image); ok {
+			return nil
+		}
+		if ok, _ := path.Match(pattern, repository); ok {
+			return nil
+		}
+	}
+	return reject(RejectImageNotAllowed, fmt.Errorf("image %q is not allowed on this node", image))
+}
+
+// imageRepository strips the tag and digest from an image reference
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// validateGPUs checks that the node has enough GPUs, with enough memory, for
+// the job ever to run
+func (a *Agent) validateGPUs(jobMsg JobMessage) error {
+	count := jobMsg.gpuCount()
+	if count > a.gpuAllocator.Total() {
+		return reject(RejectInsufficientGPUs, fmt.Errorf("job requests %d GPU(s) but node has %d", count, a.gpuAllocator.Total()))
+	}
+	if eligible := a.gpuAllocator.Eligible(jobMsg.MinVRAMMiB); count > eligible {
+		return reject(RejectInsufficientVRAM, fmt.Errorf("job requests %d GPU(s) with %d MiB of VRAM but node has %d", count, jobMsg.MinVRAMMiB, eligible))
+	}
+	return nil
+}
+
+// gpuCount returns the number of GPUs a job asks for, 1 by default
+func (j JobMessage) gpuCount() int {
+	if j.GPUCount <= 0 {
+		return 1
+	}
+	return j.GPUCount
+}
@@ -4,50 +4,119 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"lamda_node_agent/internal/blockchain"
+	"lamda_node_agent/internal/config"
 	"lamda_node_agent/internal/docker"
+	"lamda_node_agent/internal/encryption"
+	"lamda_node_agent/internal/hwinfo"
 	"lamda_node_agent/internal/nats"
 	"lamda_node_agent/internal/storage"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
+// JobSpecVersion is the newest job message format the agent understands
+const JobSpecVersion = 1
+
+// supportedJobSpecVersions lists every job message format the agent runs
+var supportedJobSpecVersions = []int{JobSpecVersion}
+
+// logUploadTimeout bounds uploading a job's logs, which outlives the job's
+// context so logs of cancelled jobs and jobs running at shutdown are kept
+const logUploadTimeout = 5 * time.Minute
+
 // JobMessage represents a job assignment message from NATS
 type JobMessage struct {
+	// SpecVersion is the job message format; 0 means 1
+	SpecVersion  int    `json:"spec_version,omitempty"`
 	JobID        string `json:"job_id"`
 	ImageName    string `json:"image_name"`
-	InputFileCID string `json:"input_file_cid"`
-	OutputPath   string `json:"output_path"`
+	InputFileCID string `json:"input_file_cid"` // CID or storage URI
+	OutputPath   string `json:"output_path"`    // storage URI; anything else uses the default backend
+
+	// Inputs are additional files or directories, each downloaded to /input/<path>
+	Inputs []NamedInput `json:"inputs,omitempty"`
+
+	// Optional overrides for the image's ENTRYPOINT, CMD and working directory
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Command    []string          `json:"command,omitempty"`
+	WorkingDir string            `json:"working_dir,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+
+	// GPUCount is the number of GPUs to attach to the container (default 1)
+	GPUCount int `json:"gpu_count,omitempty"`
+	// MinVRAMMiB is the memory each of the job's GPUs must have
+	MinVRAMMiB uint64 `json:"min_vram_mib,omitempty"`
+
+	// MaxRuntimeSeconds bounds the job's run time, capped by the node's MAX_JOB_RUNTIME
+	MaxRuntimeSeconds int `json:"max_runtime_seconds,omitempty"`
+
+	// Resources requests container limits, bounded by the node's ceilings
+	Resources ResourceRequest `json:"resources,omitempty"`
+
+	// TTY runs the container with a pseudo-terminal; its output is then all stdout
+	TTY bool `json:"tty,omitempty"`
+
+	// NetworkEgress asks for network access, allowed only by the node's ALLOW_JOB_EGRESS
+	NetworkEgress bool `json:"network_egress,omitempty"`
+
+	// EncryptedKey is the AES-256 data key of encrypted inputs, sealed with
+	// ECIES to the agent's secp256k1 public key (hex)
+	EncryptedKey string `json:"encrypted_key,omitempty"`
+	// RequesterPublicKey is a secp256k1 public key (hex); when set, the
+	// output and logs are encrypted to it
+	RequesterPublicKey string `json:"requester_public_key,omitempty"`
+}
+
+// NamedInput is a file or directory placed at a path under /input. CID is a
+// bare IPFS CID or a storage URI (ipfs://, s3://, file://, https://).
+type NamedInput struct {
+	CID  string `json:"cid"`
+	Path string `json:"path"`
+}
+
+// CancelRequest asks the agent to abort a job
+type CancelRequest struct {
+	JobID string `json:"job_id"`
 }
 
-// StatusUpdate represents a status update message to NATS
-type StatusUpdate struct {
-	AgentAddress string    `json:"agent_address"`
-	JobID        string    `json:"job_id"`
-	Status       string    `json:"status"`
-	OutputCID    string    `json:"output_cid,omitempty"`
-	Timestamp    time.Time `json:"timestamp"`
+// CancelReply answers a CancelRequest
+type CancelReply struct {
+	JobID  string `json:"job_id"`
+	Result string `json:"result"` // "cancelling", "not_found" or "invalid"
+	Stage  string `json:"stage,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
 // Agent is the main orchestrator for the lamda_node_agent
 type Agent struct {
+	cfg              *config.Config
 	blockchainClient blockchain.BlockchainClient
 	dockerManager    docker.Manager
 	storageManager   storage.Manager
 	natsClient       nats.Client
 	privateKey       *ecdsa.PrivateKey
 	address          string
+	gpuAllocator     *gpuAllocator
+	scheduler        *scheduler
+	jobs             *jobRegistry
+	verifier         *jobVerifier
+	audit            *auditLogger
 	heartbeatTicker  *time.Ticker
 }
 
 // NewAgent creates a new agent instance
 func NewAgent(
+	cfg *config.Config,
 	blockchainClient blockchain.BlockchainClient,
 	dockerManager docker.Manager,
 	storageManager storage.Manager,
@@ -60,19 +129,52 @@ func NewAgent(
 	address := crypto.PubkeyToAddress(*publicKeyECDSA)
 
 	return &Agent{
+		cfg:              cfg,
 		blockchainClient: blockchainClient,
 		dockerManager:    dockerManager,
 		storageManager:   storageManager,
 		natsClient:       natsClient,
 		privateKey:       privateKey,
 		address:          address.Hex(),
+		jobs:             newJobRegistry(),
 	}
 }
 
 // Run starts the agent and orchestrates all operations
-func (a *Agent) Run(ctx context.Context, gpuModel string, vram uint64) error {
+func (a *Agent) Run(ctx context.Context, gpus []hwinfo.GPU) error {
+	gpuModel, vram := hwinfo.Summarize(gpus)
 	log.Printf("Starting lamda_node_agent with address: %s", a.address)
-	log.Printf("GPU Model: %s, VRAM: %d MiB", gpuModel, vram)
+	log.Printf("Public key for encrypted jobs: %s", hexutil.Encode(crypto.FromECDSAPub(&a.privateKey.PublicKey)))
+	log.Printf("GPU Model: %s, VRAM per GPU: %d MiB, GPUs: %d", gpuModel, vram, len(gpus))
+	a.gpuAllocator = newGPUAllocator(gpus)
+
+	// Only run jobs signed by an allowed dispatcher. A job turned away as busy
+	// must still be valid whenever JetStream delivers it again.
+	if window := a.redeliveryWindow(); a.cfg.JobEnvelopeMaxTTL > 0 && a.cfg.JobEnvelopeMaxTTL < window {
+		return fmt.Errorf("JOB_ENVELOPE_MAX_TTL (%s) is shorter than the %s over which busy jobs are delivered again (NATS_NAK_DELAY × (NATS_MAX_DELIVER - 1))", a.cfg.JobEnvelopeMaxTTL, window)
+	}
+	verifier, err := newJobVerifier(a.address, a.cfg.DispatcherAddresses, a.cfg.JobEnvelopeMaxTTL, a.cfg.AllowUnsignedJobs)
+	if err != nil {
+		return err
+	}
+	a.verifier = verifier
+	if a.cfg.AllowUnsignedJobs {
+		log.Printf("Warning: ALLOW_UNSIGNED_JOBS is set; unsigned job messages will run")
+	}
+	audit, err := newAuditLogger(a.cfg.AuditLogFile)
+	if err != nil {
+		return err
+	}
+	a.audit = audit
+	defer a.audit.Close()
+
+	// Run jobs concurrently, one worker per GPU slot by default
+	workers := a.cfg.MaxConcurrentJobs
+	if workers <= 0 {
+		workers = len(gpus)
+	}
+	a.scheduler = newScheduler(workers, a.cfg.JobQueueSize, a.runJob)
+	log.Printf("Job scheduler running %d worker(s) with a queue of %d", workers, a.cfg.JobQueueSize)
 
 	// Register node with the blockchain
 	log.Printf("Registering node with blockchain...")
@@ -84,6 +186,9 @@ func (a *Agent) Run(ctx context.Context, gpuModel string, vram uint64) error {
 	// Start heartbeat goroutine
 	a.startHeartbeat(ctx)
 
+	// Start job workers
+	a.scheduler.Start(ctx)
+
 	// Subscribe to job assignments
 	subject := fmt.Sprintf("jobs.dispatch.%s", a.address)
 	log.Printf("Subscribing to job assignments on subject: %s", subject)
@@ -92,19 +197,58 @@ func (a *Agent) Run(ctx context.Context, gpuModel string, vram uint64) error {
 		return fmt.Errorf("failed to subscribe to jobs: %w", err)
 	}
 
+	// Subscribe to job cancellations
+	cancelSubject := fmt.Sprintf("jobs.cancel.%s", a.address)
+	log.Printf("Subscribing to job cancellations on subject: %s", cancelSubject)
+
+	if err := a.natsClient.SubscribeToCancellations(ctx, cancelSubject, a.handleCancelMessage); err != nil {
+		return fmt.Errorf("failed to subscribe to job cancellations: %w", err)
+	}
+
+	// Announce the agent periodically, and again whenever the NATS connection
+	// comes back, since dispatchers may have given up on it while it was away
+	a.publishPresence(presenceOnline)
+	a.natsClient.OnReconnect(func() { a.publishPresence(presenceOnline) })
+	a.startPresence(ctx)
+
 	// Keep the agent running
 	<-ctx.Done()
 	log.Printf("Agent shutting down...")
 
+	a.stopScheduler()
+
 	// Cleanup
 	if a.heartbeatTicker != nil {
 		a.heartbeatTicker.Stop()
 	}
+	a.publishPresence(presenceOffline)
 	a.natsClient.Close()
 
 	return nil
 }
 
+// stopScheduler waits for in-flight jobs to finish and reports the jobs that
+// never started. Like jobs cut short, they are requeued when JetStream will
+// deliver them again, and cancelled otherwise.
+func (a *Agent) stopScheduler() {
+	log.Printf("Waiting for in-flight jobs to finish...")
+	for _, job := range a.scheduler.Stop() {
+		log.Printf("Job %s was still queued at shutdown", job.JobID)
+		a.publishStatus(job.JobID, StatusCancelled)
+		a.jobs.Remove(job.JobID)
+	}
+}
+
+// redeliveryWindow returns how long after its first delivery JetStream may
+// deliver a job that keeps being turned away as busy. It is 0 without
+// JetStream, and without a delivery limit, which no envelope TTL could cover.
+func (a *Agent) redeliveryWindow() time.Duration {
+	if !a.cfg.NatsJetStream || a.cfg.NatsMaxDeliver <= 0 {
+		return 0
+	}
+	return a.cfg.NatsNakDelay * time.Duration(a.cfg.NatsMaxDeliver-1)
+}
+
 // startHeartbeat starts a goroutine to send periodic heartbeats
 func (a *Agent) startHeartbeat(ctx context.Context) {
 	a.heartbeatTicker = time.NewTicker(5 * time.Minute)
@@ -125,77 +269,506 @@ func (a *Agent) startHeartbeat(ctx context.Context) {
 	}()
 }
 
-// handleJobMessage processes incoming job messages
-func (a *Agent) handleJobMessage(msg []byte) {
+// handleJobMessage verifies incoming job messages and queues them for the
+// scheduler. Messages that are not signed by an allowed dispatcher are
+// dropped without a status update. Messages sent as requests are answered
+// with a DispatchReply saying whether the job was accepted.
+func (a *Agent) handleJobMessage(delivery nats.JobDelivery) {
+	payload, signer, err := a.verifier.Open(delivery.Data(), delivery.Sequence(), time.Now())
+	if errors.Is(err, errEnvelopeExpired) {
+		a.expireJob(delivery, payload, signer, err)
+		return
+	}
+	if err != nil {
+		a.audit.Record(auditEntry{Event: "job_dropped", Signer: signer, Reason: err.Error()})
+		delivery.Term()
+		rejectJob(delivery, "", RejectUnauthorized, err)
+		return
+	}
+
 	var jobMsg JobMessage
-	if err := json.Unmarshal(msg, &jobMsg); err != nil {
-		log.Printf("Failed to unmarshal job message: %v", err)
+	if err := json.Unmarshal(payload, &jobMsg); err != nil {
+		err = fmt.Errorf("malformed job message: %w", err)
+		a.audit.Record(auditEntry{Event: "job_dropped", Signer: signer, Reason: err.Error()})
+		delivery.Term()
+		rejectJob(delivery, "", RejectMalformed, err)
 		return
 	}
 
+	event := "job_verified"
+	if signer == "" {
+		event = "job_unsigned"
+	}
+	a.audit.Record(auditEntry{Event: event, JobID: jobMsg.JobID, Signer: signer})
+
 	log.Printf("Received job assignment: %s", jobMsg.JobID)
 
+	// Reject jobs the node's policy does not allow before any work is done
+	if err := a.validateJob(jobMsg); err != nil {
+		log.Printf("Rejecting job %s: %v", jobMsg.JobID, err)
+		delivery.Term()
+		rejectJob(delivery, jobMsg.JobID, rejectReason(err), err)
+		a.publishResult(StatusUpdate{
+			JobID:  jobMsg.JobID,
+			Status: StatusRejected,
+			Error:  jobError(ErrorInvalidJob, "", err),
+		})
+		return
+	}
+
+	// The job is already queued or running. JetStream delivers its message
+	// again if the first delivery's heartbeat lapsed; acknowledging that
+	// would settle the message while the job is still in flight, so the job
+	// carries on under the new delivery instead. A different message with
+	// the same job ID is only acknowledged.
+	if !a.jobs.Add(jobMsg.JobID, delivery) {
+		log.Printf("Ignoring duplicate job assignment: %s", jobMsg.JobID)
+		acceptJob(delivery, jobMsg.JobID)
+		if previous, ok := a.jobs.Redeliver(jobMsg.JobID, delivery); ok {
+			previous.Release()
+		} else {
+			delivery.Ack()
+		}
+		return
+	}
+
+	// Turn the job away rather than block the NATS dispatcher when the queue
+	// is full. With JetStream it is delivered again later, unless this was
+	// its last delivery. The message is settled before the dispatcher hears
+	// back, so a rejected job is never delivered again.
+	if !a.scheduler.Submit(jobMsg) {
+		err := errors.New("job queue is full")
+		if delivery.Redeliverable() {
+			log.Printf("Job queue is full, requeueing job %s", jobMsg.JobID)
+			delivery.Nak(a.cfg.NatsNakDelay)
+			requeueJob(delivery, jobMsg.JobID, RejectBusy, err)
+			a.publishStatus(jobMsg.JobID, StatusRequeued)
+		} else {
+			log.Printf("Job queue is full, rejecting job %s", jobMsg.JobID)
+			delivery.Term()
+			rejectJob(delivery, jobMsg.JobID, RejectBusy, err)
+			a.publishStatus(jobMsg.JobID, StatusBusy)
+		}
+		a.jobs.Remove(jobMsg.JobID)
+		return
+	}
+	acceptJob(delivery, jobMsg.JobID)
+}
+
+// expireJob drops a job whose envelope, signed by an allowed dispatcher,
+// expired before it arrived, for example while it waited in the stream for
+// the agent to come back. Unlike other messages that fail verification, the
+// job is reported as rejected so the dispatcher learns it will not run.
+func (a *Agent) expireJob(delivery nats.JobDelivery, payload []byte, signer string, err error) {
+	var jobMsg JobMessage
+	json.Unmarshal(payload, &jobMsg) // a payload that is not a job only loses its job ID
+	a.audit.Record(auditEntry{Event: "job_dropped", JobID: jobMsg.JobID, Signer: signer, Reason: err.Error()})
+	log.Printf("Dropping job %s: %v", jobMsg.JobID, err)
+
+	delivery.Term()
+	rejectJob(delivery, jobMsg.JobID, RejectExpired, err)
+	if jobMsg.JobID != "" {
+		a.publishFailure(jobMsg.JobID, StatusRejected, jobError(ErrorEnvelopeExpired, "", err))
+	}
+}
+
+// handleCancelMessage cancels a queued or running job and returns the reply
+func (a *Agent) handleCancelMessage(msg []byte) []byte {
+	var req CancelRequest
+	reply := CancelReply{}
+
+	if err := json.Unmarshal(msg, &req); err != nil || req.JobID == "" {
+		log.Printf("Received invalid cancellation request: %s", string(msg))
+		reply.Result = "invalid"
+		reply.Error = "cancellation request must be JSON with a job_id"
+	} else if stage, ok := a.jobs.Cancel(req.JobID); ok {
+		log.Printf("Cancelling job %s at stage %s", req.JobID, stage)
+		reply.JobID = req.JobID
+		reply.Result = "cancelling"
+		reply.Stage = stage
+
+		// A queued job gives up its place at once. One a worker has just
+		// picked up is no longer queued, and runJob reports it instead.
+		if stage == stageQueued && a.scheduler.Remove(req.JobID) {
+			a.publishStatus(req.JobID, StatusCancelled)
+			a.jobs.Remove(req.JobID)
+		}
+	} else {
+		log.Printf("Cannot cancel job %s: not queued or running", req.JobID)
+		reply.JobID = req.JobID
+		reply.Result = "not_found"
+		reply.Error = "job is unknown or already finished"
+	}
+
+	replyBytes, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("Failed to marshal cancellation reply: %v", err)
+		return nil
+	}
+	return replyBytes
+}
+
+// runJob executes a job end to end on a scheduler worker. ctx is the agent's
+// Run context, so shutdown cancels the job at whatever stage it is in.
+func (a *Agent) runJob(ctx context.Context, jobMsg JobMessage) {
+	defer a.jobs.Remove(jobMsg.JobID)
+
+	// Make the job cancellable by ID from here on
+	ctx, cancelJob := context.WithCancel(ctx)
+	defer cancelJob()
+	if !a.jobs.Start(jobMsg.JobID, cancelJob) {
+		log.Printf("Job %s was cancelled before it started", jobMsg.JobID)
+		a.publishStatus(jobMsg.JobID, StatusCancelled)
+		return
+	}
+
+	log.Printf("Starting job: %s", jobMsg.JobID)
+
+	// Assign specific GPUs from the node's inventory to the job
+	gpus, err := a.gpuAllocator.Acquire(ctx, jobMsg.JobID, jobMsg.gpuCount(), jobMsg.MinVRAMMiB)
+	if err != nil {
+		log.Printf("Failed to allocate GPUs for job %s: %v", jobMsg.JobID, err)
+		a.publishFailure(jobMsg.JobID, terminalStatus(ctx), jobError(ErrorGPUAllocation, stagePreparing, err))
+		return
+	}
+	defer a.gpuAllocator.Release(jobMsg.JobID)
+
+	gpuIDs := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		gpuIDs = append(gpuIDs, gpu.UUID)
+	}
+	log.Printf("Assigned GPU(s) %v to job %s", gpuIDs, jobMsg.JobID)
+
+	// Bound the job's run time, unless neither the node nor the job limits it
+	var jobCtx context.Context
+	var cancel context.CancelFunc
+	if timeout := a.jobTimeout(jobMsg); timeout > 0 {
+		jobCtx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		jobCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
 	// Create local directories for the job
 	jobDir := filepath.Join(os.TempDir(), "lamda_jobs", jobMsg.JobID)
 	inputDir := filepath.Join(jobDir, "input")
 	outputDir := filepath.Join(jobDir, "output")
+	logDir := filepath.Join(jobDir, "logs")
+
+	defer os.RemoveAll(jobDir)
 
 	if err := os.MkdirAll(inputDir, 0755); err != nil {
 		log.Printf("Failed to create input directory: %v", err)
+		a.publishFailure(jobMsg.JobID, StatusFailed, jobError(ErrorWorkspace, stagePreparing, err))
 		return
 	}
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		log.Printf("Failed to create output directory: %v", err)
+		a.publishFailure(jobMsg.JobID, StatusFailed, jobError(ErrorWorkspace, stagePreparing, err))
+		return
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		log.Printf("Failed to create log directory: %v", err)
+		a.publishFailure(jobMsg.JobID, StatusFailed, jobError(ErrorWorkspace, stagePreparing, err))
+		return
+	}
+	// The job runs as a non-root user, so the output mount must be writable by anyone
+	if err := os.Chmod(outputDir, 0777); err != nil {
+		log.Printf("Failed to make output directory writable: %v", err)
+		a.publishFailure(jobMsg.JobID, StatusFailed, jobError(ErrorWorkspace, stagePreparing, err))
 		return
 	}
 
-	// Update status to "processing"
-	a.publishStatus(jobMsg.JobID, "processing")
-
-	// Download input data from IPFS
-	if err := a.storageManager.DownloadInput(context.Background(), jobMsg.InputFileCID, inputDir); err != nil {
-		log.Printf("Failed to download input data: %v", err)
-		a.publishStatus(jobMsg.JobID, "failed")
+	// Download input data, or mount it from the input cache
+	a.enterStage(jobMsg.JobID, stageDownloading)
+	inputs, err := a.stageInputs(a.withProgress(jobCtx, jobMsg.JobID, StatusDownloading), jobMsg, inputDir)
+	defer inputs.Release()
+	if err != nil {
+		log.Printf("Failed to stage inputs for job %s: %v", jobMsg.JobID, err)
+		status, code := downloadFailure(jobCtx, err)
+		a.publishFailure(jobMsg.JobID, status, jobError(code, stageDownloading, err))
 		return
 	}
 
 	// Run the job container
-	if err := a.dockerManager.RunJobContainer(context.Background(), jobMsg.ImageName, inputDir, outputDir); err != nil {
-		log.Printf("Failed to run job container: %v", err)
-		a.publishStatus(jobMsg.JobID, "failed")
+	a.enterStage(jobMsg.JobID, stageRunning)
+	resources, _ := a.resolveResources(jobMsg.Resources) // validated on receipt
+	spec := docker.JobSpec{
+		ImageName:     jobMsg.ImageName,
+		InputPath:     inputDir,
+		InputMounts:   inputs.mounts,
+		OutputPath:    outputDir,
+		Entrypoint:    jobMsg.Entrypoint,
+		Cmd:           jobMsg.Command,
+		WorkingDir:    jobMsg.WorkingDir,
+		Env:           jobMsg.Env,
+		GPUDeviceIDs:  gpuIDs,
+		Resources:     resources,
+		NetworkEgress: jobMsg.NetworkEgress,
+		TTY:           jobMsg.TTY,
+		LogDir:        logDir,
+		MaxLogBytes:   a.cfg.MaxJobLogSizeMB * 1024 * 1024,
+		StopTimeout:   a.cfg.ContainerStopTimeout,
+	}
+
+	// Stream the container's output live to jobs.logs.<job_id>
+	var streamer *logStreamer
+	if a.cfg.LogStreamRateKB > 0 {
+		streamer = newLogStreamer(a.natsClient, jobMsg.JobID, a.cfg.LogStreamRateKB*1024)
+		spec.OnLogLine = streamer.HandleLogLine
+	}
+	runErr := a.dockerManager.RunJobContainer(jobCtx, spec)
+	if streamer != nil {
+		streamer.Close()
+	}
+
+	// Encrypt the output and logs to the requester before anything is uploaded
+	a.enterStage(jobMsg.JobID, stageUploading)
+	sealer, err := newOutputSealer(jobMsg)
+	if err != nil {
+		log.Printf("Failed to create output key for job %s: %v", jobMsg.JobID, err)
+		a.publishFailure(jobMsg.JobID, StatusFailed, jobError(ErrorOutputEncryption, stageUploading, err))
+		return
+	}
+
+	// Upload the container logs whether or not the job succeeded, timed out
+	// or was cancelled, so the upload cannot use the job's context
+	logsCtx, cancelLogs := context.WithTimeout(context.Background(), logUploadTimeout)
+	logsCID := a.uploadLogs(logsCtx, jobMsg.JobID, logDir, sealer)
+	cancelLogs()
+	result := StatusUpdate{JobID: jobMsg.JobID, LogsCID: logsCID, OutputKey: sealer.SealedKey()}
+
+	if runErr != nil {
+		log.Printf("Failed to run job container: %v", runErr)
+		result.Status = terminalStatus(jobCtx)
+		result.Error = jobError(ErrorContainer, stageRunning, runErr)
+		a.publishResult(result)
 		return
 	}
 
 	// Upload output data to IPFS
-	outputCID, err := a.storageManager.UploadOutput(context.Background(), outputDir)
+	uploadDir, err := sealer.Encrypt(outputDir)
+	if err != nil {
+		log.Printf("Failed to encrypt output data: %v", err)
+		result.Status = StatusFailed
+		result.Error = jobError(ErrorOutputEncryption, stageUploading, err)
+		a.publishResult(result)
+		return
+	}
+	outputCID, err := a.storageManager.UploadOutput(a.withProgress(jobCtx, jobMsg.JobID, StatusUploading), jobMsg.JobID, uploadDir, jobMsg.OutputPath)
+	if errors.Is(err, storage.ErrEmptyOutput) {
+		log.Printf("Job %s finished without writing any output", jobMsg.JobID)
+		result.Status = StatusEmptyOutput
+		a.publishResult(result)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to upload output data: %v", err)
-		a.publishStatus(jobMsg.JobID, "failed")
+		result.Status = terminalStatus(jobCtx)
+		result.Error = jobError(ErrorOutputUpload, stageUploading, err)
+		a.publishResult(result)
 		return
 	}
 
-	// Update status to "completed" with output CID
-	a.publishStatus(jobMsg.JobID, "completed", outputCID)
-
-	// Cleanup
-	os.RemoveAll(jobDir)
+	// Update status to "completed" with output and log CIDs
+	result.Status = StatusCompleted
+	result.OutputCID = outputCID
+	a.publishResult(result)
 
 	log.Printf("Job %s completed successfully", jobMsg.JobID)
 }
 
+// uploadLogs uploads a job's container logs, encrypted when sealer is not
+// nil, and returns their CID, or an empty string if they could not be uploaded
+func (a *Agent) uploadLogs(ctx context.Context, jobID, logDir string, sealer *outputSealer) string {
+	uploadDir, err := sealer.Encrypt(logDir)
+	if err != nil {
+		log.Printf("Failed to encrypt logs for job %s: %v", jobID, err)
+		return ""
+	}
+
+	logsCID, err := a.storageManager.UploadLogs(ctx, jobID, uploadDir)
+	if err != nil {
+		log.Printf("Failed to upload logs for job %s: %v", jobID, err)
+		return ""
+	}
+	log.Printf("Uploaded logs for job %s: %s", jobID, logsCID)
+	return logsCID
+}
+
+// validateJob checks a job's required fields, its inputs, its encryption
+// keys and the node's policy: allowed images, GPU inventory, resource
+// ceilings and whether jobs may use the network. Errors carry the reason
+// given to the dispatcher.
+func (a *Agent) validateJob(jobMsg JobMessage) error {
+	if err := validateMessage(jobMsg); err != nil {
+		return err
+	}
+	if err := a.validateImage(jobMsg.ImageName); err != nil {
+		return err
+	}
+	if err := a.validateGPUs(jobMsg); err != nil {
+		return err
+	}
+	if err := a.validateStorage(jobMsg); err != nil {
+		return err
+	}
+	if err := a.validateEncryption(jobMsg); err != nil {
+		return err
+	}
+	if _, err := a.resolveResources(jobMsg.Resources); err != nil {
+		return err
+	}
+	if jobMsg.NetworkEgress && !a.cfg.AllowJobEgress {
+		return fmt.Errorf("network egress is not allowed on this node")
+	}
+	return nil
+}
+
+// validateStorage checks that a job has input, that named inputs stay inside
+// /input without overlapping, and that every storage reference can be served
+// by a configured backend
+func (a *Agent) validateStorage(jobMsg JobMessage) error {
+	if jobMsg.InputFileCID == "" && len(jobMsg.Inputs) == 0 {
+		return fmt.Errorf("job has no input_file_cid or inputs")
+	}
+	if jobMsg.InputFileCID != "" {
+		if err := a.storageManager.CheckRef(jobMsg.InputFileCID); err != nil {
+			return err
+		}
+	}
+	if strings.Contains(jobMsg.OutputPath, "://") {
+		if err := a.storageManager.CheckRef(jobMsg.OutputPath); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, input := range jobMsg.Inputs {
+		if input.CID == "" {
+			return fmt.Errorf("input %q has no cid", input.Path)
+		}
+		if err := a.storageManager.CheckRef(input.CID); err != nil {
+			return err
+		}
+		if !filepath.IsLocal(filepath.FromSlash(input.Path)) {
+			return fmt.Errorf("input path %q must be relative and inside /input", input.Path)
+		}
+		path := filepath.ToSlash(filepath.Clean(filepath.FromSlash(input.Path)))
+		if seen[path] {
+			return fmt.Errorf("input path %q is used more than once", input.Path)
+		}
+		seen[path] = true
+	}
+	return nil
+}
+
+// jobTimeout returns the maximum run time for a job: the node's limit, or
+// the job's own limit when it is shorter. 0 means the job runs until it exits.
+func (a *Agent) jobTimeout(jobMsg JobMessage) time.Duration {
+	timeout := a.cfg.MaxJobRuntime
+	if jobMsg.MaxRuntimeSeconds > 0 {
+		requested := time.Duration(jobMsg.MaxRuntimeSeconds) * time.Second
+		if timeout <= 0 || requested < timeout {
+			timeout = requested
+		}
+	}
+	return timeout
+}
+
+// terminalStatus maps the state of a job's context to the status reported
+// when one of its stages fails
+func terminalStatus(ctx context.Context) JobStatus {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return StatusTimedOut
+	case errors.Is(ctx.Err(), context.Canceled):
+		return StatusCancelled
+	default:
+		return StatusFailed
+	}
+}
+
+// downloadFailure reports inputs that fail verification against their CID as
+// "integrity_failed", inputs no source has as "input_not_found" and inputs
+// that cannot be decrypted as "decryption_failed", apart from ordinary
+// download failures, along with the matching error code
+func downloadFailure(ctx context.Context, err error) (JobStatus, ErrorCode) {
+	switch {
+	case errors.Is(err, storage.ErrIntegrity):
+		return StatusIntegrityFailed, ErrorInputIntegrity
+	case errors.Is(err, encryption.ErrDecrypt):
+		return StatusDecryptionFailed, ErrorInputDecryption
+	case errors.Is(err, storage.ErrNotFound):
+		return StatusInputNotFound, ErrorInputNotFound
+	}
+	return terminalStatus(ctx), ErrorInputDownload
+}
+
+// enterStage records the stage a job has reached and publishes it as the
+// job's status
+func (a *Agent) enterStage(jobID, stage string) {
+	a.jobs.SetStage(jobID, stage)
+	a.publishStatus(jobID, JobStatus(stage))
+}
+
 // publishStatus publishes a status update to NATS
-func (a *Agent) publishStatus(jobID, status string, outputCID ...string) {
-	statusUpdate := StatusUpdate{
-		AgentAddress: a.address,
-		JobID:        jobID,
-		Status:       status,
-		Timestamp:    time.Now(),
+func (a *Agent) publishStatus(jobID string, status JobStatus) {
+	a.publishResult(StatusUpdate{JobID: jobID, Status: status})
+}
+
+// publishFailure publishes a final status with the error that caused it
+func (a *Agent) publishFailure(jobID string, status JobStatus, failure *StatusError) {
+	a.publishResult(StatusUpdate{JobID: jobID, Status: status, Error: failure})
+}
+
+// publishResult publishes a status update to NATS. A final status also
+// settles the message the job arrived in. A job cancelled by the agent
+// shutting down rather than on request is reported as requeued instead when
+// JetStream will deliver it again, so cancelled is never followed by more
+// updates.
+func (a *Agent) publishResult(update StatusUpdate) {
+	if update.Status == StatusCancelled {
+		delivery, cancelRequested, ok := a.jobs.Delivery(update.JobID)
+		if ok && !cancelRequested && delivery.Redeliverable() {
+			a.publishUpdate(StatusUpdate{JobID: update.JobID, Status: StatusRequeued})
+			delivery.Nak(a.cfg.NatsNakDelay)
+			return
+		}
 	}
 
-	// Add output CID if provided
-	if len(outputCID) > 0 && outputCID[0] != "" {
-		statusUpdate.OutputCID = outputCID[0]
+	a.publishUpdate(update)
+	if update.Status.Final() {
+		a.settleJob(update.JobID, update.Status)
 	}
+}
+
+// settleJob acknowledges the message a job arrived in. Jobs turned away as
+// busy, and jobs cut short by shutdown that will not be delivered again, are
+// terminated instead.
+func (a *Agent) settleJob(jobID string, status JobStatus) {
+	delivery, cancelRequested, ok := a.jobs.Delivery(jobID)
+	if !ok {
+		return
+	}
+
+	switch {
+	case status == StatusBusy:
+		delivery.Term()
+	case status == StatusCancelled && !cancelRequested:
+		delivery.Term()
+	default:
+		delivery.Ack()
+	}
+}
+
+// publishUpdate stamps a status update with the schema version, the agent's
+// address and the current time and publishes it to the job's and the
+// agent's status subjects
+func (a *Agent) publishUpdate(statusUpdate StatusUpdate) {
+	statusUpdate.Version = StatusSchemaVersion
+	statusUpdate.AgentAddress = a.address
+	statusUpdate.Timestamp = time.Now()
 
 	statusBytes, err := json.Marshal(statusUpdate)
 	if err != nil {
@@ -203,7 +776,9 @@ func (a *Agent) publishStatus(jobID, status string, outputCID ...string) {
 		return
 	}
 
-	if err := a.natsClient.PublishStatusUpdate(context.Background(), statusBytes); err != nil {
-		log.Printf("Failed to publish status update: %v", err)
+	for _, subject := range statusSubjects(a.address, statusUpdate.JobID) {
+		if err := a.natsClient.PublishStatusUpdate(context.Background(), subject, statusBytes); err != nil {
+			log.Printf("Failed to publish status update: %v", err)
+		}
 	}
 }
@@ -0,0 +1,569 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/nats-io/nats-server/v2/server"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"lamda_node_agent/internal/config"
+	"lamda_node_agent/internal/hwinfo"
+	"lamda_node_agent/internal/nats"
+	"lamda_node_agent/internal/storage"
+)
+
+const testReplySubject = "dispatcher.replies"
+
+// testAgent is an agent consuming jobs from an embedded JetStream server. Its
+// scheduler has no workers and a queue of one job, which tests take jobs
+// from to make room.
+type testAgent struct {
+	*Agent
+	dispatcher *ecdsa.PrivateKey
+	conn       *natsgo.Conn // the dispatcher's connection
+	js         jetstream.JetStream
+	replies    chan DispatchReply
+	statuses   chan StatusUpdate
+}
+
+// newTestAgent starts an embedded NATS server and an agent consuming jobs
+// from it. configure may change the agent's configuration first.
+func newTestAgent(t *testing.T, configure func(cfg *config.Config)) *testAgent {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(func() {
+		s.Shutdown()
+		s.WaitForShutdown()
+	})
+
+	agentKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		NatsJetStream:       true,
+		NatsJobStream:       "JOBS",
+		NatsAckWait:         5 * time.Second,
+		NatsMaxDeliver:      3,
+		NatsNakDelay:        300 * time.Millisecond,
+		DispatcherAddresses: []string{crypto.PubkeyToAddress(dispatcher.PublicKey).Hex()},
+		JobEnvelopeMaxTTL:   10 * time.Minute,
+		JobQueueSize:        1,
+		StorageBackend:      "local",
+		LocalStorageDir:     t.TempDir(),
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	storageManager, err := storage.NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := nats.NewJetStreamClient(s.ClientURL(), nats.ConnectOptions{}, nats.JetStreamOptions{
+		Stream:     cfg.NatsJobStream,
+		AckWait:    cfg.NatsAckWait,
+		MaxDeliver: cfg.NatsMaxDeliver,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	a := &testAgent{
+		Agent:      NewAgent(cfg, nil, nil, storageManager, client, agentKey),
+		dispatcher: dispatcher,
+		replies:    make(chan DispatchReply, 10),
+		statuses:   make(chan StatusUpdate, 10),
+	}
+	a.gpuAllocator = newGPUAllocator([]hwinfo.GPU{{UUID: "GPU-0", MemoryTotalMiB: 24576}})
+	if a.verifier, err = newJobVerifier(a.address, cfg.DispatcherAddresses, cfg.JobEnvelopeMaxTTL, false); err != nil {
+		t.Fatal(err)
+	}
+	if a.audit, err = newAuditLogger(""); err != nil {
+		t.Fatal(err)
+	}
+	a.scheduler = newScheduler(1, cfg.JobQueueSize, nil)
+
+	// Listen as the dispatcher for replies and status updates
+	conn, err := natsgo.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	a.conn = conn
+	subscribeJSON(t, conn, testReplySubject, a.replies)
+	subscribeJSON(t, conn, "jobs.status.>", a.statuses)
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if a.js, err = jetstream.New(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := client.SubscribeToJobs(ctx, "jobs.dispatch."+a.address, a.handleJobMessage); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// subscribeJSON decodes the messages on subject into ch
+func subscribeJSON[T any](t *testing.T, conn *natsgo.Conn, subject string, ch chan<- T) {
+	t.Helper()
+	_, err := conn.Subscribe(subject, func(msg *natsgo.Msg) {
+		var v T
+		if err := json.Unmarshal(msg.Data, &v); err != nil {
+			t.Errorf("%s: %v", subject, err)
+			return
+		}
+		ch <- v
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign wraps a job in an envelope signed by the dispatcher
+func (a *testAgent) sign(t *testing.T, job JobMessage, nonce string) []byte {
+	t.Helper()
+	return a.signWith(t, a.dispatcher, job, nonce, time.Now().Add(5*time.Minute))
+}
+
+// signWith wraps a job in an envelope signed by key that expires at expiresAt
+func (a *testAgent) signWith(t *testing.T, key *ecdsa.PrivateKey, job JobMessage, nonce string, expiresAt time.Time) []byte {
+	t.Helper()
+	payload, err := json.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := JobEnvelope{Payload: string(payload), Nonce: nonce, ExpiresAt: expiresAt.Unix()}
+	signature, err := crypto.Sign(accounts.TextHash(signingMessage(a.address, envelope)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Signature = hexutil.Encode(signature)
+
+	msg, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// dispatch stores a job message in the stream, asking for a reply
+func (a *testAgent) dispatch(t *testing.T, msg []byte) {
+	t.Helper()
+	_, err := a.js.PublishMsg(context.Background(), &natsgo.Msg{
+		Subject: "jobs.dispatch." + a.address,
+		Header:  natsgo.Header{nats.ReplyToHeader: {testReplySubject}},
+		Data:    msg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// streamMessages returns how many job messages the stream holds, once it
+// has held that many for a moment
+func (a *testAgent) streamMessages(t *testing.T) uint64 {
+	t.Helper()
+	stream, err := a.js.Stream(context.Background(), a.cfg.NatsJobStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last uint64
+	for stable := 0; stable < 5; {
+		time.Sleep(50 * time.Millisecond)
+		info, err := stream.Info(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.State.Msgs == last {
+			stable++
+		} else {
+			last, stable = info.State.Msgs, 0
+		}
+	}
+	return last
+}
+
+// receive waits for a value on ch
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		var zero T
+		return zero
+	}
+}
+
+// expectNothing fails if a value arrives on ch within wait
+func expectNothing[T any](t *testing.T, ch <-chan T, wait time.Duration) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		t.Fatalf("unexpected message %+v", v)
+	case <-time.After(wait):
+	}
+}
+
+// fakeDelivery is a delivery of a stored job message handed straight to the
+// agent, recording how it was settled
+type fakeDelivery struct {
+	data     []byte
+	sequence uint64
+	replies  chan DispatchReply
+	settled  string
+	released bool
+}
+
+func (d *fakeDelivery) Data() []byte        { return d.data }
+func (d *fakeDelivery) Ack()                { d.settled = "ack" }
+func (d *fakeDelivery) Nak(time.Duration)   { d.settled = "nak" }
+func (d *fakeDelivery) Term()               { d.settled = "term" }
+func (d *fakeDelivery) Sequence() uint64    { return d.sequence }
+func (d *fakeDelivery) Redeliverable() bool { return true }
+func (d *fakeDelivery) Release()            { d.released = true }
+
+func (d *fakeDelivery) Respond(reply []byte) {
+	var r DispatchReply
+	json.Unmarshal(reply, &r)
+	d.replies <- r
+}
+
+// testJob returns a valid job reading from the local storage backend
+func testJob(jobID string) JobMessage {
+	return JobMessage{JobID: jobID, ImageName: "example/model:1", InputFileCID: "file:///inputs/" + jobID}
+}
+
+func TestBusySignedJobIsDeliveredAgain(t *testing.T) {
+	a := newTestAgent(t, nil)
+	if !a.scheduler.Submit(testJob("filler")) {
+		t.Fatal("could not fill the job queue")
+	}
+
+	a.dispatch(t, a.sign(t, testJob("job-1"), "nonce-1"))
+	if reply := receive(t, a.replies); reply.Result != "requeued" || reply.Reason != RejectBusy {
+		t.Fatalf("first delivery: reply %+v, want requeued as busy", reply)
+	}
+	if status := receive(t, a.statuses); status.Status != StatusRequeued {
+		t.Fatalf("first delivery: status %s, want %s", status.Status, StatusRequeued)
+	}
+
+	// Once there is room, the same signed message is delivered and accepted
+	a.scheduler.Remove("filler")
+	if reply := receive(t, a.replies); reply.Result != "accepted" {
+		t.Fatalf("second delivery: reply %+v, want accepted", reply)
+	}
+	if !a.scheduler.Remove("job-1") {
+		t.Fatal("job-1 was accepted but not queued")
+	}
+
+	// Completing the job acknowledges its message
+	a.publishResult(StatusUpdate{JobID: "job-1", Status: StatusCompleted})
+	if status := receive(t, a.statuses); status.Status != StatusCompleted {
+		t.Fatalf("status %s, want %s", status.Status, StatusCompleted)
+	}
+	if n := a.streamMessages(t); n != 0 {
+		t.Errorf("stream holds %d message(s) after the job completed", n)
+	}
+	expectNothing(t, a.replies, time.Second)
+}
+
+func TestBusyJobOnLastDeliveryIsTerminated(t *testing.T) {
+	a := newTestAgent(t, func(cfg *config.Config) { cfg.NatsMaxDeliver = 1 })
+	if !a.scheduler.Submit(testJob("filler")) {
+		t.Fatal("could not fill the job queue")
+	}
+
+	a.dispatch(t, a.sign(t, testJob("job-1"), "nonce-1"))
+	if reply := receive(t, a.replies); reply.Result != "rejected" || reply.Reason != RejectBusy {
+		t.Fatalf("reply %+v, want rejected as busy", reply)
+	}
+	if status := receive(t, a.statuses); status.Status != StatusBusy {
+		t.Fatalf("status %s, want %s", status.Status, StatusBusy)
+	}
+	if n := a.streamMessages(t); n != 0 {
+		t.Errorf("stream holds %d message(s) after the job was turned away", n)
+	}
+}
+
+func TestReplayedEnvelopeIsTerminated(t *testing.T) {
+	a := newTestAgent(t, nil)
+	envelope := a.sign(t, testJob("job-1"), "nonce-1")
+
+	a.dispatch(t, envelope)
+	if reply := receive(t, a.replies); reply.Result != "accepted" {
+		t.Fatalf("first message: reply %+v, want accepted", reply)
+	}
+	a.scheduler.Remove("job-1")
+
+	// Publishing the envelope again stores a new message, which is a replay
+	a.dispatch(t, envelope)
+	if reply := receive(t, a.replies); reply.Result != "rejected" || reply.Reason != RejectUnauthorized {
+		t.Fatalf("replayed message: reply %+v, want rejected as unauthorized", reply)
+	}
+	expectNothing(t, a.replies, time.Second)
+
+	// Only the accepted job's message is still held
+	if n := a.streamMessages(t); n != 1 {
+		t.Errorf("stream holds %d message(s), want 1", n)
+	}
+}
+
+func TestExpiredEnvelopeIsReported(t *testing.T) {
+	a := newTestAgent(t, nil)
+
+	a.dispatch(t, a.signWith(t, a.dispatcher, testJob("job-1"), "nonce-1", time.Now().Add(-time.Minute)))
+	if reply := receive(t, a.replies); reply.Result != "rejected" || reply.Reason != RejectExpired || reply.JobID != "job-1" {
+		t.Fatalf("reply %+v, want job-1 rejected as expired", reply)
+	}
+	status := receive(t, a.statuses)
+	if status.JobID != "job-1" || status.Status != StatusRejected || status.Error == nil || status.Error.Code != ErrorEnvelopeExpired {
+		t.Fatalf("status %+v, want job-1 rejected with %s", status, ErrorEnvelopeExpired)
+	}
+	if n := a.streamMessages(t); n != 0 {
+		t.Errorf("stream holds %d message(s) after the job expired", n)
+	}
+}
+
+func TestExpiredEnvelopeFromUnknownSignerIsNotReported(t *testing.T) {
+	a := newTestAgent(t, nil)
+	stranger, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.dispatch(t, a.signWith(t, stranger, testJob("job-1"), "nonce-1", time.Now().Add(-time.Minute)))
+	if reply := receive(t, a.replies); reply.Result != "rejected" || reply.Reason != RejectUnauthorized || reply.JobID != "" {
+		t.Fatalf("reply %+v, want rejected as unauthorized without a job ID", reply)
+	}
+	expectNothing(t, a.statuses, 500*time.Millisecond)
+}
+
+func TestRedeliveredJobInFlightIsNotAcknowledged(t *testing.T) {
+	a := newTestAgent(t, nil)
+	envelope := a.sign(t, testJob("job-1"), "nonce-1")
+	a.dispatch(t, envelope)
+	if reply := receive(t, a.replies); reply.Result != "accepted" {
+		t.Fatalf("reply %+v, want accepted", reply)
+	}
+	first, _, _ := a.jobs.Delivery("job-1")
+
+	// JetStream delivers the same message again while the job is queued
+	again := &fakeDelivery{data: envelope, sequence: first.Sequence(), replies: make(chan DispatchReply, 1)}
+	a.handleJobMessage(again)
+	if reply := receive(t, again.replies); reply.Result != "accepted" {
+		t.Fatalf("redelivery: reply %+v, want accepted", reply)
+	}
+	if again.settled != "" {
+		t.Fatalf("redelivery was settled with %s while the job is in flight", again.settled)
+	}
+	if n := a.streamMessages(t); n != 1 {
+		t.Fatalf("stream holds %d message(s), want the job's message kept", n)
+	}
+
+	// The job is settled through the delivery that took over
+	a.publishResult(StatusUpdate{JobID: "job-1", Status: StatusCompleted})
+	if again.settled != "ack" {
+		t.Errorf("redelivery settled with %q, want ack", again.settled)
+	}
+}
+
+func TestDuplicateJobIDInAnotherMessageIsAcknowledged(t *testing.T) {
+	a := newTestAgent(t, nil)
+	a.dispatch(t, a.sign(t, testJob("job-1"), "nonce-1"))
+	if reply := receive(t, a.replies); reply.Result != "accepted" {
+		t.Fatalf("reply %+v, want accepted", reply)
+	}
+
+	other := &fakeDelivery{data: a.sign(t, testJob("job-1"), "nonce-2"), sequence: 999, replies: make(chan DispatchReply, 1)}
+	a.handleJobMessage(other)
+	if reply := receive(t, other.replies); reply.Result != "accepted" {
+		t.Fatalf("duplicate: reply %+v, want accepted", reply)
+	}
+	if other.settled != "ack" || other.released {
+		t.Errorf("duplicate settled with %q (released %v), want ack", other.settled, other.released)
+	}
+	if delivery, _, _ := a.jobs.Delivery("job-1"); delivery == nats.JobDelivery(other) {
+		t.Error("the job was handed over to a different message")
+	}
+}
+
+func TestRejectedJobIsTerminated(t *testing.T) {
+	a := newTestAgent(t, func(cfg *config.Config) { cfg.AllowedImages = []string{"allowed/*"} })
+
+	a.dispatch(t, a.sign(t, testJob("job-1"), "nonce-1"))
+	if reply := receive(t, a.replies); reply.Result != "rejected" || reply.Reason != RejectImageNotAllowed {
+		t.Fatalf("reply %+v, want rejected as image_not_allowed", reply)
+	}
+	if status := receive(t, a.statuses); status.Status != StatusRejected {
+		t.Fatalf("status %s, want %s", status.Status, StatusRejected)
+	}
+	if n := a.streamMessages(t); n != 0 {
+		t.Errorf("stream holds %d message(s) after the job was rejected", n)
+	}
+	expectNothing(t, a.replies, time.Second)
+}
+
+func TestCancellingQueuedJobFreesItsPlace(t *testing.T) {
+	a := newTestAgent(t, nil)
+
+	a.dispatch(t, a.sign(t, testJob("job-1"), "nonce-1"))
+	if reply := receive(t, a.replies); reply.Result != "accepted" {
+		t.Fatalf("reply %+v, want accepted", reply)
+	}
+
+	var reply CancelReply
+	if err := json.Unmarshal(a.handleCancelMessage([]byte(`{"job_id":"job-1"}`)), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Result != "cancelling" || reply.Stage != stageQueued {
+		t.Fatalf("cancel reply %+v, want cancelling at stage %s", reply, stageQueued)
+	}
+
+	// The job is reported and settled without waiting for a worker
+	if status := receive(t, a.statuses); status.Status != StatusCancelled {
+		t.Fatalf("status %s, want %s", status.Status, StatusCancelled)
+	}
+	if n := a.streamMessages(t); n != 0 {
+		t.Errorf("stream holds %d message(s) after the job was cancelled", n)
+	}
+	if queued, running := a.jobs.Counts(); queued != 0 || running != 0 {
+		t.Errorf("registry holds %d queued and %d running job(s), want none", queued, running)
+	}
+
+	// Its place in the queue is free for the next job
+	a.dispatch(t, a.sign(t, testJob("job-2"), "nonce-2"))
+	if reply := receive(t, a.replies); reply.Result != "accepted" || reply.JobID != "job-2" {
+		t.Fatalf("next job: reply %+v, want job-2 accepted", reply)
+	}
+}
+
+func TestShutdownRequeuesQueuedJob(t *testing.T) {
+	a := newTestAgent(t, func(cfg *config.Config) { cfg.NatsNakDelay = time.Minute })
+
+	a.dispatch(t, a.sign(t, testJob("job-1"), "nonce-1"))
+	if reply := receive(t, a.replies); reply.Result != "accepted" {
+		t.Fatalf("reply %+v, want accepted", reply)
+	}
+
+	a.stopScheduler()
+	if status := receive(t, a.statuses); status.Status != StatusRequeued || status.Error != nil {
+		t.Fatalf("status %s (error %v), want %s", status.Status, status.Error, StatusRequeued)
+	}
+	expectNothing(t, a.statuses, 500*time.Millisecond)
+	if n := a.streamMessages(t); n != 1 {
+		t.Errorf("stream holds %d message(s), want the job kept for redelivery", n)
+	}
+}
+
+func TestShutdownCancelsQueuedJobOnLastDelivery(t *testing.T) {
+	a := newTestAgent(t, func(cfg *config.Config) { cfg.NatsMaxDeliver = 1 })
+
+	a.dispatch(t, a.sign(t, testJob("job-1"), "nonce-1"))
+	if reply := receive(t, a.replies); reply.Result != "accepted" {
+		t.Fatalf("reply %+v, want accepted", reply)
+	}
+
+	a.stopScheduler()
+	if status := receive(t, a.statuses); status.Status != StatusCancelled {
+		t.Fatalf("status %s, want %s", status.Status, StatusCancelled)
+	}
+	if n := a.streamMessages(t); n != 0 {
+		t.Errorf("stream holds %d message(s) after the job was cancelled on its last delivery", n)
+	}
+}
+
+func TestRunRefusesEnvelopeTTLShorterThanRedelivery(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		NatsJetStream:     true,
+		NatsMaxDeliver:    10,
+		NatsNakDelay:      2 * time.Minute,
+		JobEnvelopeMaxTTL: 10 * time.Minute,
+		AllowUnsignedJobs: true,
+	}
+
+	err = NewAgent(cfg, nil, nil, nil, nil, key).Run(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "JOB_ENVELOPE_MAX_TTL") {
+		t.Fatalf("Run returned %v, want an error about JOB_ENVELOPE_MAX_TTL", err)
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		nodeLimit  time.Duration
+		jobSeconds int
+		want       time.Duration
+	}{
+		{name: "no limits", want: 0},
+		{name: "node limit", nodeLimit: time.Hour, want: time.Hour},
+		{name: "job limit without node limit", jobSeconds: 60, want: time.Minute},
+		{name: "shorter job limit", nodeLimit: time.Hour, jobSeconds: 60, want: time.Minute},
+		{name: "longer job limit", nodeLimit: time.Minute, jobSeconds: 3600, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{cfg: &config.Config{MaxJobRuntime: tt.nodeLimit}}
+			if got := a.jobTimeout(JobMessage{MaxRuntimeSeconds: tt.jobSeconds}); got != tt.want {
+				t.Errorf("jobTimeout() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminalStatusReportsRuntimeLimit(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-expired.Done()
+	if got := terminalStatus(expired); got != StatusTimedOut {
+		t.Errorf("terminalStatus(past deadline) = %s, want %s", got, StatusTimedOut)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := terminalStatus(cancelled); got != StatusCancelled {
+		t.Errorf("terminalStatus(cancelled) = %s, want %s", got, StatusCancelled)
+	}
+
+	if got := terminalStatus(context.Background()); got != StatusFailed {
+		t.Errorf("terminalStatus(live) = %s, want %s", got, StatusFailed)
+	}
+}
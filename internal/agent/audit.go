@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry records a decision about a job message
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"` // "job_verified", "job_unsigned" or "job_dropped"
+	JobID  string    `json:"job_id,omitempty"`
+	Signer string    `json:"signer,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// auditLogger writes audit entries to the agent log and, when configured, as
+// JSON lines to an append-only file
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newAuditLogger opens the audit file at path; an empty path logs only to
+// the agent log
+func newAuditLogger(path string) (*auditLogger, error) {
+	if path == "" {
+		return &auditLogger{}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &auditLogger{file: file}, nil
+}
+
+// Record writes an entry
+func (l *auditLogger) Record(entry auditEntry) {
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to marshal audit entry: %v", err)
+		return
+	}
+	log.Printf("AUDIT %s", line)
+
+	if l.file == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// Close closes the audit file
+func (l *auditLogger) Close() {
+	if l.file != nil {
+		l.file.Close()
+	}
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// JobEnvelope wraps a job message signed by a dispatcher
+type JobEnvelope struct {
+	Payload   string `json:"payload"`    // the JobMessage as JSON
+	Nonce     string `json:"nonce"`      // unique per dispatcher for the envelope's lifetime
+	ExpiresAt int64  `json:"expires_at"` // Unix seconds
+	Signature string `json:"signature"`  // 65-byte secp256k1 signature, hex
+}
+
+// errUnsignedJob is returned for job messages that are not signed envelopes
+var errUnsignedJob = errors.New("job message is not a signed envelope")
+
+// errEnvelopeExpired is returned for envelopes that were signed by an allowed
+// dispatcher but have expired
+var errEnvelopeExpired = errors.New("envelope expired")
+
+// jobVerifier checks job envelopes against the allowlisted dispatchers and
+// remembers nonces until their envelopes expire, so replays are refused.
+// JetStream delivers a message again with the same stream sequence, which
+// is not a replay; a replayed envelope is stored as a new message.
+type jobVerifier struct {
+	agentAddress  string
+	dispatchers   map[common.Address]bool
+	maxTTL        time.Duration
+	allowUnsigned bool
+
+	mu   sync.Mutex
+	seen map[string]seenNonce // keyed by "<signer>/<nonce>"
+}
+
+// seenNonce is a nonce's envelope expiry and the stream sequence of the
+// message that first carried it, or 0 if that message was not stored
+type seenNonce struct {
+	expiresAt time.Time
+	sequence  uint64
+}
+
+// newJobVerifier creates a verifier for envelopes addressed to agentAddress.
+// Unless allowUnsigned is set, at least one dispatcher must be allowed.
+func newJobVerifier(agentAddress string, dispatchers []string, maxTTL time.Duration, allowUnsigned bool) (*jobVerifier, error) {
+	v := &jobVerifier{
+		agentAddress:  agentAddress,
+		dispatchers:   make(map[common.Address]bool),
+		maxTTL:        maxTTL,
+		allowUnsigned: allowUnsigned,
+		seen:          make(map[string]seenNonce),
+	}
+	for _, dispatcher := range dispatchers {
+		dispatcher = strings.TrimSpace(dispatcher)
+		if dispatcher == "" {
+			continue
+		}
+		if !common.IsHexAddress(dispatcher) {
+			return nil, fmt.Errorf("invalid dispatcher address %q", dispatcher)
+		}
+		v.dispatchers[common.HexToAddress(dispatcher)] = true
+	}
+	if len(v.dispatchers) == 0 && !allowUnsigned {
+		return nil, errors.New("DISPATCHER_ADDRESSES must list at least one dispatcher unless ALLOW_UNSIGNED_JOBS is set")
+	}
+	return v, nil
+}
+
+// Open verifies a signed envelope and returns its payload and signer.
+// sequence is the message's stream sequence, or 0 if it is not stored.
+// Unsigned messages are returned as they are only when allowUnsigned is set.
+// An expired envelope's payload is returned along with an error wrapping
+// errEnvelopeExpired, so the job it carried can be reported; it must not be run.
+func (v *jobVerifier) Open(msg []byte, sequence uint64, now time.Time) ([]byte, string, error) {
+	var envelope JobEnvelope
+	if err := json.Unmarshal(msg, &envelope); err != nil || envelope.Signature == "" {
+		if v.allowUnsigned {
+			return msg, "", nil
+		}
+		return nil, "", errUnsignedJob
+	}
+
+	signer, err := v.recoverSigner(envelope)
+	if err != nil {
+		return nil, "", err
+	}
+	if !v.dispatchers[signer] {
+		return nil, signer.Hex(), fmt.Errorf("signer %s is not an allowed dispatcher", signer.Hex())
+	}
+
+	expiresAt := time.Unix(envelope.ExpiresAt, 0)
+	switch {
+	case envelope.Nonce == "":
+		return nil, signer.Hex(), errors.New("envelope has no nonce")
+	case !expiresAt.After(now):
+		return []byte(envelope.Payload), signer.Hex(), fmt.Errorf("%w at %s", errEnvelopeExpired, expiresAt.UTC().Format(time.RFC3339))
+	case v.maxTTL > 0 && expiresAt.Sub(now) > v.maxTTL:
+		return nil, signer.Hex(), fmt.Errorf("envelope expires more than %s ahead", v.maxTTL)
+	}
+
+	if !v.remember(signer.Hex()+"/"+envelope.Nonce, sequence, expiresAt, now) {
+		return nil, signer.Hex(), fmt.Errorf("nonce %q was already used", envelope.Nonce)
+	}
+	return []byte(envelope.Payload), signer.Hex(), nil
+}
+
+// recoverSigner returns the address that signed an envelope. Signatures are
+// made with personal_sign (EIP-191) over the envelope's signing message, with
+// a recovery ID of 0/1 or 27/28.
+func (v *jobVerifier) recoverSigner(envelope JobEnvelope) (common.Address, error) {
+	signature, err := hexutil.Decode(envelope.Signature)
+	if err != nil || len(signature) != crypto.SignatureLength {
+		return common.Address{}, errors.New("signature must be 65 bytes of 0x-prefixed hex")
+	}
+	if signature[crypto.RecoveryIDOffset] >= 27 {
+		signature[crypto.RecoveryIDOffset] -= 27
+	}
+
+	hash := accounts.TextHash(signingMessage(v.agentAddress, envelope))
+	pub, err := crypto.SigToPub(hash, signature)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid signature: %w", err)
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// signingMessage is what a dispatcher signs. It binds the payload to the
+// receiving agent, so an envelope cannot be replayed to another agent:
+//
+//	lamda-job:<agent address, lowercase>:<nonce>:<expires_at>:<payload>
+func signingMessage(agentAddress string, envelope JobEnvelope) []byte {
+	return []byte(fmt.Sprintf("lamda-job:%s:%s:%d:%s",
+		strings.ToLower(agentAddress), envelope.Nonce, envelope.ExpiresAt, envelope.Payload))
+}
+
+// remember records a nonce until expiresAt. It returns false if the nonce
+// was already used by another message, or by a message that was not stored,
+// and forgets nonces whose envelopes have expired.
+func (v *jobVerifier) remember(key string, sequence uint64, expiresAt, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for seenKey, seen := range v.seen {
+		if !seen.expiresAt.After(now) {
+			delete(v.seen, seenKey)
+		}
+	}
+	if seen, ok := v.seen[key]; ok {
+		return sequence != 0 && seen.sequence == sequence
+	}
+	v.seen[key] = seenNonce{expiresAt: expiresAt, sequence: sequence}
+	return true
+}
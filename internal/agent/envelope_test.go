@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestJobVerifierNonces(t *testing.T) {
+	const agentAddress = "0x1111111111111111111111111111111111111111"
+	dispatcher, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	signed := func(nonce string, expiresAt time.Time) []byte {
+		envelope := JobEnvelope{Payload: `{"job_id":"job-1"}`, Nonce: nonce, ExpiresAt: expiresAt.Unix()}
+		signature, err := crypto.Sign(accounts.TextHash(signingMessage(agentAddress, envelope)), dispatcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope.Signature = hexutil.Encode(signature)
+		msg, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	type delivery struct {
+		nonce    string
+		sequence uint64
+		at       time.Duration // after now
+		wantErr  bool
+	}
+	tests := []struct {
+		name       string
+		deliveries []delivery
+	}{
+		{name: "redelivered stored message", deliveries: []delivery{
+			{nonce: "a", sequence: 7},
+			{nonce: "a", sequence: 7},
+			{nonce: "a", sequence: 7},
+		}},
+		{name: "replay stored again", deliveries: []delivery{
+			{nonce: "a", sequence: 7},
+			{nonce: "a", sequence: 8, wantErr: true},
+		}},
+		{name: "replay over core NATS", deliveries: []delivery{
+			{nonce: "a"},
+			{nonce: "a", wantErr: true},
+		}},
+		{name: "core NATS replay of a stored message", deliveries: []delivery{
+			{nonce: "a", sequence: 7},
+			{nonce: "a", wantErr: true},
+		}},
+		{name: "stored replay of a core NATS message", deliveries: []delivery{
+			{nonce: "a"},
+			{nonce: "a", sequence: 7, wantErr: true},
+		}},
+		{name: "distinct nonces", deliveries: []delivery{
+			{nonce: "a"},
+			{nonce: "b"},
+			{nonce: "c", sequence: 7},
+			{nonce: "d", sequence: 7},
+		}},
+		{name: "redelivered after expiry", deliveries: []delivery{
+			{nonce: "a", sequence: 7},
+			{nonce: "a", sequence: 7, at: 2 * time.Minute, wantErr: true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newJobVerifier(agentAddress, []string{crypto.PubkeyToAddress(dispatcher.PublicKey).Hex()}, 10*time.Minute, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, d := range tt.deliveries {
+				msg := signed(d.nonce, now.Add(time.Minute))
+				_, _, err := v.Open(msg, d.sequence, now.Add(d.at))
+				if gotErr := err != nil; gotErr != d.wantErr {
+					t.Errorf("delivery %d of nonce %q at sequence %d: error = %v, want error %t", i, d.nonce, d.sequence, err, d.wantErr)
+				}
+			}
+		})
+	}
+}
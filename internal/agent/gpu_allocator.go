@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"lamda_node_agent/internal/hwinfo"
+)
+
+// gpuAllocator tracks which GPUs are assigned to running jobs
+type gpuAllocator struct {
+	mu    sync.Mutex
+	gpus  []hwinfo.GPU
+	inUse map[string]string // GPU UUID -> job ID
+
+	// released is closed and replaced whenever GPUs are returned to the pool
+	released chan struct{}
+}
+
+// newGPUAllocator creates an allocator over the detected GPU inventory
+func newGPUAllocator(gpus []hwinfo.GPU) *gpuAllocator {
+	return &gpuAllocator{
+		gpus:     gpus,
+		inUse:    make(map[string]string),
+		released: make(chan struct{}),
+	}
+}
+
+// Total returns the number of GPUs on the node
+func (g *gpuAllocator) Total() int {
+	return len(g.gpus)
+}
+
+// Inventory returns the node's GPUs
+func (g *gpuAllocator) Inventory() []hwinfo.GPU {
+	return g.gpus
+}
+
+// Assigned returns the UUIDs of the GPUs assigned to jobs, mapped to the job IDs
+func (g *gpuAllocator) Assigned() map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	assigned := make(map[string]string, len(g.inUse))
+	for uuid, jobID := range g.inUse {
+		assigned[uuid] = jobID
+	}
+	return assigned
+}
+
+// Free returns the number of GPUs not assigned to any job
+func (g *gpuAllocator) Free() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.gpus) - len(g.inUse)
+}
+
+// Eligible returns the number of GPUs with at least minVRAM MiB of memory
+func (g *gpuAllocator) Eligible(minVRAM uint64) int {
+	eligible := 0
+	for _, gpu := range g.gpus {
+		if gpu.MemoryTotalMiB >= minVRAM {
+			eligible++
+		}
+	}
+	return eligible
+}
+
+// Acquire assigns count free GPUs with at least minVRAM MiB of memory to a
+// job, lowest index first, waiting for other jobs to release GPUs if not
+// enough are free
+func (g *gpuAllocator) Acquire(ctx context.Context, jobID string, count int, minVRAM uint64) ([]hwinfo.GPU, error) {
+	if eligible := g.Eligible(minVRAM); count > eligible {
+		return nil, fmt.Errorf("job requests %d GPU(s) with %d MiB but node has %d", count, minVRAM, eligible)
+	}
+
+	for {
+		g.mu.Lock()
+		if g.freeLocked(minVRAM) >= count {
+			allocated := g.allocateLocked(jobID, count, minVRAM)
+			g.mu.Unlock()
+			return allocated, nil
+		}
+		released := g.released
+		g.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// freeLocked returns the number of free GPUs with at least minVRAM MiB of
+// memory. The caller must hold g.mu.
+func (g *gpuAllocator) freeLocked(minVRAM uint64) int {
+	free := 0
+	for _, gpu := range g.gpus {
+		if _, busy := g.inUse[gpu.UUID]; !busy && gpu.MemoryTotalMiB >= minVRAM {
+			free++
+		}
+	}
+	return free
+}
+
+// allocateLocked assigns count free GPUs with at least minVRAM MiB of memory
+// to a job. The caller must hold g.mu and have checked that enough are free.
+func (g *gpuAllocator) allocateLocked(jobID string, count int, minVRAM uint64) []hwinfo.GPU {
+	allocated := make([]hwinfo.GPU, 0, count)
+	for _, gpu := range g.gpus {
+		if len(allocated) == count {
+			break
+		}
+		if _, busy := g.inUse[gpu.UUID]; busy || gpu.MemoryTotalMiB < minVRAM {
+			continue
+		}
+		g.inUse[gpu.UUID] = jobID
+		allocated = append(allocated, gpu)
+	}
+
+	return allocated
+}
+
+// Release returns all GPUs assigned to a job to the free pool
+func (g *gpuAllocator) Release(jobID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for uuid, owner := range g.inUse {
+		if owner == jobID {
+			delete(g.inUse, uuid)
+		}
+	}
+
+	close(g.released)
+	g.released = make(chan struct{})
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+
+	"lamda_node_agent/internal/docker"
+	"lamda_node_agent/internal/encryption"
+	"lamda_node_agent/internal/storage"
+)
+
+// stagedInputs are a job's inputs ready to be mounted into its container
+type stagedInputs struct {
+	mounts []docker.InputMount
+	cached []*storage.CachedInput
+}
+
+// Release returns the job's cached inputs to the cache
+func (s *stagedInputs) Release() {
+	for _, input := range s.cached {
+		input.Release()
+	}
+}
+
+// stageInputs prepares a job's inputs under inputDir. Cached inputs are
+// mounted read-only instead of being copied; others are downloaded into
+// inputDir. Encrypted inputs are always decrypted into inputDir, next to
+// which the ciphertext is staged. The caller must release the staged inputs
+// once the job is done, including when an error is returned.
+func (a *Agent) stageInputs(ctx context.Context, jobMsg JobMessage, inputDir string) (*stagedInputs, error) {
+	staged := &stagedInputs{}
+	key, err := a.inputKey(jobMsg)
+	if err != nil {
+		return staged, err
+	}
+	stagingRoot := filepath.Dir(inputDir)
+
+	if jobMsg.InputFileCID != "" {
+		cached, err := a.storageManager.AcquireInput(ctx, jobMsg.InputFileCID)
+		if err != nil {
+			return staged, fmt.Errorf("failed to fetch input data: %w", err)
+		}
+
+		switch {
+		case cached == nil && key != nil:
+			err := decryptDownload(stagingRoot, inputDir, key, func(dir string) (string, error) {
+				return dir, a.storageManager.DownloadInput(ctx, jobMsg.InputFileCID, dir)
+			})
+			if err != nil {
+				return staged, fmt.Errorf("failed to download input data: %w", err)
+			}
+		case cached == nil:
+			if err := a.storageManager.DownloadInput(ctx, jobMsg.InputFileCID, inputDir); err != nil {
+				return staged, fmt.Errorf("failed to download input data: %w", err)
+			}
+		case key != nil:
+			dest := inputDir
+			if !cached.IsDir {
+				dest = filepath.Join(inputDir, "input")
+			}
+			err := encryption.DecryptTree(cached.Path, dest, key)
+			cached.Release()
+			if err != nil {
+				return staged, fmt.Errorf("failed to decrypt input data: %w", err)
+			}
+		case !cached.IsDir:
+			staged.add(cached, "/input/input")
+		case len(jobMsg.Inputs) == 0:
+			staged.add(cached, "/input")
+		default:
+			// Named inputs are mounted inside /input, which must stay writable
+			// on the host for Docker to create their mount points
+			err := cached.CopyTo(inputDir)
+			cached.Release()
+			if err != nil {
+				return staged, fmt.Errorf("failed to copy cached input data: %w", err)
+			}
+		}
+	}
+
+	for _, input := range jobMsg.Inputs {
+		cached, err := a.storageManager.AcquireInput(ctx, input.CID)
+		if err != nil {
+			return staged, fmt.Errorf("failed to fetch input %s: %w", input.Path, err)
+		}
+		dest := filepath.Join(inputDir, filepath.FromSlash(input.Path))
+
+		switch {
+		case cached != nil && key != nil:
+			err := encryption.DecryptTree(cached.Path, dest, key)
+			cached.Release()
+			if err != nil {
+				return staged, fmt.Errorf("failed to decrypt input %s: %w", input.Path, err)
+			}
+		case cached != nil:
+			staged.add(cached, path.Join("/input", path.Clean(input.Path)))
+		case key != nil:
+			err := decryptDownload(stagingRoot, dest, key, func(dir string) (string, error) {
+				content := filepath.Join(dir, "content")
+				return content, a.storageManager.DownloadTo(ctx, input.CID, content)
+			})
+			if err != nil {
+				return staged, fmt.Errorf("failed to download input %s: %w", input.Path, err)
+			}
+		default:
+			if err := a.storageManager.DownloadTo(ctx, input.CID, dest); err != nil {
+				return staged, fmt.Errorf("failed to download input %s: %w", input.Path, err)
+			}
+		}
+	}
+
+	if len(staged.cached) > 0 {
+		stats := a.storageManager.CacheStats()
+		log.Printf("Input cache: %d hit(s), %d miss(es), %d eviction(s), %d/%d bytes in %d entries",
+			stats.Hits, stats.Misses, stats.Evictions, stats.SizeBytes, stats.MaxBytes, stats.Entries)
+	}
+	return staged, nil
+}
+
+// add records a cached input mounted at target
+func (s *stagedInputs) add(cached *storage.CachedInput, target string) {
+	s.cached = append(s.cached, cached)
+	s.mounts = append(s.mounts, docker.InputMount{Source: cached.Path, Target: target})
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"lamda_node_agent/internal/config"
+	"lamda_node_agent/internal/storage"
+)
+
+// fixtureRoot is the CID of storage/testdata/dir_v1.car, a small directory
+const fixtureRoot = "bafybeichyt4ac6fdhxtwq7uu5omz6a7yavhjmsnllksds4ndye5iq5lwea"
+
+func TestStageInputsReportsIntegrityFailures(t *testing.T) {
+	tampers := []struct {
+		name   string
+		tamper func(sections [][]byte) [][]byte
+	}{
+		{
+			name: "corrupted block",
+			tamper: func(sections [][]byte) [][]byte {
+				last := bytes.Clone(sections[len(sections)-1])
+				last[len(last)-1] ^= 0xff
+				return append(sections[:len(sections)-1], last)
+			},
+		},
+		{
+			// The first section after the header holds the root block
+			name:   "missing root",
+			tamper: func(sections [][]byte) [][]byte { return slices.Delete(sections, 1, 2) },
+		},
+	}
+	jobs := []struct {
+		name  string
+		job   JobMessage
+		cache bool
+	}{
+		{name: "input_file_cid", job: JobMessage{InputFileCID: fixtureRoot}},
+		{name: "named input", job: JobMessage{Inputs: []NamedInput{{CID: "ipfs://" + fixtureRoot, Path: "data"}}}},
+		{name: "cached input", job: JobMessage{InputFileCID: fixtureRoot}, cache: true},
+	}
+
+	for _, backend := range []string{"gateway", "kubo"} {
+		for _, tt := range tampers {
+			for _, jt := range jobs {
+				t.Run(backend+"/"+tt.name+"/"+jt.name, func(t *testing.T) {
+					car := joinCAR(tt.tamper(splitCAR(t, readStorageFixture(t, "dir_v1.car"))))
+					manager := newTamperedStorage(t, backend, car, jt.cache)
+					a := &Agent{storageManager: manager}
+
+					inputDir := filepath.Join(t.TempDir(), "input")
+					if err := os.MkdirAll(inputDir, 0755); err != nil {
+						t.Fatal(err)
+					}
+					inputs, err := a.stageInputs(context.Background(), jt.job, inputDir)
+					defer inputs.Release()
+					if err == nil {
+						t.Fatal("stageInputs succeeded, want an error")
+					}
+
+					status, code := downloadFailure(context.Background(), err)
+					if status != StatusIntegrityFailed || code != ErrorInputIntegrity {
+						t.Errorf("downloadFailure(%v) = %s, %s, want %s, %s", err, status, code, StatusIntegrityFailed, ErrorInputIntegrity)
+					}
+				})
+			}
+		}
+	}
+}
+
+// newTamperedStorage creates a storage manager whose IPFS backend is served
+// car for every CID, by a fake gateway or Kubo node
+func newTamperedStorage(t *testing.T, backend string, car []byte, cache bool) storage.Manager {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/dag/export" && !strings.HasPrefix(r.URL.Path, "/ipfs/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+		w.Write(car)
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := &config.Config{
+		StorageBackend:   backend,
+		PinataJWT:        "jwt",
+		IPFSGatewayURLs:  []string{server.URL},
+		KuboAPIURL:       server.URL,
+		DownloadAttempts: 1,
+	}
+	if cache {
+		cfg.InputCacheDir = t.TempDir()
+		cfg.InputCacheSizeMB = 1
+	}
+	manager, err := storage.NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+// readStorageFixture reads one of the storage package's test CARs
+func readStorageFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("..", "storage", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// splitCAR splits a CARv1 into its length-prefixed header and block sections
+func splitCAR(t *testing.T, car []byte) [][]byte {
+	t.Helper()
+	var sections [][]byte
+	for len(car) > 0 {
+		length, n := binary.Uvarint(car)
+		if n <= 0 || uint64(len(car)-n) < length {
+			t.Fatal("malformed CAR fixture")
+		}
+		sections = append(sections, car[n:n+int(length)])
+		car = car[n+int(length):]
+	}
+	return sections
+}
+
+// joinCAR joins sections into a CARv1
+func joinCAR(sections [][]byte) []byte {
+	var car []byte
+	for _, section := range sections {
+		car = binary.AppendUvarint(car, uint64(len(section)))
+		car = append(car, section...)
+	}
+	return car
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"lamda_node_agent/internal/nats"
+)
+
+// Job stages tracked while a job is on the agent
+const (
+	stageQueued      = "queued"
+	stagePreparing   = "preparing" // reported only as the stage a job failed in
+	stageDownloading = "downloading"
+	stageRunning     = "running"
+	stageUploading   = "uploading"
+)
+
+// trackedJob is the agent's record of a queued or running job
+type trackedJob struct {
+	stage           string
+	delivery        nats.JobDelivery   // settled when the job has a final status
+	cancel          context.CancelFunc // set once the job starts
+	cancelRequested bool
+}
+
+// jobRegistry tracks the jobs on the agent so they can be cancelled by ID
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*trackedJob
+}
+
+// newJobRegistry creates an empty job registry
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{
+		jobs: make(map[string]*trackedJob),
+	}
+}
+
+// Add records a newly queued job and the message it arrived in. It returns
+// false if the job ID is already known.
+func (r *jobRegistry) Add(jobID string, delivery nats.JobDelivery) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.jobs[jobID]; exists {
+		return false
+	}
+	r.jobs[jobID] = &trackedJob{stage: stageQueued, delivery: delivery}
+	return true
+}
+
+// Redeliver hands a job over to a later delivery of the message it arrived
+// in, and returns the delivery it replaces. It returns false if the job is
+// unknown or arrived in a different message.
+func (r *jobRegistry) Redeliver(jobID string, delivery nats.JobDelivery) (nats.JobDelivery, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[jobID]
+	if !ok || delivery.Sequence() == 0 || job.delivery.Sequence() != delivery.Sequence() {
+		return nil, false
+	}
+	previous := job.delivery
+	job.delivery = delivery
+	return previous, true
+}
+
+// Delivery returns the message a job arrived in and whether the job was
+// cancelled on request, or false if the job is unknown
+func (r *jobRegistry) Delivery(jobID string) (nats.JobDelivery, bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[jobID]
+	if !ok {
+		return nil, false, false
+	}
+	return job.delivery, job.cancelRequested, true
+}
+
+// Start attaches the job's cancel function. It returns false if the job was
+// cancelled while it was still queued.
+func (r *jobRegistry) Start(jobID string, cancel context.CancelFunc) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[jobID]
+	if !ok || job.cancelRequested {
+		return false
+	}
+	job.cancel = cancel
+	return true
+}
+
+// SetStage records the stage a job has reached
+func (r *jobRegistry) SetStage(jobID, stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, ok := r.jobs[jobID]; ok {
+		job.stage = stage
+	}
+}
+
+// Cancel cancels a job at whatever stage it is in. It returns the stage the
+// job was in, or false if the job is unknown or already finished.
+func (r *jobRegistry) Cancel(jobID string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[jobID]
+	if !ok {
+		return "", false
+	}
+	job.cancelRequested = true
+	if job.cancel != nil {
+		job.cancel()
+	}
+	return job.stage, true
+}
+
+// Counts returns how many jobs are queued and how many have started
+func (r *jobRegistry) Counts() (queued, running int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, job := range r.jobs {
+		if job.stage == stageQueued {
+			queued++
+		} else {
+			running++
+		}
+	}
+	return queued, running
+}
+
+// Remove forgets a finished job
+func (r *jobRegistry) Remove(jobID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.jobs, jobID)
+}
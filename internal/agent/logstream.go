@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"lamda_node_agent/internal/docker"
+	"lamda_node_agent/internal/nats"
+)
+
+// logFlushInterval is how often buffered log output is published
+const logFlushInterval = 500 * time.Millisecond
+
+// lineTruncatedMarker ends a line that alone is larger than a flush's budget
+const lineTruncatedMarker = " [line truncated]\n"
+
+// LogChunk is a piece of a running job's output published to jobs.logs.<job_id>
+type LogChunk struct {
+	JobID  string `json:"job_id"`
+	Seq    uint64 `json:"seq"`
+	Stream string `json:"stream"` // "stdout" or "stderr"
+	Data   string `json:"data"`   // one or more lines of output, each ending in a newline
+
+	// Dropped counts bytes of this stream discarded by the rate limit since
+	// the previous chunk
+	Dropped   int64     `json:"dropped,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// logStreamer publishes a job's container output to NATS while it runs. Output
+// is buffered and flushed every logFlushInterval; anything beyond the rate
+// limit is dropped and counted, so a chatty job cannot flood the bus.
+type logStreamer struct {
+	mu       sync.Mutex
+	jobID    string
+	subject  string
+	client   nats.Client
+	budget   int // bytes that may be buffered per flush across both streams
+	buffered int
+	seq      uint64
+	buffers  map[string][]byte
+	dropped  map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newLogStreamer starts streaming a job's logs at up to bytesPerSecond
+func newLogStreamer(client nats.Client, jobID string, bytesPerSecond int) *logStreamer {
+	budget := int(int64(bytesPerSecond) * int64(logFlushInterval) / int64(time.Second))
+	if budget < 1 {
+		budget = 1
+	}
+
+	s := &logStreamer{
+		jobID:   jobID,
+		subject: fmt.Sprintf("jobs.logs.%s", jobID),
+		client:  client,
+		budget:  budget,
+		buffers: make(map[string][]byte),
+		dropped: make(map[string]int64),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// HandleLogLine buffers a line of the job's output for the next flush. It
+// never blocks on NATS.
+func (s *logStreamer) HandleLogLine(line docker.LogLine) {
+	s.write(line.Stream, []byte(line.Line+"\n"))
+}
+
+// Close publishes any remaining buffered output and stops the streamer
+func (s *logStreamer) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+// run flushes buffered output until the streamer is closed
+func (s *logStreamer) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// write buffers a line for a stream. A line that does not fit in what is
+// left of the budget is dropped whole, unless it is larger than the whole
+// budget and could never fit: it is then cut short to what is left and ends
+// with lineTruncatedMarker.
+func (s *logStreamer) write(stream string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remaining := s.budget - s.buffered
+	switch {
+	case len(p) <= remaining:
+		s.buffers[stream] = append(s.buffers[stream], p...)
+		s.buffered += len(p)
+	case len(p) > s.budget && remaining > len(lineTruncatedMarker):
+		// Cut on a rune boundary so the chunk stays valid UTF-8
+		keep := remaining - len(lineTruncatedMarker)
+		for keep > 0 && !utf8.RuneStart(p[keep]) {
+			keep--
+		}
+		s.buffers[stream] = append(append(s.buffers[stream], p[:keep]...), lineTruncatedMarker...)
+		s.buffered += keep + len(lineTruncatedMarker)
+		s.dropped[stream] += int64(len(p) - keep)
+	default:
+		s.dropped[stream] += int64(len(p))
+	}
+}
+
+// flush publishes one chunk per stream with buffered output or dropped bytes
+func (s *logStreamer) flush() {
+	s.mu.Lock()
+	var chunks []LogChunk
+	for _, stream := range []string{docker.StreamStdout, docker.StreamStderr} {
+		if len(s.buffers[stream]) == 0 && s.dropped[stream] == 0 {
+			continue
+		}
+		s.seq++
+		chunks = append(chunks, LogChunk{
+			JobID:     s.jobID,
+			Seq:       s.seq,
+			Stream:    stream,
+			Data:      string(s.buffers[stream]),
+			Dropped:   s.dropped[stream],
+			Timestamp: time.Now(),
+		})
+		s.buffers[stream] = nil
+		s.dropped[stream] = 0
+	}
+	s.buffered = 0
+	s.mu.Unlock()
+
+	for _, chunk := range chunks {
+		chunkBytes, err := json.Marshal(chunk)
+		if err != nil {
+			log.Printf("Failed to marshal log chunk: %v", err)
+			continue
+		}
+		if err := s.client.PublishLogChunk(context.Background(), s.subject, chunkBytes); err != nil {
+			log.Printf("Failed to publish log chunk for job %s: %v", s.jobID, err)
+		}
+	}
+}
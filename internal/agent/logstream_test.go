@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"lamda_node_agent/internal/docker"
+)
+
+func TestLogStreamerWriteBudget(t *testing.T) {
+	long := strings.Repeat("x", 200) + "\n"
+	tests := []struct {
+		name        string
+		lines       []string
+		wantData    string
+		wantDropped int64
+	}{
+		{
+			name:     "lines within the budget",
+			lines:    []string{"one\n", "two\n"},
+			wantData: "one\ntwo\n",
+		},
+		{
+			name:        "line that does not fit what is left is dropped whole",
+			lines:       []string{strings.Repeat("a", 60) + "\n", strings.Repeat("b", 60) + "\n"},
+			wantData:    strings.Repeat("a", 60) + "\n",
+			wantDropped: 61,
+		},
+		{
+			name:        "line larger than the budget is cut short",
+			lines:       []string{long},
+			wantData:    strings.Repeat("x", 100-len(lineTruncatedMarker)) + lineTruncatedMarker,
+			wantDropped: int64(len(long) - (100 - len(lineTruncatedMarker))),
+		},
+		{
+			name:        "line larger than the budget fills what is left",
+			lines:       []string{"one\n", long},
+			wantData:    "one\n" + strings.Repeat("x", 96-len(lineTruncatedMarker)) + lineTruncatedMarker,
+			wantDropped: int64(len(long) - (96 - len(lineTruncatedMarker))),
+		},
+		{
+			name:        "no room left for a cut line",
+			lines:       []string{strings.Repeat("a", 90) + "\n", long},
+			wantData:    strings.Repeat("a", 90) + "\n",
+			wantDropped: int64(len(long)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &logStreamer{budget: 100, buffers: map[string][]byte{}, dropped: map[string]int64{}}
+			for _, line := range tt.lines {
+				s.write(docker.StreamStdout, []byte(line))
+			}
+
+			if got := string(s.buffers[docker.StreamStdout]); got != tt.wantData {
+				t.Errorf("buffered %q, want %q", got, tt.wantData)
+			}
+			if got := s.dropped[docker.StreamStdout]; got != tt.wantDropped {
+				t.Errorf("dropped %d bytes, want %d", got, tt.wantDropped)
+			}
+			if s.buffered > s.budget {
+				t.Errorf("buffered %d bytes, over the %d byte budget", s.buffered, s.budget)
+			}
+		})
+	}
+}
+
+func TestLogStreamerCutsOnRuneBoundary(t *testing.T) {
+	s := &logStreamer{budget: 100, buffers: map[string][]byte{}, dropped: map[string]int64{}}
+	s.write(docker.StreamStderr, []byte("a"+strings.Repeat("é", 100)+"\n"))
+
+	data := s.buffers[docker.StreamStderr]
+	if !utf8.Valid(data) {
+		t.Errorf("cut line %q is not valid UTF-8", data)
+	}
+	if !strings.HasSuffix(string(data), lineTruncatedMarker) {
+		t.Errorf("cut line %q does not end with the truncation marker", data)
+	}
+}
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Version is the agent's version, set at build time with
+// -ldflags "-X lamda_node_agent/internal/agent.Version=<version>"
+var Version = "dev"
+
+// Presence statuses
+const (
+	presenceOnline  = "online"
+	presenceOffline = "offline"
+)
+
+// presenceListTimeout bounds listing the node's images for a presence message
+const presenceListTimeout = 5 * time.Second
+
+// Presence announces whether the agent is reachable, what it can run and how
+// much work it can take. It is published on agents.presence.<agent_address>.
+type Presence struct {
+	AgentAddress    string        `json:"agent_address"`
+	Status          string        `json:"status" enum:"online,offline"`
+	AgentVersion    string        `json:"agent_version"`
+	JobSpecVersions []int         `json:"job_spec_versions"`
+	GPUs            []PresenceGPU `json:"gpus"`
+	FreeGPUs        int           `json:"free_gpus"`
+	FreeSlots       int           `json:"free_slots"`
+	RunningJobs     int           `json:"running_jobs"`
+	QueuedJobs      int           `json:"queued_jobs"`
+	CachedImages    []string      `json:"cached_images"`
+	CachedInputs    []string      `json:"cached_inputs"` // CIDs held in the input cache
+	InputCache      PresenceCache `json:"input_cache"`
+	Timestamp       time.Time     `json:"timestamp"`
+}
+
+// PresenceCache are the input cache's counters since the agent started,
+// and its current size. They are all 0 when the cache is disabled.
+type PresenceCache struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	SizeBytes int64  `json:"size_bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// PresenceGPU is one GPU in the agent's inventory
+type PresenceGPU struct {
+	Index             int    `json:"index"`
+	UUID              string `json:"uuid"`
+	Name              string `json:"name"`
+	MemoryTotalMiB    uint64 `json:"memory_total_mib"`
+	ComputeCapability string `json:"compute_capability,omitempty"`
+	InUse             bool   `json:"in_use"`
+}
+
+// startPresence publishes the agent's presence every PRESENCE_INTERVAL until
+// ctx is done; 0 disables the periodic messages
+func (a *Agent) startPresence(ctx context.Context) {
+	if a.cfg.PresenceInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.cfg.PresenceInterval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.publishPresence(presenceOnline)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// publishPresence publishes the agent's presence with the given status
+func (a *Agent) publishPresence(status string) {
+	presence, err := json.Marshal(a.presence(status))
+	if err != nil {
+		log.Printf("Failed to marshal presence: %v", err)
+		return
+	}
+
+	subject := fmt.Sprintf("agents.presence.%s", a.address)
+	if err := a.natsClient.PublishPresence(context.Background(), subject, presence); err != nil {
+		log.Printf("Failed to publish presence: %v", err)
+	}
+}
+
+// presence describes the agent's current state
+func (a *Agent) presence(status string) Presence {
+	queued, running := a.jobs.Counts()
+	freeSlots := a.scheduler.workers - running
+	if freeSlots < 0 {
+		freeSlots = 0
+	}
+
+	assigned := a.gpuAllocator.Assigned()
+	inventory := a.gpuAllocator.Inventory()
+	gpus := make([]PresenceGPU, 0, len(inventory))
+	for _, gpu := range inventory {
+		_, inUse := assigned[gpu.UUID]
+		gpus = append(gpus, PresenceGPU{
+			Index:             gpu.Index,
+			UUID:              gpu.UUID,
+			Name:              gpu.Name,
+			MemoryTotalMiB:    gpu.MemoryTotalMiB,
+			ComputeCapability: gpu.ComputeCapability,
+			InUse:             inUse,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), presenceListTimeout)
+	defer cancel()
+	images, err := a.dockerManager.ListImages(ctx)
+	if err != nil {
+		log.Printf("Failed to list images for presence: %v", err)
+	}
+	cache := a.storageManager.CacheStats()
+
+	return Presence{
+		AgentAddress:    a.address,
+		Status:          status,
+		AgentVersion:    Version,
+		JobSpecVersions: supportedJobSpecVersions,
+		GPUs:            gpus,
+		FreeGPUs:        len(gpus) - len(assigned),
+		FreeSlots:       freeSlots,
+		RunningJobs:     running,
+		QueuedJobs:      queued,
+		CachedImages:    nonNil(images),
+		CachedInputs:    nonNil(a.storageManager.CachedCIDs()),
+		InputCache: PresenceCache{
+			Hits:      cache.Hits,
+			Misses:    cache.Misses,
+			Evictions: cache.Evictions,
+			Entries:   cache.Entries,
+			SizeBytes: cache.SizeBytes,
+			MaxBytes:  cache.MaxBytes,
+		},
+		Timestamp: time.Now(),
+	}
+}
+
+// nonNil returns an empty list for nil, so lists are never sent as null
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
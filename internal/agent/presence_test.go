@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"lamda_node_agent/internal/config"
+	"lamda_node_agent/internal/docker"
+	"lamda_node_agent/internal/hwinfo"
+)
+
+// fakeImages is a Docker manager holding a fixed set of images. It cannot
+// run jobs.
+type fakeImages []string
+
+func (f fakeImages) RunJobContainer(ctx context.Context, spec docker.JobSpec) error {
+	return errors.New("fakeImages cannot run containers")
+}
+
+func (f fakeImages) ListImages(ctx context.Context) ([]string, error) {
+	return f, nil
+}
+
+func TestPresenceDescribesAgent(t *testing.T) {
+	a := newTestAgent(t, func(cfg *config.Config) {
+		cfg.InputCacheSizeMB = 1
+		cfg.InputCacheDir = t.TempDir()
+	})
+	presences := make(chan json.RawMessage, 1)
+	subscribeJSON(t, a.conn, "agents.presence."+a.address, presences)
+	if err := a.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	a.dockerManager = fakeImages{"ghcr.io/org/model:v2"}
+	a.gpuAllocator = newGPUAllocator([]hwinfo.GPU{
+		{Index: 0, UUID: "GPU-0", Name: "NVIDIA RTX 4090", MemoryTotalMiB: 24564, ComputeCapability: "8.9"},
+		{Index: 1, UUID: "GPU-1", Name: "NVIDIA A40", MemoryTotalMiB: 46068},
+	})
+
+	// One job runs on the larger GPU while another waits in the queue
+	if _, err := a.gpuAllocator.Acquire(context.Background(), "job-1", 1, 40000); err != nil {
+		t.Fatal(err)
+	}
+	a.jobs.Add("job-1", &fakeDelivery{})
+	a.jobs.SetStage("job-1", stageRunning)
+	a.jobs.Add("job-2", &fakeDelivery{})
+
+	a.publishPresence(presenceOnline)
+	var got Presence
+	if err := json.Unmarshal(receive(t, presences), &got); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(got.Timestamp) > time.Minute {
+		t.Errorf("timestamp = %s, want the current time", got.Timestamp)
+	}
+	got.Timestamp = time.Time{}
+
+	want := Presence{
+		AgentAddress:    a.address,
+		Status:          presenceOnline,
+		AgentVersion:    Version,
+		JobSpecVersions: supportedJobSpecVersions,
+		GPUs: []PresenceGPU{
+			{Index: 0, UUID: "GPU-0", Name: "NVIDIA RTX 4090", MemoryTotalMiB: 24564, ComputeCapability: "8.9"},
+			{Index: 1, UUID: "GPU-1", Name: "NVIDIA A40", MemoryTotalMiB: 46068, InUse: true},
+		},
+		FreeGPUs:     1,
+		FreeSlots:    0,
+		RunningJobs:  1,
+		QueuedJobs:   1,
+		CachedImages: []string{"ghcr.io/org/model:v2"},
+		CachedInputs: []string{},
+		InputCache:   PresenceCache{MaxBytes: 1024 * 1024},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("presence = %+v, want %+v", got, want)
+	}
+}
+
+func TestPresenceSendsEmptyLists(t *testing.T) {
+	a := newTestAgent(t, nil)
+	presences := make(chan json.RawMessage, 1)
+	subscribeJSON(t, a.conn, "agents.presence."+a.address, presences)
+	if err := a.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	a.dockerManager = fakeImages(nil)
+	a.gpuAllocator = newGPUAllocator(nil)
+
+	a.publishPresence(presenceOffline)
+	raw := string(receive(t, presences))
+	for _, field := range []string{`"status":"offline"`, `"gpus":[]`, `"cached_images":[]`, `"cached_inputs":[]`} {
+		if !strings.Contains(raw, field) {
+			t.Errorf("presence %s does not contain %s", raw, field)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"lamda_node_agent/internal/storage"
+)
+
+// progressReporter publishes a job's transfer progress as status updates, at
+// most once per interval
+type progressReporter struct {
+	agent    *Agent
+	jobID    string
+	status   JobStatus
+	interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// withProgress returns a context whose storage transfers publish progress
+// updates with the given status. It returns ctx unchanged when progress
+// updates are disabled.
+func (a *Agent) withProgress(ctx context.Context, jobID string, status JobStatus) context.Context {
+	if a.cfg.ProgressInterval <= 0 {
+		return ctx
+	}
+
+	reporter := &progressReporter{
+		agent:    a,
+		jobID:    jobID,
+		status:   status,
+		interval: a.cfg.ProgressInterval,
+		last:     time.Now(), // the stage's own status update was just published
+	}
+	return storage.WithProgress(ctx, reporter.Update)
+}
+
+// Update publishes the progress if the interval has passed since the last update
+func (r *progressReporter) Update(p storage.Progress) {
+	r.mu.Lock()
+	now := time.Now()
+	if now.Sub(r.last) < r.interval {
+		r.mu.Unlock()
+		return
+	}
+	r.last = now
+	r.mu.Unlock()
+
+	update := StatusUpdate{
+		JobID:      r.jobID,
+		Status:     r.status,
+		BytesDone:  p.Bytes,
+		BytesTotal: p.Total,
+	}
+	if p.Total > 0 {
+		percent := min(100, math.Round(float64(p.Bytes)*1000/float64(p.Total))/10)
+		update.Percent = &percent
+	}
+	r.agent.publishUpdate(update)
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"fmt"
+
+	"lamda_node_agent/internal/docker"
+)
+
+// ResourceRequest is the container resources a job asks for. Zero values
+// fall back to the node's ceilings from the configuration.
+type ResourceRequest struct {
+	MemoryMB  int64   `json:"memory_mb,omitempty"`
+	CPUs      float64 `json:"cpus,omitempty"`
+	PidsLimit int64   `json:"pids_limit,omitempty"`
+	ShmSizeMB int64   `json:"shm_size_mb,omitempty"`
+}
+
+// resolveResources checks a job's resource request against the node's
+// ceilings and returns the limits to apply to its container
+func (a *Agent) resolveResources(req ResourceRequest) (docker.Resources, error) {
+	if req.MemoryMB < 0 || req.CPUs < 0 || req.PidsLimit < 0 || req.ShmSizeMB < 0 {
+		return docker.Resources{}, fmt.Errorf("resource requests must not be negative")
+	}
+
+	memoryMB, err := applyCeiling("memory_mb", req.MemoryMB, a.cfg.MaxJobMemoryMB)
+	if err != nil {
+		return docker.Resources{}, err
+	}
+	pidsLimit, err := applyCeiling("pids_limit", req.PidsLimit, a.cfg.MaxJobPids)
+	if err != nil {
+		return docker.Resources{}, err
+	}
+	shmSizeMB, err := applyCeiling("shm_size_mb", req.ShmSizeMB, a.cfg.MaxJobShmSizeMB)
+	if err != nil {
+		return docker.Resources{}, err
+	}
+
+	cpus := req.CPUs
+	if a.cfg.MaxJobCPUs > 0 {
+		if cpus > a.cfg.MaxJobCPUs {
+			return docker.Resources{}, fmt.Errorf("cpus %.2f exceeds node limit of %.2f", cpus, a.cfg.MaxJobCPUs)
+		}
+		if cpus == 0 {
+			cpus = a.cfg.MaxJobCPUs
+		}
+	}
+
+	return docker.Resources{
+		MemoryBytes:  memoryMB * 1024 * 1024,
+		NanoCPUs:     int64(cpus * 1e9),
+		PidsLimit:    pidsLimit,
+		ShmSizeBytes: shmSizeMB * 1024 * 1024,
+	}, nil
+}
+
+// applyCeiling returns the requested value, or the ceiling when nothing was
+// requested. A ceiling of 0 means the node sets no limit.
+func applyCeiling(name string, requested, ceiling int64) (int64, error) {
+	if ceiling <= 0 {
+		return requested, nil
+	}
+	if requested > ceiling {
+		return 0, fmt.Errorf("%s %d exceeds node limit of %d", name, requested, ceiling)
+	}
+	if requested == 0 {
+		return ceiling, nil
+	}
+	return requested, nil
+}
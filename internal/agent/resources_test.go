@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"testing"
+
+	"lamda_node_agent/internal/config"
+	"lamda_node_agent/internal/docker"
+)
+
+func TestResolveResources(t *testing.T) {
+	ceilings := &config.Config{MaxJobMemoryMB: 4096, MaxJobCPUs: 4, MaxJobPids: 512, MaxJobShmSizeMB: 256}
+
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		req     ResourceRequest
+		want    docker.Resources
+		wantErr bool
+	}{
+		{
+			name: "defaults to the node ceilings",
+			cfg:  ceilings,
+			want: docker.Resources{MemoryBytes: 4096 << 20, NanoCPUs: 4e9, PidsLimit: 512, ShmSizeBytes: 256 << 20},
+		},
+		{
+			name: "request within the ceilings",
+			cfg:  ceilings,
+			req:  ResourceRequest{MemoryMB: 1024, CPUs: 1.5, PidsLimit: 64, ShmSizeMB: 32},
+			want: docker.Resources{MemoryBytes: 1024 << 20, NanoCPUs: 1.5e9, PidsLimit: 64, ShmSizeBytes: 32 << 20},
+		},
+		{
+			name: "no ceilings",
+			cfg:  &config.Config{},
+			req:  ResourceRequest{MemoryMB: 1024},
+			want: docker.Resources{MemoryBytes: 1024 << 20},
+		},
+		{name: "memory over the ceiling", cfg: ceilings, req: ResourceRequest{MemoryMB: 8192}, wantErr: true},
+		{name: "cpus over the ceiling", cfg: ceilings, req: ResourceRequest{CPUs: 4.5}, wantErr: true},
+		{name: "pids over the ceiling", cfg: ceilings, req: ResourceRequest{PidsLimit: 1024}, wantErr: true},
+		{name: "shm over the ceiling", cfg: ceilings, req: ResourceRequest{ShmSizeMB: 512}, wantErr: true},
+		{name: "negative request", cfg: &config.Config{}, req: ResourceRequest{CPUs: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{cfg: tt.cfg}
+			got, err := a.resolveResources(tt.req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveResources() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveResources() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveResources() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// scheduler runs jobs on a bounded pool of workers fed by a bounded queue.
+// Queued jobs can be taken back out with Remove.
+type scheduler struct {
+	mu        sync.Mutex
+	ready     *sync.Cond // signalled when a job is queued or the workers should stop
+	queue     []JobMessage
+	queueSize int
+	idle      int // workers waiting for a job
+	stopped   bool
+	workers   int
+	run       func(ctx context.Context, job JobMessage)
+	wg        sync.WaitGroup
+}
+
+// newScheduler creates a scheduler with the given concurrency and queue size
+func newScheduler(workers, queueSize int, run func(ctx context.Context, job JobMessage)) *scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	s := &scheduler{
+		queueSize: queueSize,
+		workers:   workers,
+		run:       run,
+	}
+	s.ready = sync.NewCond(&s.mu)
+	return s
+}
+
+// Start launches the workers. They stop picking up new jobs once ctx is done;
+// running jobs receive ctx and are expected to wind down when it is cancelled.
+func (s *scheduler) Start(ctx context.Context) {
+	context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		s.ready.Broadcast()
+		s.mu.Unlock()
+	})
+
+	for i := 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for {
+				job, ok := s.next(ctx)
+				if !ok {
+					return
+				}
+				s.run(ctx, job)
+			}
+		}()
+	}
+}
+
+// next waits for a queued job. It returns false once ctx is done, checking
+// for shutdown first so queued jobs are not started late.
+func (s *scheduler) next(ctx context.Context) (JobMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.idle++
+	for len(s.queue) == 0 && ctx.Err() == nil {
+		s.ready.Wait()
+	}
+	s.idle--
+
+	if ctx.Err() != nil {
+		return JobMessage{}, false
+	}
+	job := s.queue[0]
+	s.queue = slices.Delete(s.queue, 0, 1)
+	return job, true
+}
+
+// Submit queues a job without blocking. It returns false when the queue is
+// full or the scheduler has been stopped. Idle workers count as room in the
+// queue, so a queue size of 0 still accepts jobs a worker can start at once.
+func (s *scheduler) Submit(job JobMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped || len(s.queue) >= s.queueSize+s.idle {
+		return false
+	}
+	s.queue = append(s.queue, job)
+	s.ready.Signal()
+	return true
+}
+
+// Remove takes a job out of the queue. It returns false if the job is not
+// queued, because a worker has already picked it up or it was never queued.
+func (s *scheduler) Remove(jobID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.queue, func(job JobMessage) bool { return job.JobID == jobID })
+	if i < 0 {
+		return false
+	}
+	s.queue = slices.Delete(s.queue, i, i+1)
+	return true
+}
+
+// Stop rejects further submissions, waits for in-flight jobs to finish and
+// returns the jobs that were still queued
+func (s *scheduler) Stop() []JobMessage {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.queue
+	s.queue = nil
+	return pending
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// jobIDs returns the IDs of jobs in order
+func jobIDs(jobs []JobMessage) []string {
+	ids := make([]string, len(jobs))
+	for i, job := range jobs {
+		ids[i] = job.JobID
+	}
+	return ids
+}
+
+func TestSchedulerSubmitRejectsWhenQueueFull(t *testing.T) {
+	s := newScheduler(1, 2, nil)
+
+	for _, jobID := range []string{"job-1", "job-2"} {
+		if !s.Submit(testJob(jobID)) {
+			t.Fatalf("Submit(%s) = false with room in the queue", jobID)
+		}
+	}
+	if s.Submit(testJob("job-3")) {
+		t.Error("Submit succeeded with the queue full")
+	}
+
+	if got, want := jobIDs(s.Stop()), []string{"job-1", "job-2"}; !slices.Equal(got, want) {
+		t.Errorf("Stop() = %v, want %v", got, want)
+	}
+	if s.Submit(testJob("job-4")) {
+		t.Error("Submit succeeded after Stop")
+	}
+}
+
+func TestSchedulerStopWaitsForRunningJobsAndReturnsQueued(t *testing.T) {
+	started := make(chan string)
+	release := make(chan struct{})
+	var finished []string
+	s := newScheduler(1, 4, func(ctx context.Context, job JobMessage) {
+		started <- job.JobID
+		<-release
+		finished = append(finished, job.JobID)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	for _, jobID := range []string{"job-1", "job-2", "job-3"} {
+		if !s.Submit(testJob(jobID)) {
+			t.Fatalf("Submit(%s) = false", jobID)
+		}
+	}
+	if jobID := receive(t, started); jobID != "job-1" {
+		t.Fatalf("started %s first, want job-1", jobID)
+	}
+
+	// Shutdown leaves the queued jobs alone and waits for the running one
+	cancel()
+	pending := make(chan []JobMessage)
+	go func() { pending <- s.Stop() }()
+	expectNothing(t, pending, 100*time.Millisecond)
+
+	close(release)
+	if got, want := jobIDs(receive(t, pending)), []string{"job-2", "job-3"}; !slices.Equal(got, want) {
+		t.Errorf("Stop() = %v, want %v", got, want)
+	}
+	if want := []string{"job-1"}; !slices.Equal(finished, want) {
+		t.Errorf("ran %v, want %v", finished, want)
+	}
+}
+
+func TestSchedulerRemoveFreesQueuedPlace(t *testing.T) {
+	s := newScheduler(1, 2, nil)
+	for _, jobID := range []string{"job-1", "job-2"} {
+		s.Submit(testJob(jobID))
+	}
+
+	if !s.Remove("job-1") {
+		t.Fatal("Remove(job-1) = false for a queued job")
+	}
+	if s.Remove("job-1") {
+		t.Error("Remove(job-1) = true a second time")
+	}
+	if s.Remove("job-9") {
+		t.Error("Remove(job-9) = true for a job that was never queued")
+	}
+	if !s.Submit(testJob("job-3")) {
+		t.Error("Submit failed after a job was removed from the full queue")
+	}
+
+	if got, want := jobIDs(s.Stop()), []string{"job-2", "job-3"}; !slices.Equal(got, want) {
+		t.Errorf("Stop() = %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerWithoutQueueAcceptsJobsForIdleWorkers(t *testing.T) {
+	started := make(chan string)
+	release := make(chan struct{})
+	s := newScheduler(1, 0, func(ctx context.Context, job JobMessage) {
+		started <- job.JobID
+		<-release
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+
+	// Wait for the worker to be idle
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Submit(testJob("job-1")) {
+		if time.Now().After(deadline) {
+			t.Fatal("Submit never succeeded with an idle worker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	receive(t, started)
+	if s.Submit(testJob("job-2")) {
+		t.Error("Submit succeeded with no queue and the only worker busy")
+	}
+
+	close(release)
+	cancel()
+	if pending := s.Stop(); len(pending) != 0 {
+		t.Errorf("Stop() = %v, want nothing queued", jobIDs(pending))
+	}
+}
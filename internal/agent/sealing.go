@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"lamda_node_agent/internal/encryption"
+)
+
+// outputSealer encrypts a job's output and logs to the requester's public key
+type outputSealer struct {
+	key       []byte
+	sealedKey string // key sealed to the requester, reported as output_key
+}
+
+// newOutputSealer creates a fresh data key for a job's output and seals it to
+// the requester. It returns nil when the job's output is not encrypted.
+func newOutputSealer(jobMsg JobMessage) (*outputSealer, error) {
+	if jobMsg.RequesterPublicKey == "" {
+		return nil, nil
+	}
+
+	pub, err := encryption.ParsePublicKey(jobMsg.RequesterPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	sealedKey, err := encryption.SealKey(pub, key)
+	if err != nil {
+		return nil, err
+	}
+	return &outputSealer{key: key, sealedKey: sealedKey}, nil
+}
+
+// Encrypt returns an encrypted copy of dir to upload in its place, or dir
+// itself when s is nil
+func (s *outputSealer) Encrypt(dir string) (string, error) {
+	if s == nil {
+		return dir, nil
+	}
+
+	encrypted := dir + "-encrypted"
+	if err := encryption.EncryptTree(dir, encrypted, s.key); err != nil {
+		return "", fmt.Errorf("failed to encrypt %s: %w", filepath.Base(dir), err)
+	}
+	return encrypted, nil
+}
+
+// SealedKey returns the sealed data key, or an empty string when s is nil
+func (s *outputSealer) SealedKey() string {
+	if s == nil {
+		return ""
+	}
+	return s.sealedKey
+}
+
+// inputKey opens the data key of a job's encrypted inputs with the agent's
+// private key. It returns nil when the inputs are not encrypted.
+func (a *Agent) inputKey(jobMsg JobMessage) ([]byte, error) {
+	if jobMsg.EncryptedKey == "" {
+		return nil, nil
+	}
+	return encryption.OpenKey(a.privateKey, jobMsg.EncryptedKey)
+}
+
+// validateEncryption checks that a job's sealed input key opens with the
+// agent's key and that the requester's public key parses
+func (a *Agent) validateEncryption(jobMsg JobMessage) error {
+	if _, err := a.inputKey(jobMsg); err != nil {
+		return err
+	}
+	if jobMsg.RequesterPublicKey != "" {
+		if _, err := encryption.ParsePublicKey(jobMsg.RequesterPublicKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptDownload downloads an encrypted input into a temporary directory
+// under stagingRoot and decrypts it to dest. download receives the directory
+// and returns the path it wrote the ciphertext to.
+func decryptDownload(stagingRoot, dest string, key []byte, download func(dir string) (string, error)) error {
+	dir, err := os.MkdirTemp(stagingRoot, "encrypted")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, err := download(dir)
+	if err != nil {
+		return err
+	}
+	return encryption.DecryptTree(source, dest, key)
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//go:generate go run ../../cmd/schemagen -out ../../schema
+
+// StatusSchemaVersion is the version of the agent's message formats: the
+// StatusUpdate that carries it, the DispatchReply and the Presence. It
+// changes whenever a field or an allowed value is added, removed or changes
+// meaning. Version 2 added the status "requeued", the error code
+// "envelope_expired", the reply result "requeued", the rejection reason
+// "expired" and the presence's input_cache.
+const StatusSchemaVersion = 2
+
+// JobStatus is the state a status update reports for a job
+type JobStatus string
+
+// Phase statuses mark a stage the job has reached, and "requeued" a job that
+// will be delivered again; every other status is final and is the job's last
+// update
+const (
+	StatusDownloading JobStatus = "downloading"
+	StatusRunning     JobStatus = "running"
+	StatusUploading   JobStatus = "uploading"
+	StatusRequeued    JobStatus = "requeued"
+
+	StatusCompleted        JobStatus = "completed"
+	StatusEmptyOutput      JobStatus = "empty_output"
+	StatusFailed           JobStatus = "failed"
+	StatusIntegrityFailed  JobStatus = "integrity_failed"
+	StatusInputNotFound    JobStatus = "input_not_found"
+	StatusDecryptionFailed JobStatus = "decryption_failed"
+	StatusTimedOut         JobStatus = "timed_out"
+	StatusCancelled        JobStatus = "cancelled"
+	StatusRejected         JobStatus = "rejected"
+	StatusBusy             JobStatus = "busy"
+)
+
+// Enum lists every job status
+func (JobStatus) Enum() []string {
+	return []string{
+		string(StatusDownloading), string(StatusRunning), string(StatusUploading), string(StatusRequeued),
+		string(StatusCompleted), string(StatusEmptyOutput), string(StatusFailed),
+		string(StatusIntegrityFailed), string(StatusInputNotFound), string(StatusDecryptionFailed),
+		string(StatusTimedOut), string(StatusCancelled), string(StatusRejected), string(StatusBusy),
+	}
+}
+
+// Final reports whether a status ends a job, as opposed to marking a stage
+// it has reached
+func (s JobStatus) Final() bool {
+	switch s {
+	case StatusDownloading, StatusRunning, StatusUploading, StatusRequeued:
+		return false
+	}
+	return true
+}
+
+// ErrorCode identifies what went wrong with a job
+type ErrorCode string
+
+const (
+	ErrorInvalidJob       ErrorCode = "invalid_job"
+	ErrorEnvelopeExpired  ErrorCode = "envelope_expired"
+	ErrorWorkspace        ErrorCode = "workspace_error"
+	ErrorGPUAllocation    ErrorCode = "gpu_allocation_failed"
+	ErrorInputDownload    ErrorCode = "input_download_failed"
+	ErrorInputIntegrity   ErrorCode = "input_integrity_failed"
+	ErrorInputNotFound    ErrorCode = "input_not_found"
+	ErrorInputDecryption  ErrorCode = "input_decryption_failed"
+	ErrorContainer        ErrorCode = "container_failed"
+	ErrorOutputEncryption ErrorCode = "output_encryption_failed"
+	ErrorOutputUpload     ErrorCode = "output_upload_failed"
+)
+
+// Enum lists every error code
+func (ErrorCode) Enum() []string {
+	return []string{
+		string(ErrorInvalidJob), string(ErrorEnvelopeExpired), string(ErrorWorkspace), string(ErrorGPUAllocation),
+		string(ErrorInputDownload), string(ErrorInputIntegrity), string(ErrorInputNotFound),
+		string(ErrorInputDecryption), string(ErrorContainer), string(ErrorOutputEncryption),
+		string(ErrorOutputUpload),
+	}
+}
+
+// StatusError describes why a job failed
+type StatusError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Stage is the stage the job failed in; it is omitted for jobs rejected on receipt
+	Stage string `json:"stage,omitempty" enum:"preparing,downloading,running,uploading"`
+}
+
+// jobError describes err as a failure with code at stage
+func jobError(code ErrorCode, stage string, err error) *StatusError {
+	return &StatusError{Code: code, Message: err.Error(), Stage: stage}
+}
+
+// StatusUpdate represents a status update message to NATS. Updates are
+// published to jobs.status.<job_id> and agents.<agent_address>.status.
+type StatusUpdate struct {
+	Version      int       `json:"version"`
+	AgentAddress string    `json:"agent_address"`
+	JobID        string    `json:"job_id"`
+	Status       JobStatus `json:"status"`
+	OutputCID    string    `json:"output_cid,omitempty"` // CID, or URI for location-addressed backends
+	LogsCID      string    `json:"logs_cid,omitempty"`
+	OutputKey    string    `json:"output_key,omitempty"` // data key of encrypted output and logs, sealed to the requester
+	Timestamp    time.Time `json:"timestamp"`
+
+	// Error is set when a stage of the job failed, and always on "failed"
+	Error *StatusError `json:"error,omitempty"`
+
+	// Transfer progress of the downloading and uploading phases. Percent is
+	// omitted while the total size is unknown.
+	Percent    *float64 `json:"percent,omitempty"`
+	BytesDone  int64    `json:"bytes_done,omitempty"`
+	BytesTotal int64    `json:"bytes_total,omitempty"`
+}
+
+// statusSubjects returns the subjects a job's status updates are published
+// to. The per-job subject is left out when the job ID is not a valid subject
+// token, which only happens for jobs rejected on receipt.
+func statusSubjects(agentAddress, jobID string) []string {
+	subjects := []string{fmt.Sprintf("agents.%s.status", agentAddress)}
+	if validSubjectToken(jobID) {
+		subjects = append(subjects, fmt.Sprintf("jobs.status.%s", jobID))
+	}
+	return subjects
+}
+
+// validSubjectToken reports whether s can be used as one token of a NATS subject
+func validSubjectToken(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ".*> \t\r\n")
+}
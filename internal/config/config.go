@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"time"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
@@ -16,6 +17,29 @@ type Config struct {
 
 	// NATS Configuration
 	NatsURL string `env:"NATS_URL" envDefault:"nats://localhost:4222"`
+	// NATS authentication; set at most one of user/password, token, NKey seed
+	// file and credentials file. A TLS client certificate can be added to any.
+	NatsUser         string `env:"NATS_USER"`
+	NatsPassword     string `env:"NATS_PASSWORD"`
+	NatsToken        string `env:"NATS_TOKEN"`
+	NatsNKeySeedFile string `env:"NATS_NKEY_SEED_FILE"`
+	NatsCredsFile    string `env:"NATS_CREDS_FILE"`
+	NatsTLSCertFile  string `env:"NATS_TLS_CERT_FILE"`
+	NatsTLSKeyFile   string `env:"NATS_TLS_KEY_FILE"`
+	NatsTLSCAFile    string `env:"NATS_TLS_CA_FILE"`
+	// The agent reconnects to NATS forever, doubling the wait between
+	// attempts from NatsReconnectWait up to NatsMaxReconnectWait
+	NatsReconnectWait    time.Duration `env:"NATS_RECONNECT_WAIT" envDefault:"1s"`
+	NatsMaxReconnectWait time.Duration `env:"NATS_MAX_RECONNECT_WAIT" envDefault:"30s"`
+	// NatsJetStream receives jobs through a durable JetStream consumer, so
+	// jobs sent while the agent is offline are not lost
+	NatsJetStream  bool          `env:"NATS_JETSTREAM" envDefault:"false"`
+	NatsJobStream  string        `env:"NATS_JOB_STREAM" envDefault:"JOBS"`
+	NatsAckWait    time.Duration `env:"NATS_ACK_WAIT" envDefault:"2m"`
+	NatsMaxDeliver int           `env:"NATS_MAX_DELIVER" envDefault:"10"`
+	// NatsNakDelay is how long a job turned away as busy, or interrupted by
+	// shutdown, waits before it is delivered again
+	NatsNakDelay time.Duration `env:"NATS_NAK_DELAY" envDefault:"30s"`
 
 	// Docker Configuration
 	DockerHost string `env:"DOCKER_HOST" envDefault:"unix:///var/run/docker.sock"`
@@ -23,9 +47,106 @@ type Config struct {
 	// Agent Configuration
 	HeartbeatInterval string `env:"HEARTBEAT_INTERVAL" envDefault:"5m"`
 	LogLevel          string `env:"LOG_LEVEL" envDefault:"info"`
+	// PresenceInterval is how often the agent publishes its presence and
+	// capabilities over NATS; 0 publishes only on start, reconnect and shutdown
+	PresenceInterval time.Duration `env:"PRESENCE_INTERVAL" envDefault:"30s"`
 
-	// IPFS Configuration
-	PinataJWT string `env:"PINATA_JWT,required"`
+	// Job Authentication Configuration
+	// DispatcherAddresses are the Ethereum addresses allowed to sign jobs
+	DispatcherAddresses []string `env:"DISPATCHER_ADDRESSES" envSeparator:","`
+	// AllowUnsignedJobs also accepts plain job messages; meant for development
+	AllowUnsignedJobs bool `env:"ALLOW_UNSIGNED_JOBS" envDefault:"false"`
+	// JobEnvelopeMaxTTL is the furthest ahead a signed job may expire. With
+	// JetStream it must cover NatsNakDelay × (NatsMaxDeliver - 1), so busy
+	// jobs can still run when they are delivered again.
+	JobEnvelopeMaxTTL time.Duration `env:"JOB_ENVELOPE_MAX_TTL" envDefault:"10m"`
+	// AuditLogFile receives audit entries as JSON lines; empty logs them only to the agent log
+	AuditLogFile string `env:"AUDIT_LOG_FILE"`
+
+	// Job Scheduling Configuration
+	// MaxConcurrentJobs defaults to the number of detected GPUs when set to 0
+	MaxConcurrentJobs int `env:"MAX_CONCURRENT_JOBS" envDefault:"0"`
+	JobQueueSize      int `env:"JOB_QUEUE_SIZE" envDefault:"16"`
+
+	// MaxJobRuntime caps every job's run time; jobs may ask for a shorter limit.
+	// 0 means unlimited, leaving jobs without max_runtime_seconds to run until they exit.
+	MaxJobRuntime time.Duration `env:"MAX_JOB_RUNTIME" envDefault:"24h"`
+	// ContainerStopTimeout is the grace period between SIGTERM and SIGKILL
+	ContainerStopTimeout time.Duration `env:"CONTAINER_STOP_TIMEOUT" envDefault:"10s"`
+
+	// Container resource ceilings per job; 0 means no limit. Jobs that do
+	// not request a resource get the ceiling as their limit.
+	MaxJobMemoryMB  int64   `env:"MAX_JOB_MEMORY_MB" envDefault:"0"`
+	MaxJobCPUs      float64 `env:"MAX_JOB_CPUS" envDefault:"0"`
+	MaxJobPids      int64   `env:"MAX_JOB_PIDS" envDefault:"4096"`
+	MaxJobShmSizeMB int64   `env:"MAX_JOB_SHM_SIZE_MB" envDefault:"8192"`
+
+	// MaxJobLogSizeMB caps each of a job's stdout and stderr logs; 0 means no cap
+	MaxJobLogSizeMB int64 `env:"MAX_JOB_LOG_SIZE_MB" envDefault:"10"`
+	// LogStreamRateKB limits live log streaming per job in KiB/s; 0 disables it
+	LogStreamRateKB int `env:"LOG_STREAM_RATE_KB" envDefault:"64"`
+	// ProgressInterval is the least time between a job's download or upload
+	// progress updates; 0 disables them
+	ProgressInterval time.Duration `env:"PROGRESS_INTERVAL" envDefault:"5s"`
+
+	// Job Sandbox Configuration
+	// JobUser is the non-root "uid:gid" job containers run as
+	JobUser string `env:"JOB_USER" envDefault:"65534:65534"`
+	// JobSeccompProfile is a seccomp JSON file; empty uses Docker's default profile
+	JobSeccompProfile string `env:"JOB_SECCOMP_PROFILE"`
+	JobTmpfsSizeMB    int64  `env:"JOB_TMPFS_SIZE_MB" envDefault:"1024"`
+	// AllowJobEgress lets jobs opt into network access; otherwise they have none
+	AllowJobEgress bool `env:"ALLOW_JOB_EGRESS" envDefault:"false"`
+	// AllowedImages are path.Match patterns for the images jobs may run,
+	// matched with and without tag or digest; empty allows any image
+	AllowedImages []string `env:"ALLOWED_IMAGES" envSeparator:","`
+
+	// Storage Configuration
+	// StorageBackend is where outputs and logs go by default: gateway, kubo, s3 or local
+	StorageBackend string `env:"STORAGE_BACKEND" envDefault:"gateway"`
+
+	// IPFS Configuration; PinataJWT is required by the gateway backend.
+	// Gateways are tried in order until one serves the content.
+	PinataJWT       string   `env:"PINATA_JWT"`
+	IPFSGatewayURLs []string `env:"IPFS_GATEWAY_URLS" envSeparator:"," envDefault:"https://gateway.pinata.cloud"`
+	IPFSPinningURL  string   `env:"IPFS_PINNING_URL" envDefault:"https://api.pinata.cloud/pinning/pinFileToIPFS"`
+	KuboAPIURL      string   `env:"KUBO_API_URL" envDefault:"http://127.0.0.1:5001"`
+	// MaxInputSizeMB caps the size of an input: the unpacked size of an IPFS
+	// DAG, an https:// download or the objects of an s3:// reference. DAGs
+	// can link the same blocks many times, so this also bounds small
+	// malicious CARs. 0 means no limit.
+	MaxInputSizeMB int64 `env:"MAX_INPUT_SIZE_MB" envDefault:"102400"`
+
+	// Download Retry Configuration for gateway, HTTP and S3 inputs. Attempts
+	// are per gateway and S3 object, and an attempt fails once no data has
+	// arrived for the idle timeout; the backoff doubles from the base up to
+	// the maximum.
+	DownloadAttempts    int           `env:"DOWNLOAD_ATTEMPTS" envDefault:"3"`
+	DownloadIdleTimeout time.Duration `env:"DOWNLOAD_IDLE_TIMEOUT" envDefault:"5m"`
+	DownloadBackoffBase time.Duration `env:"DOWNLOAD_BACKOFF_BASE" envDefault:"1s"`
+	DownloadBackoffMax  time.Duration `env:"DOWNLOAD_BACKOFF_MAX" envDefault:"30s"`
+
+	// S3-compatible Storage Configuration; s3:// references are enabled when S3_BUCKET is set
+	S3Endpoint        string `env:"S3_ENDPOINT" envDefault:"https://s3.amazonaws.com"`
+	S3Region          string `env:"S3_REGION" envDefault:"us-east-1"`
+	S3Bucket          string `env:"S3_BUCKET"`
+	S3Prefix          string `env:"S3_PREFIX" envDefault:"jobs"`
+	S3AccessKeyID     string `env:"S3_ACCESS_KEY_ID"`
+	S3SecretAccessKey string `env:"S3_SECRET_ACCESS_KEY"`
+	// S3AllowedPrefixes are the "<bucket>" or "<bucket>/<prefix>" locations
+	// s3:// job references may name; empty allows only S3_BUCKET/S3_PREFIX
+	S3AllowedPrefixes []string `env:"S3_ALLOWED_PREFIXES" envSeparator:","`
+
+	// Input Cache Configuration; IPFS inputs are cached when the size is above 0
+	InputCacheDir    string `env:"INPUT_CACHE_DIR" envDefault:"/var/cache/lamda_node_agent/inputs"`
+	InputCacheSizeMB int64  `env:"INPUT_CACHE_SIZE_MB" envDefault:"0"`
+
+	// LocalStorageDir roots file:// references; meant for development
+	LocalStorageDir string `env:"LOCAL_STORAGE_DIR"`
+
+	// AllowHTTPInputs enables https:// input URLs. Only public addresses are
+	// reached, and plain http:// is never allowed.
+	AllowHTTPInputs bool `env:"ALLOW_HTTP_INPUTS" envDefault:"false"`
 }
 
 // LoadConfig loads configuration from environment variables and .env file
@@ -0,0 +1,231 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Log files written to a job's LogDir
+const (
+	StdoutLogFile = "stdout.log"
+	StderrLogFile = "stderr.log"
+)
+
+// Container output streams carried in a LogLine
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// LogLine is one line of a job container's output
+type LogLine struct {
+	Stream    string    // StreamStdout or StreamStderr
+	Timestamp time.Time // when Docker received the line
+	Line      string    // without the trailing newline
+}
+
+// logDrainTimeout bounds how long a finished job waits for the rest of its
+// container's logs before the stream is closed
+const logDrainTimeout = 5 * time.Second
+
+// maxLogLineBytes splits lines longer than this so a job writing without
+// newlines cannot grow the line buffer without bound
+const maxLogLineBytes = 64 * 1024
+
+// captureLogs follows a container's output, splitting it into LogLines that
+// are written to separate stdout and stderr files in spec.LogDir and passed
+// to spec.OnLogLine. The returned function waits for the capture to finish
+// and must be called before the container is removed. The capture outlives
+// the job's context so output written while the container is being stopped
+// is kept.
+func (d *dockerManager) captureLogs(containerID string, spec JobSpec) func() {
+	if spec.LogDir == "" {
+		return func() {}
+	}
+
+	stdout, err := os.Create(filepath.Join(spec.LogDir, StdoutLogFile))
+	if err != nil {
+		log.Printf("Warning: failed to create stdout log: %v", err)
+		return func() {}
+	}
+	stderr, err := os.Create(filepath.Join(spec.LogDir, StderrLogFile))
+	if err != nil {
+		log.Printf("Warning: failed to create stderr log: %v", err)
+		stdout.Close()
+		return func() {}
+	}
+
+	logsCtx, cancelLogs := context.WithCancel(context.Background())
+	logs, err := d.client.ContainerLogs(logsCtx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: true,
+	})
+	if err != nil {
+		log.Printf("Warning: failed to get container logs: %v", err)
+		cancelLogs()
+		stdout.Close()
+		stderr.Close()
+		return func() {}
+	}
+
+	files := map[string]io.Writer{
+		StreamStdout: newCappedWriter(stdout, spec.MaxLogBytes),
+		StreamStderr: newCappedWriter(stderr, spec.MaxLogBytes),
+	}
+	emit := func(line LogLine) {
+		fmt.Fprintln(files[line.Stream], line.Line)
+		if spec.OnLogLine != nil {
+			spec.OnLogLine(line)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer logs.Close()
+		defer stdout.Close()
+		defer stderr.Close()
+
+		stdoutLines := newLineSplitter(StreamStdout, emit)
+		stderrLines := newLineSplitter(StreamStderr, emit)
+
+		// TTY containers have a single raw stream; otherwise Docker
+		// multiplexes stdout and stderr with stdcopy framing
+		var err error
+		if spec.TTY {
+			_, err = io.Copy(stdoutLines, logs)
+		} else {
+			_, err = stdcopy.StdCopy(stdoutLines, stderrLines, logs)
+		}
+		if err != nil && logsCtx.Err() == nil {
+			log.Printf("Warning: container log stream ended early: %v", err)
+		}
+
+		stdoutLines.Flush()
+		stderrLines.Flush()
+	}()
+
+	return func() {
+		select {
+		case <-done:
+		case <-time.After(logDrainTimeout):
+			cancelLogs()
+			<-done
+		}
+		cancelLogs()
+	}
+}
+
+// lineSplitter turns one stream of timestamped Docker log output into LogLines
+type lineSplitter struct {
+	stream  string
+	emit    func(LogLine)
+	partial []byte
+}
+
+// newLineSplitter creates a splitter that passes each line of stream to emit
+func newLineSplitter(stream string, emit func(LogLine)) *lineSplitter {
+	return &lineSplitter{stream: stream, emit: emit}
+}
+
+// Write emits every complete line in p and keeps the rest for the next write
+func (l *lineSplitter) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+
+	rest := l.partial
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		l.emitLine(rest[:i])
+		rest = rest[i+1:]
+	}
+	if len(rest) >= maxLogLineBytes {
+		l.emitLine(rest)
+		rest = nil
+	}
+	l.partial = append([]byte(nil), rest...)
+
+	return len(p), nil
+}
+
+// Flush emits a trailing line that has no newline
+func (l *lineSplitter) Flush() {
+	if len(l.partial) > 0 {
+		l.emitLine(l.partial)
+		l.partial = nil
+	}
+}
+
+// emitLine strips the timestamp Docker prefixes to each line, and the
+// carriage return TTY output ends lines with
+func (l *lineSplitter) emitLine(raw []byte) {
+	raw = bytes.TrimSuffix(raw, []byte("\r"))
+
+	timestamp := time.Now()
+	if prefix, line, found := bytes.Cut(raw, []byte(" ")); found {
+		if parsed, err := time.Parse(time.RFC3339Nano, string(prefix)); err == nil {
+			timestamp = parsed
+			raw = line
+		}
+	}
+
+	l.emit(LogLine{
+		Stream:    l.stream,
+		Timestamp: timestamp,
+		Line:      string(raw),
+	})
+}
+
+// cappedWriter writes up to limit bytes and silently discards the rest, so a
+// chatty job cannot fill the disk. A limit of 0 means no cap.
+type cappedWriter struct {
+	w         io.Writer
+	limit     int64
+	written   int64
+	truncated bool
+}
+
+// newCappedWriter wraps w with a size cap
+func newCappedWriter(w io.Writer, limit int64) *cappedWriter {
+	return &cappedWriter{w: w, limit: limit}
+}
+
+// Write always reports the full length written so the log stream keeps
+// draining after the cap is reached
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if c.limit <= 0 {
+		return c.w.Write(p)
+	}
+	if c.truncated {
+		return len(p), nil
+	}
+
+	remaining := c.limit - c.written
+	if int64(len(p)) <= remaining {
+		n, err := c.w.Write(p)
+		c.written += int64(n)
+		return len(p), err
+	}
+
+	n, err := c.w.Write(p[:remaining])
+	c.written += int64(n)
+	c.truncated = true
+	if err != nil {
+		return len(p), err
+	}
+	_, err = fmt.Fprintf(c.w, "\n[log truncated at %d bytes]\n", c.limit)
+	return len(p), err
+}
@@ -0,0 +1,209 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// collectLines returns a splitter for stream and the lines it has emitted
+func collectLines(stream string) (*lineSplitter, *[]LogLine) {
+	var lines []LogLine
+	return newLineSplitter(stream, func(line LogLine) { lines = append(lines, line) }), &lines
+}
+
+// lineTexts returns the text of each line
+func lineTexts(lines []LogLine) []string {
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = line.Line
+	}
+	return texts
+}
+
+func TestLineSplitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{name: "whole lines", writes: []string{"one\ntwo\n"}, want: []string{"one", "two"}},
+		{name: "line split across writes", writes: []string{"on", "e\ntw", "o\n"}, want: []string{"one", "two"}},
+		{name: "final line without newline", writes: []string{"one\ntwo"}, want: []string{"one", "two"}},
+		{name: "empty lines", writes: []string{"\n\none\n"}, want: []string{"", "", "one"}},
+		{name: "TTY carriage returns", writes: []string{"one\r\ntwo\r\n"}, want: []string{"one", "two"}},
+		{
+			name:   "output without newlines is not buffered past the limit",
+			writes: []string{strings.Repeat("a", maxLogLineBytes), "bbb\n"},
+			want:   []string{strings.Repeat("a", maxLogLineBytes), "bbb"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			splitter, lines := collectLines(StreamStdout)
+			for _, write := range tt.writes {
+				if n, err := splitter.Write([]byte(write)); n != len(write) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", write, n, err)
+				}
+			}
+			splitter.Flush()
+
+			if got := lineTexts(*lines); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lines = %q, want %q", got, tt.want)
+			}
+			for _, line := range *lines {
+				if line.Stream != StreamStdout {
+					t.Errorf("line %q is on stream %q, want %q", line.Line, line.Stream, StreamStdout)
+				}
+			}
+		})
+	}
+}
+
+func TestLineSplitterParsesDockerTimestamps(t *testing.T) {
+	splitter, lines := collectLines(StreamStderr)
+	splitter.Write([]byte("2024-05-01T12:00:00.123456789Z hello world\nno timestamp here\n"))
+
+	if len(*lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(*lines))
+	}
+	stamped := (*lines)[0]
+	want := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	if stamped.Line != "hello world" || !stamped.Timestamp.Equal(want) {
+		t.Errorf("got %q at %s, want %q at %s", stamped.Line, stamped.Timestamp, "hello world", want)
+	}
+	if plain := (*lines)[1]; plain.Line != "no timestamp here" {
+		t.Errorf("line without a timestamp = %q, want it unchanged", plain.Line)
+	}
+}
+
+func TestCappedWriter(t *testing.T) {
+	marker := "\n[log truncated at 10 bytes]\n"
+	tests := []struct {
+		name   string
+		limit  int64
+		writes []string
+		want   string
+	}{
+		{name: "under the cap", limit: 10, writes: []string{"abc", "def"}, want: "abcdef"},
+		{name: "exactly at the cap", limit: 10, writes: []string{"abcde", "fghij"}, want: "abcdefghij"},
+		{name: "write crossing the cap", limit: 10, writes: []string{"abcdefgh", "ijkl"}, want: "abcdefghij" + marker},
+		{name: "writes after the cap", limit: 10, writes: []string{"abcdefghijk", "more", "and more"}, want: "abcdefghij" + marker},
+		{name: "write after an exact fill", limit: 10, writes: []string{"abcdefghij", "k", "l"}, want: "abcdefghij" + marker},
+		{name: "no cap", limit: 0, writes: []string{"abcdefghij", "klmnop"}, want: "abcdefghijklmnop"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newCappedWriter(&buf, tt.limit)
+			for _, write := range tt.writes {
+				// The full length is always reported so the log stream keeps draining
+				if n, err := w.Write([]byte(write)); n != len(write) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", write, n, err)
+				}
+			}
+			if buf.String() != tt.want {
+				t.Errorf("wrote %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+// runLoggedJob runs a job whose container writes logs, and returns the lines
+// passed to OnLogLine and the contents of the stdout and stderr log files
+func runLoggedJob(t *testing.T, logs []byte, tty bool) (lines []LogLine, stdout, stderr string) {
+	t.Helper()
+	manager := newFakeDockerManager(t, &fakeDockerAPI{t: t, logs: logs})
+
+	var mu sync.Mutex
+	logDir := t.TempDir()
+	err := manager.RunJobContainer(context.Background(), JobSpec{
+		ImageName:  "job:latest",
+		InputPath:  "/jobs/1/input",
+		OutputPath: "/jobs/1/output",
+		LogDir:     logDir,
+		TTY:        tty,
+		OnLogLine: func(line LogLine) {
+			mu.Lock()
+			lines = append(lines, line)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("RunJobContainer failed: %v", err)
+	}
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(logDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	return lines, read(StdoutLogFile), read(StderrLogFile)
+}
+
+// streamTexts returns the text of the lines on stream
+func streamTexts(lines []LogLine, stream string) []string {
+	var texts []string
+	for _, line := range lines {
+		if line.Stream == stream {
+			texts = append(texts, line.Line)
+		}
+	}
+	return texts
+}
+
+func TestCaptureLogsDemultiplexesStreams(t *testing.T) {
+	var logs bytes.Buffer
+	stdoutFrames := stdcopy.NewStdWriter(&logs, stdcopy.Stdout)
+	stderrFrames := stdcopy.NewStdWriter(&logs, stdcopy.Stderr)
+	stdoutFrames.Write([]byte("2024-05-01T12:00:00Z out one\n2024-05-01T12:00:01Z out "))
+	stderrFrames.Write([]byte("2024-05-01T12:00:02Z err one\n"))
+	stdoutFrames.Write([]byte("two\n"))
+	stderrFrames.Write([]byte("2024-05-01T12:00:03Z err two"))
+
+	lines, stdout, stderr := runLoggedJob(t, logs.Bytes(), false)
+
+	if want := []string{"out one", "out two"}; !reflect.DeepEqual(streamTexts(lines, StreamStdout), want) {
+		t.Errorf("stdout lines = %q, want %q", streamTexts(lines, StreamStdout), want)
+	}
+	if want := []string{"err one", "err two"}; !reflect.DeepEqual(streamTexts(lines, StreamStderr), want) {
+		t.Errorf("stderr lines = %q, want %q", streamTexts(lines, StreamStderr), want)
+	}
+	if want := "out one\nout two\n"; stdout != want {
+		t.Errorf("stdout log = %q, want %q", stdout, want)
+	}
+	if want := "err one\nerr two\n"; stderr != want {
+		t.Errorf("stderr log = %q, want %q", stderr, want)
+	}
+}
+
+func TestCaptureLogsTTYIsOneStream(t *testing.T) {
+	logs := []byte("2024-05-01T12:00:00Z first\r\n2024-05-01T12:00:01Z second\r\n")
+
+	lines, stdout, stderr := runLoggedJob(t, logs, true)
+
+	if want := []string{"first", "second"}; !reflect.DeepEqual(streamTexts(lines, StreamStdout), want) {
+		t.Errorf("stdout lines = %q, want %q", streamTexts(lines, StreamStdout), want)
+	}
+	if got := streamTexts(lines, StreamStderr); len(got) != 0 {
+		t.Errorf("TTY job has stderr lines %q", got)
+	}
+	if want := "first\nsecond\n"; stdout != want {
+		t.Errorf("stdout log = %q, want %q", stdout, want)
+	}
+	if stderr != "" {
+		t.Errorf("stderr log = %q, want it empty", stderr)
+	}
+}
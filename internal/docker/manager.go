@@ -5,37 +5,113 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sort"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 )
 
 // Manager defines the interface for Docker operations
 type Manager interface {
-	RunJobContainer(ctx context.Context, imageName string, inputPath string, outputPath string) error
+	RunJobContainer(ctx context.Context, spec JobSpec) error
+	// ListImages returns the tags of the images present on the node
+	ListImages(ctx context.Context) ([]string, error)
 }
 
+// JobSpec describes the container to run for a job
+type JobSpec struct {
+	ImageName  string
+	InputPath  string
+	OutputPath string
+
+	// InputMounts are mounted read-only on top of InputPath; one targeting
+	// /input itself replaces InputPath
+	InputMounts []InputMount
+
+	// Entrypoint and Cmd override the image's ENTRYPOINT and CMD when set
+	Entrypoint []string
+	Cmd        []string
+	WorkingDir string
+	Env        map[string]string
+
+	// GPUDeviceIDs selects specific GPUs by UUID; otherwise GPUCount GPUs are requested
+	GPUCount     int
+	GPUDeviceIDs []string
+
+	// Resources limits the container's memory, CPU, processes and /dev/shm
+	Resources Resources
+
+	// NetworkEgress attaches the container to the default bridge network;
+	// otherwise it has no network at all
+	NetworkEgress bool
+
+	// LogDir receives the container's stdout and stderr as separate files,
+	// each capped at MaxLogBytes (0 means no cap)
+	LogDir      string
+	MaxLogBytes int64
+
+	// OnLogLine, when set, receives each line of the container's output as it
+	// is produced. It must not block.
+	OnLogLine func(LogLine)
+
+	// TTY allocates a pseudo-terminal; stdout and stderr are then merged
+	TTY bool
+
+	// StopTimeout is the grace period between SIGTERM and SIGKILL when the
+	// job is cancelled or times out
+	StopTimeout time.Duration
+}
+
+// InputMount is a host file or directory mounted read-only into the container
+type InputMount struct {
+	Source string
+	Target string // absolute path under /input
+}
+
+// Resources are the container resource limits for a job; zero means unlimited
+// (or the Docker default for ShmSizeBytes)
+type Resources struct {
+	MemoryBytes  int64
+	NanoCPUs     int64
+	PidsLimit    int64
+	ShmSizeBytes int64
+}
+
+// gpuCapabilities are the NVIDIA driver capabilities exposed to job containers
+var gpuCapabilities = []string{"gpu", "compute", "utility"}
+
 // dockerManager implements Manager using Docker
 type dockerManager struct {
-	client *client.Client
+	client   *client.Client
+	security SecurityProfile
 }
 
-// NewDockerManager creates a new Docker manager
-func NewDockerManager() (Manager, error) {
+// NewDockerManager creates a new Docker manager that sandboxes every job
+// container with the given security profile
+func NewDockerManager(security SecurityProfile) (Manager, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Docker client: %w", err)
 	}
+	return newDockerManager(cli, security), nil
+}
 
+// newDockerManager creates a Docker manager that talks to the daemon through cli
+func newDockerManager(cli *client.Client, security SecurityProfile) *dockerManager {
 	return &dockerManager{
-		client: cli,
-	}, nil
+		client:   cli,
+		security: security,
+	}
 }
 
 // RunJobContainer runs a Docker container for job execution with GPU access
-func (d *dockerManager) RunJobContainer(ctx context.Context, imageName string, inputPath string, outputPath string) error {
+func (d *dockerManager) RunJobContainer(ctx context.Context, spec JobSpec) error {
+	imageName := spec.ImageName
+
 	// Pull the Docker image
 	log.Printf("Pulling Docker image: %s", imageName)
 	reader, err := d.client.ImagePull(ctx, imageName, types.ImagePullOptions{})
@@ -46,28 +122,10 @@ func (d *dockerManager) RunJobContainer(ctx context.Context, imageName string, i
 	io.Copy(io.Discard, reader)
 
 	// Create container configuration
-	config := &container.Config{
-		Image: imageName,
-		Cmd:   []string{"/bin/bash", "-c", "ls /input && ls /output"},
-	}
+	config := buildContainerConfig(spec, d.security)
 
-	// Create host configuration with volume mounts
-	hostConfig := &container.HostConfig{
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: inputPath,
-				Target: "/input",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: outputPath,
-				Target: "/output",
-			},
-		},
-		// Note: GPU access requires nvidia-docker runtime
-		// This can be configured via Docker daemon settings
-	}
+	// Create host configuration with volume mounts, GPU access and the sandbox
+	hostConfig := buildHostConfig(spec, d.security)
 
 	// Create the container
 	log.Printf("Creating container for image: %s", imageName)
@@ -79,26 +137,18 @@ func (d *dockerManager) RunJobContainer(ctx context.Context, imageName string, i
 	containerID := resp.ID
 	log.Printf("Created container with ID: %s", containerID)
 
+	// Always remove the container, even if ctx has been cancelled
+	defer d.removeContainer(containerID)
+
 	// Start the container
 	log.Printf("Starting container: %s", containerID)
 	if err := d.client.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
 		return fmt.Errorf("failed to start container: %w", err)
 	}
 
-	// Stream container logs
-	logs, err := d.client.ContainerLogs(ctx, containerID, container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     true,
-	})
-	if err != nil {
-		log.Printf("Warning: failed to get container logs: %v", err)
-	} else {
-		defer logs.Close()
-		go func() {
-			io.Copy(log.Writer(), logs)
-		}()
-	}
+	// Capture container logs; wait for them before the container is removed
+	waitForLogs := d.captureLogs(containerID, spec)
+	defer waitForLogs()
 
 	// Wait for container to complete
 	log.Printf("Waiting for container to complete: %s", containerID)
@@ -106,6 +156,10 @@ func (d *dockerManager) RunJobContainer(ctx context.Context, imageName string, i
 
 	select {
 	case err := <-errCh:
+		if ctx.Err() != nil {
+			d.stopContainer(containerID, spec.StopTimeout)
+			return fmt.Errorf("container stopped: %w", ctx.Err())
+		}
 		if err != nil {
 			return fmt.Errorf("error waiting for container: %w", err)
 		}
@@ -113,14 +167,159 @@ func (d *dockerManager) RunJobContainer(ctx context.Context, imageName string, i
 		if status.StatusCode != 0 {
 			return fmt.Errorf("container exited with status code: %d", status.StatusCode)
 		}
+	case <-ctx.Done():
+		d.stopContainer(containerID, spec.StopTimeout)
+		return fmt.Errorf("container stopped: %w", ctx.Err())
 	}
 
-	// Remove the container
+	log.Printf("Container execution completed successfully")
+	return nil
+}
+
+// ListImages returns the tags of the images present on the node, sorted.
+// Untagged images are left out.
+func (d *dockerManager) ListImages(ctx context.Context) ([]string, error) {
+	images, err := d.client.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	var tags []string
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if tag != "<none>:<none>" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// stopContainer sends SIGTERM to a container and SIGKILL after the grace period.
+// It uses its own context because the job's context is already done.
+func (d *dockerManager) stopContainer(containerID string, gracePeriod time.Duration) {
+	timeout := int(gracePeriod.Seconds())
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod+30*time.Second)
+	defer cancel()
+
+	log.Printf("Stopping container %s (grace period %s)", containerID, gracePeriod)
+	if err := d.client.ContainerStop(ctx, containerID, container.StopOptions{
+		Signal:  "SIGTERM",
+		Timeout: &timeout,
+	}); err != nil {
+		log.Printf("Warning: failed to stop container: %v", err)
+	}
+}
+
+// removeContainer force-removes a container
+func (d *dockerManager) removeContainer(containerID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
 	log.Printf("Removing container: %s", containerID)
-	if err := d.client.ContainerRemove(ctx, containerID, container.RemoveOptions{}); err != nil {
+	if err := d.client.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true}); err != nil {
 		log.Printf("Warning: failed to remove container: %v", err)
 	}
+}
 
-	log.Printf("Container execution completed successfully")
-	return nil
+// buildContainerConfig creates the container configuration for a job.
+// Entrypoint and Cmd are left nil when not set so the image defaults apply.
+func buildContainerConfig(spec JobSpec, security SecurityProfile) *container.Config {
+	config := &container.Config{
+		Image:      spec.ImageName,
+		WorkingDir: spec.WorkingDir,
+		Tty:        spec.TTY,
+	}
+	security.applyToContainerConfig(config)
+
+	if len(spec.Entrypoint) > 0 {
+		config.Entrypoint = spec.Entrypoint
+	}
+	if len(spec.Cmd) > 0 {
+		config.Cmd = spec.Cmd
+	}
+
+	// Sort environment variables for a deterministic container config
+	keys := make([]string, 0, len(spec.Env))
+	for key := range spec.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		config.Env = append(config.Env, fmt.Sprintf("%s=%s", key, spec.Env[key]))
+	}
+
+	return config
+}
+
+// buildHostConfig creates the host configuration for a job, mounting the
+// input and output directories, applying resource limits and the security
+// profile, and requesting GPUs from the nvidia driver
+func buildHostConfig(spec JobSpec, security SecurityProfile) *container.HostConfig {
+	hostConfig := &container.HostConfig{
+		ShmSize: spec.Resources.ShmSizeBytes,
+		Resources: container.Resources{
+			Memory:   spec.Resources.MemoryBytes,
+			NanoCPUs: spec.Resources.NanoCPUs,
+		},
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeBind,
+				Source: spec.OutputPath,
+				Target: "/output",
+			},
+		},
+	}
+
+	// Inputs from the cache are shared between jobs, so they are read-only
+	inputMounted := false
+	for _, input := range spec.InputMounts {
+		inputMounted = inputMounted || input.Target == "/input"
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   input.Source,
+			Target:   input.Target,
+			ReadOnly: true,
+		})
+	}
+	if !inputMounted {
+		hostConfig.Mounts = append([]mount.Mount{{
+			Type:   mount.TypeBind,
+			Source: spec.InputPath,
+			Target: "/input",
+		}}, hostConfig.Mounts...)
+	}
+
+	// Disable swap so the memory limit is a hard limit
+	if spec.Resources.MemoryBytes > 0 {
+		hostConfig.Resources.MemorySwap = spec.Resources.MemoryBytes
+	}
+	if spec.Resources.PidsLimit > 0 {
+		pidsLimit := spec.Resources.PidsLimit
+		hostConfig.Resources.PidsLimit = &pidsLimit
+	}
+
+	security.applyToHostConfig(hostConfig, spec.NetworkEgress)
+
+	// GPU access requires the NVIDIA container toolkit on the host
+	if len(spec.GPUDeviceIDs) > 0 {
+		hostConfig.DeviceRequests = []container.DeviceRequest{
+			{
+				Driver:       "nvidia",
+				DeviceIDs:    spec.GPUDeviceIDs,
+				Capabilities: [][]string{gpuCapabilities},
+			},
+		}
+	} else if spec.GPUCount > 0 {
+		hostConfig.DeviceRequests = []container.DeviceRequest{
+			{
+				Driver:       "nvidia",
+				Count:        spec.GPUCount,
+				Capabilities: [][]string{gpuCapabilities},
+			},
+		}
+	}
+
+	return hostConfig
 }
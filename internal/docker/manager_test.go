@@ -0,0 +1,236 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// apiVersionPrefix matches the API version the Docker client puts in front of every path
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+// fakeDockerAPI serves just enough of the Docker Engine API to run one job
+// container, recording the container create and stop requests
+type fakeDockerAPI struct {
+	t       *testing.T
+	created createRequest
+
+	// running keeps the container running until the wait call is abandoned
+	running bool
+	stops   []url.Values
+
+	// logs is the body of the container logs call
+	logs []byte
+}
+
+// createRequest is the body of a container create call
+type createRequest struct {
+	container.Config
+	HostConfig *container.HostConfig
+}
+
+func (f *fakeDockerAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := apiVersionPrefix.ReplaceAllString(r.URL.Path, "")
+	switch {
+	case r.Method == http.MethodGet && path == "/_ping":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost && path == "/images/create":
+		w.Write([]byte(`{"status":"pulled"}`))
+	case r.Method == http.MethodPost && path == "/containers/create":
+		if err := json.NewDecoder(r.Body).Decode(&f.created); err != nil {
+			f.t.Errorf("failed to decode container create request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Id":"job-container","Warnings":[]}`))
+	case r.Method == http.MethodPost && path == "/containers/job-container/start":
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && path == "/containers/job-container/wait":
+		if f.running {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"StatusCode":0}`))
+	case r.Method == http.MethodGet && path == "/containers/job-container/logs":
+		w.Write(f.logs)
+	case r.Method == http.MethodPost && path == "/containers/job-container/stop":
+		f.stops = append(f.stops, r.URL.Query())
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && path == "/containers/job-container":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.t.Errorf("unexpected Docker API call: %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newFakeDockerManager creates a Docker manager talking to api
+func newFakeDockerManager(t *testing.T, api *fakeDockerAPI) *dockerManager {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	cli, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+strings.TrimPrefix(server.URL, "http://")),
+		client.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create Docker client: %v", err)
+	}
+	return newDockerManager(cli, SecurityProfile{User: "65534:65534"})
+}
+
+// runFakeJob runs spec against a fake Docker API and returns the HostConfig
+// the container was created with
+func runFakeJob(t *testing.T, spec JobSpec) *container.HostConfig {
+	t.Helper()
+	api := &fakeDockerAPI{t: t}
+	manager := newFakeDockerManager(t, api)
+
+	if err := manager.RunJobContainer(context.Background(), spec); err != nil {
+		t.Fatalf("RunJobContainer failed: %v", err)
+	}
+	if api.created.HostConfig == nil {
+		t.Fatal("container was created without a HostConfig")
+	}
+	return api.created.HostConfig
+}
+
+func TestRunJobContainerRequestsGPUs(t *testing.T) {
+	tests := []struct {
+		name string
+		spec JobSpec
+		want []container.DeviceRequest
+	}{
+		{
+			name: "device IDs",
+			spec: JobSpec{GPUDeviceIDs: []string{"GPU-a", "GPU-b"}},
+			want: []container.DeviceRequest{{
+				Driver:       "nvidia",
+				DeviceIDs:    []string{"GPU-a", "GPU-b"},
+				Capabilities: [][]string{{"gpu", "compute", "utility"}},
+			}},
+		},
+		{
+			name: "count",
+			spec: JobSpec{GPUCount: 2},
+			want: []container.DeviceRequest{{
+				Driver:       "nvidia",
+				Count:        2,
+				Capabilities: [][]string{{"gpu", "compute", "utility"}},
+			}},
+		},
+		{
+			name: "device IDs take precedence over count",
+			spec: JobSpec{GPUCount: 4, GPUDeviceIDs: []string{"GPU-c"}},
+			want: []container.DeviceRequest{{
+				Driver:       "nvidia",
+				DeviceIDs:    []string{"GPU-c"},
+				Capabilities: [][]string{{"gpu", "compute", "utility"}},
+			}},
+		},
+		{
+			name: "no GPUs",
+			spec: JobSpec{},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := tt.spec
+			spec.ImageName = "job:latest"
+			spec.InputPath = "/jobs/1/input"
+			spec.OutputPath = "/jobs/1/output"
+
+			hostConfig := runFakeJob(t, spec)
+			if !reflect.DeepEqual(hostConfig.DeviceRequests, tt.want) {
+				t.Errorf("DeviceRequests = %+v, want %+v", hostConfig.DeviceRequests, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunJobContainerStopsContainerAtDeadline(t *testing.T) {
+	api := &fakeDockerAPI{t: t, running: true}
+	manager := newFakeDockerManager(t, api)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := manager.RunJobContainer(ctx, JobSpec{
+		ImageName:   "job:latest",
+		InputPath:   "/jobs/1/input",
+		OutputPath:  "/jobs/1/output",
+		StopTimeout: 7 * time.Second,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunJobContainer() = %v, want a deadline error", err)
+	}
+
+	if len(api.stops) != 1 {
+		t.Fatalf("container was stopped %d times, want once", len(api.stops))
+	}
+	if got := api.stops[0].Get("signal"); got != "SIGTERM" {
+		t.Errorf("stop signal = %q, want SIGTERM", got)
+	}
+	if got := api.stops[0].Get("t"); got != "7" {
+		t.Errorf("stop grace period = %q, want 7", got)
+	}
+}
+
+func TestRunJobContainerAppliesResourceLimits(t *testing.T) {
+	hostConfig := runFakeJob(t, JobSpec{
+		ImageName:  "job:latest",
+		InputPath:  "/jobs/1/input",
+		OutputPath: "/jobs/1/output",
+		Resources: Resources{
+			MemoryBytes:  512 << 20,
+			NanoCPUs:     1_500_000_000,
+			PidsLimit:    256,
+			ShmSizeBytes: 64 << 20,
+		},
+	})
+
+	if hostConfig.Memory != 512<<20 {
+		t.Errorf("Memory = %d, want %d", hostConfig.Memory, 512<<20)
+	}
+	if hostConfig.MemorySwap != 512<<20 {
+		t.Errorf("MemorySwap = %d, want %d so the job cannot swap", hostConfig.MemorySwap, 512<<20)
+	}
+	if hostConfig.NanoCPUs != 1_500_000_000 {
+		t.Errorf("NanoCPUs = %d, want 1500000000", hostConfig.NanoCPUs)
+	}
+	if hostConfig.PidsLimit == nil || *hostConfig.PidsLimit != 256 {
+		t.Errorf("PidsLimit = %v, want 256", hostConfig.PidsLimit)
+	}
+	if hostConfig.ShmSize != 64<<20 {
+		t.Errorf("ShmSize = %d, want %d", hostConfig.ShmSize, 64<<20)
+	}
+}
+
+func TestRunJobContainerLeavesUnsetLimitsAlone(t *testing.T) {
+	hostConfig := runFakeJob(t, JobSpec{
+		ImageName:  "job:latest",
+		InputPath:  "/jobs/1/input",
+		OutputPath: "/jobs/1/output",
+	})
+
+	if hostConfig.Memory != 0 || hostConfig.MemorySwap != 0 || hostConfig.NanoCPUs != 0 || hostConfig.ShmSize != 0 {
+		t.Errorf("unlimited job got limits: memory %d, swap %d, CPUs %d, shm %d",
+			hostConfig.Memory, hostConfig.MemorySwap, hostConfig.NanoCPUs, hostConfig.ShmSize)
+	}
+	if hostConfig.PidsLimit != nil {
+		t.Errorf("PidsLimit = %d, want none", *hostConfig.PidsLimit)
+	}
+}
@@ -0,0 +1,80 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// jobTmpDir is the only writable path inside a job container besides its mounts
+const jobTmpDir = "/tmp"
+
+// SecurityProfile is the sandbox applied to every job container. Job images
+// come from arbitrary users, so containers drop all capabilities, cannot gain
+// privileges, run as a non-root user on a read-only root filesystem and have
+// no network unless the job is allowed egress.
+type SecurityProfile struct {
+	// User is the "uid:gid" the job's processes run as
+	User string
+
+	// Seccomp is a seccomp profile in JSON; empty uses Docker's default profile
+	Seccomp string
+
+	// TmpfsSizeBytes caps the tmpfs mounted at /tmp; 0 means the tmpfs default
+	TmpfsSizeBytes int64
+}
+
+// LoadSecurityProfile builds a security profile, reading the seccomp profile
+// from seccompPath when one is given
+func LoadSecurityProfile(user, seccompPath string, tmpfsSizeMB int64) (SecurityProfile, error) {
+	uid, _, _ := strings.Cut(user, ":")
+	if uid == "" || uid == "0" || uid == "root" {
+		return SecurityProfile{}, fmt.Errorf("job containers must run as a non-root user, got %q", user)
+	}
+
+	profile := SecurityProfile{
+		User:           user,
+		TmpfsSizeBytes: tmpfsSizeMB * 1024 * 1024,
+	}
+
+	if seccompPath != "" {
+		seccomp, err := os.ReadFile(seccompPath)
+		if err != nil {
+			return SecurityProfile{}, fmt.Errorf("failed to read seccomp profile %s: %w", seccompPath, err)
+		}
+		profile.Seccomp = string(seccomp)
+	}
+
+	return profile, nil
+}
+
+// applyToContainerConfig runs the job as the profile's non-root user
+func (p SecurityProfile) applyToContainerConfig(config *container.Config) {
+	config.User = p.User
+}
+
+// applyToHostConfig locks down the container's privileges, filesystem and
+// network. Egress uses Docker's default bridge network.
+func (p SecurityProfile) applyToHostConfig(hostConfig *container.HostConfig, networkEgress bool) {
+	hostConfig.CapDrop = []string{"ALL"}
+	hostConfig.SecurityOpt = []string{"no-new-privileges"}
+	if p.Seccomp != "" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+p.Seccomp)
+	}
+
+	hostConfig.ReadonlyRootfs = true
+	tmpfsOptions := "rw,noexec,nosuid,nodev"
+	if p.TmpfsSizeBytes > 0 {
+		tmpfsOptions = fmt.Sprintf("%s,size=%d", tmpfsOptions, p.TmpfsSizeBytes)
+	}
+	hostConfig.Tmpfs = map[string]string{jobTmpDir: tmpfsOptions}
+
+	if networkEgress {
+		hostConfig.NetworkMode = container.NetworkMode(network.NetworkBridge)
+	} else {
+		hostConfig.NetworkMode = container.NetworkMode(network.NetworkNone)
+	}
+}
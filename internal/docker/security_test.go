@@ -0,0 +1,143 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+)
+
+const testSeccompProfile = `{"defaultAction":"SCMP_ACT_ERRNO"}`
+
+func TestSecurityProfileSandboxesContainer(t *testing.T) {
+	tests := []struct {
+		name            string
+		egress          bool
+		seccomp         string
+		wantNetwork     container.NetworkMode
+		wantSecurityOpt []string
+	}{
+		{
+			name:            "no egress, default seccomp",
+			wantNetwork:     "none",
+			wantSecurityOpt: []string{"no-new-privileges"},
+		},
+		{
+			name:            "no egress, custom seccomp",
+			seccomp:         testSeccompProfile,
+			wantNetwork:     "none",
+			wantSecurityOpt: []string{"no-new-privileges", "seccomp=" + testSeccompProfile},
+		},
+		{
+			name:            "egress, default seccomp",
+			egress:          true,
+			wantNetwork:     "bridge",
+			wantSecurityOpt: []string{"no-new-privileges"},
+		},
+		{
+			name:            "egress, custom seccomp",
+			egress:          true,
+			seccomp:         testSeccompProfile,
+			wantNetwork:     "bridge",
+			wantSecurityOpt: []string{"no-new-privileges", "seccomp=" + testSeccompProfile},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			security := SecurityProfile{User: "65534:65534", Seccomp: tt.seccomp, TmpfsSizeBytes: 64 << 20}
+			spec := JobSpec{ImageName: "job:latest", InputPath: "/in", OutputPath: "/out", NetworkEgress: tt.egress}
+
+			hostConfig := buildHostConfig(spec, security)
+			if !reflect.DeepEqual(hostConfig.CapDrop, strslice.StrSlice{"ALL"}) {
+				t.Errorf("CapDrop = %v, want [ALL]", hostConfig.CapDrop)
+			}
+			if len(hostConfig.CapAdd) != 0 {
+				t.Errorf("CapAdd = %v, want none", hostConfig.CapAdd)
+			}
+			if !reflect.DeepEqual(hostConfig.SecurityOpt, tt.wantSecurityOpt) {
+				t.Errorf("SecurityOpt = %v, want %v", hostConfig.SecurityOpt, tt.wantSecurityOpt)
+			}
+			if !hostConfig.ReadonlyRootfs {
+				t.Error("ReadonlyRootfs = false, want true")
+			}
+			wantTmpfs := map[string]string{"/tmp": "rw,noexec,nosuid,nodev,size=67108864"}
+			if !reflect.DeepEqual(hostConfig.Tmpfs, wantTmpfs) {
+				t.Errorf("Tmpfs = %v, want %v", hostConfig.Tmpfs, wantTmpfs)
+			}
+			if hostConfig.NetworkMode != tt.wantNetwork {
+				t.Errorf("NetworkMode = %q, want %q", hostConfig.NetworkMode, tt.wantNetwork)
+			}
+			if hostConfig.Privileged {
+				t.Error("Privileged = true, want false")
+			}
+
+			config := buildContainerConfig(spec, security)
+			if config.User != "65534:65534" {
+				t.Errorf("User = %q, want 65534:65534", config.User)
+			}
+		})
+	}
+}
+
+func TestSecurityProfileTmpfsDefaultSize(t *testing.T) {
+	hostConfig := buildHostConfig(JobSpec{}, SecurityProfile{User: "1000"})
+	if got := hostConfig.Tmpfs["/tmp"]; got != "rw,noexec,nosuid,nodev" {
+		t.Errorf("Tmpfs[/tmp] = %q, want no size option", got)
+	}
+}
+
+func TestLoadSecurityProfile(t *testing.T) {
+	seccompPath := filepath.Join(t.TempDir(), "seccomp.json")
+	if err := os.WriteFile(seccompPath, []byte(testSeccompProfile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		user        string
+		seccompPath string
+		want        SecurityProfile
+		wantErr     bool
+	}{
+		{name: "empty user", user: "", wantErr: true},
+		{name: "root uid", user: "0", wantErr: true},
+		{name: "root uid and gid", user: "0:0", wantErr: true},
+		{name: "root name", user: "root", wantErr: true},
+		{name: "root name and group", user: "root:root", wantErr: true},
+		{name: "root uid with other gid", user: "0:65534", wantErr: true},
+		{name: "missing seccomp profile", user: "65534:65534", seccompPath: filepath.Join(t.TempDir(), "missing.json"), wantErr: true},
+		{
+			name: "non-root user",
+			user: "65534:65534",
+			want: SecurityProfile{User: "65534:65534", TmpfsSizeBytes: 64 << 20},
+		},
+		{
+			name:        "seccomp profile",
+			user:        "1000",
+			seccompPath: seccompPath,
+			want:        SecurityProfile{User: "1000", Seccomp: testSeccompProfile, TmpfsSizeBytes: 64 << 20},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := LoadSecurityProfile(tt.user, tt.seccompPath, 64)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", profile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if profile != tt.want {
+				t.Errorf("profile = %+v, want %+v", profile, tt.want)
+			}
+		})
+	}
+}
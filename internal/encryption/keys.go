@@ -0,0 +1,76 @@
+package encryption
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+)
+
+// KeySize is the size of a data key: files are encrypted with AES-256
+const KeySize = 32
+
+// GenerateKey returns a new random data key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	return key, nil
+}
+
+// SealKey encrypts a data key to a secp256k1 public key with ECIES and
+// returns it hex-encoded
+func SealKey(pub *ecdsa.PublicKey, key []byte) (string, error) {
+	sealed, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(pub), key, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to seal data key: %w", err)
+	}
+	return "0x" + hex.EncodeToString(sealed), nil
+}
+
+// OpenKey decrypts a hex-encoded data key sealed to the private key by SealKey
+func OpenKey(priv *ecdsa.PrivateKey, sealed string) ([]byte, error) {
+	ciphertext, err := decodeHex(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed data key: %w", err)
+	}
+
+	key, err := ecies.ImportECDSA(priv).Decrypt(ciphertext, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("data key is %d bytes, want %d", len(key), KeySize)
+	}
+	return key, nil
+}
+
+// ParsePublicKey parses a hex-encoded secp256k1 public key, compressed
+// (33 bytes) or uncompressed (65 bytes)
+func ParsePublicKey(s string) (*ecdsa.PublicKey, error) {
+	b, err := decodeHex(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	var pub *ecdsa.PublicKey
+	if len(b) == 33 {
+		pub, err = crypto.DecompressPubkey(b)
+	} else {
+		pub, err = crypto.UnmarshalPubkey(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return pub, nil
+}
+
+// decodeHex decodes hex with or without a 0x prefix
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+}
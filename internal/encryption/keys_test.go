@@ -0,0 +1,105 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestSealKeyRoundTrip(t *testing.T) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := SealKey(&priv.PublicKey, key)
+	if err != nil {
+		t.Fatalf("SealKey failed: %v", err)
+	}
+	if !strings.HasPrefix(sealed, "0x") {
+		t.Errorf("sealed key %q is not 0x-prefixed hex", sealed)
+	}
+
+	// The prefix is optional
+	for _, s := range []string{sealed, strings.TrimPrefix(sealed, "0x")} {
+		opened, err := OpenKey(priv, s)
+		if err != nil {
+			t.Fatalf("OpenKey failed: %v", err)
+		}
+		if !bytes.Equal(opened, key) {
+			t.Errorf("OpenKey returned %x, want %x", opened, key)
+		}
+	}
+
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenKey(other, sealed); err == nil {
+		t.Error("OpenKey with another private key succeeded")
+	}
+}
+
+func TestOpenKeyRejectsInvalidKeys(t *testing.T) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := SealKey(&priv.PublicKey, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := SealKey(&priv.PublicKey, make([]byte, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered, err := hex.DecodeString(strings.TrimPrefix(valid, "0x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered[len(tampered)-1] ^= 1
+
+	for name, sealed := range map[string]string{
+		"not hex":    "0xnothex",
+		"empty":      "",
+		"wrong size": short,
+		"tampered":   hex.EncodeToString(tampered),
+		"truncated":  valid[:len(valid)-2],
+	} {
+		if _, err := OpenKey(priv, sealed); err == nil {
+			t.Errorf("%s: OpenKey succeeded", name)
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, encoded := range map[string]string{
+		"compressed":   "0x" + hex.EncodeToString(crypto.CompressPubkey(&priv.PublicKey)),
+		"uncompressed": hex.EncodeToString(crypto.FromECDSAPub(&priv.PublicKey)),
+	} {
+		pub, err := ParsePublicKey(encoded)
+		if err != nil {
+			t.Fatalf("%s: ParsePublicKey failed: %v", name, err)
+		}
+		if !pub.Equal(&priv.PublicKey) {
+			t.Errorf("%s: ParsePublicKey returned another key", name)
+		}
+	}
+
+	for _, encoded := range []string{"", "0x1234", "0x" + strings.Repeat("00", 33)} {
+		if _, err := ParsePublicKey(encoded); err == nil {
+			t.Errorf("ParsePublicKey(%q) succeeded", encoded)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Encrypted files start with a magic string and a random nonce prefix,
+// followed by the plaintext in chunks of chunkSize bytes, each sealed with
+// AES-256-GCM. A chunk's nonce is the prefix, its index and a flag set on
+// the last chunk, so chunks cannot be reordered, dropped or truncated
+// without failing to decrypt.
+const (
+	magic           = "LMDAENC1"
+	noncePrefixSize = 7
+	chunkSize       = 64 * 1024
+)
+
+// ErrDecrypt is returned when data cannot be decrypted with the given key,
+// because the key is wrong or the data was altered
+var ErrDecrypt = errors.New("decryption failed")
+
+// newAEAD creates the AES-256-GCM cipher for a data key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("data key is %d bytes, want %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk index
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// writer encrypts what is written to it. A full chunk is held back until
+// more data arrives, so Close can mark the real last chunk.
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+// NewWriter returns a writer that encrypts to w with a data key. Close must
+// be called to write the last chunk; it does not close w.
+func NewWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	if _, err := w.Write(append([]byte(magic), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &writer{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (e *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == chunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):chunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk, which may be empty
+func (e *writer) Close() error {
+	return e.seal(true)
+}
+
+// seal encrypts and writes the buffered chunk
+func (e *writer) seal(last bool) error {
+	if e.index == ^uint32(0) {
+		return errors.New("encrypted stream is too long")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.index, last), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// reader decrypts a stream written by writer
+type reader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	sealed []byte
+	plain  []byte // decrypted bytes not yet read
+	done   bool
+}
+
+// NewReader returns a reader that decrypts r with a data key. Reads fail with
+// ErrDecrypt if the key is wrong or the data was altered or truncated.
+func NewReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic)+noncePrefixSize)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: not an encrypted file", ErrDecrypt)
+	}
+
+	return &reader{
+		r:      br,
+		aead:   aead,
+		prefix: header[len(magic):],
+		sealed: make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *reader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk. A chunk is the last one when the
+// stream ends after it.
+func (d *reader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := d.aead.Open(d.sealed[:0], chunkNonce(d.prefix, d.index, d.done), d.sealed[:n], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.index++
+	d.plain = plain
+	return nil
+}
+
+// EncryptTree encrypts src, a file or a directory tree, to dst with a data
+// key. File and directory names are kept. Symlinks are skipped.
+func EncryptTree(src, dst string, key []byte) error {
+	return transformTree(src, dst, func(in io.Reader, out io.Writer) error {
+		w, err := NewWriter(out, key)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, in); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// DecryptTree decrypts src, a file or a directory tree written by
+// EncryptTree, to dst with a data key
+func DecryptTree(src, dst string, key []byte) error {
+	return transformTree(src, dst, func(in io.Reader, out io.Writer) error {
+		r, err := NewReader(in, key)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		return err
+	})
+}
+
+// transformTree writes every regular file under src to the same path under
+// dst through transform
+func transformTree(src, dst string, transform func(in io.Reader, out io.Writer) error) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, 0755)
+		case entry.Type().IsRegular():
+			if err := transformFile(path, target, transform); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+		}
+		return nil
+	})
+}
+
+// transformFile writes one file through transform
+func transformFile(src, dst string, transform func(in io.Reader, out io.Writer) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := transform(in, out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
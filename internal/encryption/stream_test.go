@@ -0,0 +1,192 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKey returns a fixed data key
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+// encrypt encrypts plaintext, writing it in pieces of writeSize bytes
+func encrypt(t *testing.T, plaintext []byte, key []byte, writeSize int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := NewWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := plaintext; len(p) > 0; {
+		n := min(writeSize, len(p))
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// decrypt decrypts a whole stream
+func decrypt(ciphertext []byte, key []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(ciphertext), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// sealedChunks splits a stream into its header and sealed chunks, each of
+// which carries a 16-byte GCM tag
+func sealedChunks(stream []byte) (header []byte, chunks [][]byte) {
+	header, stream = stream[:len(magic)+noncePrefixSize], stream[len(magic)+noncePrefixSize:]
+	for len(stream) > 0 {
+		n := min(chunkSize+16, len(stream))
+		chunks = append(chunks, stream[:n])
+		stream = stream[n:]
+	}
+	return header, chunks
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantChunks int
+	}{
+		{name: "empty", size: 0, wantChunks: 1},
+		{name: "short", size: 100, wantChunks: 1},
+		{name: "exactly one chunk", size: chunkSize, wantChunks: 1},
+		{name: "one chunk and a byte", size: chunkSize + 1, wantChunks: 2},
+		{name: "exactly two chunks", size: 2 * chunkSize, wantChunks: 2},
+		{name: "several chunks", size: 5*chunkSize + 1234, wantChunks: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := make([]byte, tt.size)
+			rand.New(rand.NewSource(int64(tt.size))).Read(plaintext)
+
+			// The chunking must not depend on how the plaintext is written
+			for _, writeSize := range []int{1000, chunkSize, 3 * chunkSize} {
+				stream := encrypt(t, plaintext, testKey(1), writeSize)
+				if _, chunks := sealedChunks(stream); len(chunks) != tt.wantChunks {
+					t.Errorf("writes of %d bytes: %d chunks, want %d", writeSize, len(chunks), tt.wantChunks)
+				}
+
+				got, err := decrypt(stream, testKey(1))
+				if err != nil {
+					t.Fatalf("writes of %d bytes: decrypt failed: %v", writeSize, err)
+				}
+				if !bytes.Equal(got, plaintext) {
+					t.Fatalf("writes of %d bytes: decrypted %d bytes that differ from the %d encrypted", writeSize, len(got), len(plaintext))
+				}
+			}
+		})
+	}
+}
+
+func TestStreamRejectsAlteredData(t *testing.T) {
+	plaintext := make([]byte, 3*chunkSize)
+	rand.New(rand.NewSource(1)).Read(plaintext)
+	stream := encrypt(t, plaintext, testKey(1), chunkSize)
+	header, chunks := sealedChunks(stream)
+
+	join := func(chunks ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, chunks...), nil)
+	}
+	flipped := bytes.Clone(chunks[1])
+	flipped[10] ^= 1
+
+	tests := []struct {
+		name   string
+		stream []byte
+		key    []byte
+	}{
+		{name: "wrong key", stream: stream, key: testKey(2)},
+		{name: "truncated at a chunk boundary", stream: join(chunks[0], chunks[1])},
+		{name: "truncated to the header", stream: header},
+		{name: "truncated inside a chunk", stream: stream[:len(stream)-100]},
+		{name: "chunks reordered", stream: join(chunks[1], chunks[0], chunks[2])},
+		{name: "chunk dropped", stream: join(chunks[0], chunks[2])},
+		{name: "chunk repeated", stream: join(chunks[0], chunks[0], chunks[1], chunks[2])},
+		{name: "bit flipped", stream: join(chunks[0], flipped, chunks[2])},
+		{name: "data appended", stream: append(bytes.Clone(stream), 0)},
+		{name: "not encrypted", stream: plaintext},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			if key == nil {
+				key = testKey(1)
+			}
+			if _, err := decrypt(tt.stream, key); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("error = %v, want ErrDecrypt", err)
+			}
+		})
+	}
+
+	// Another stream's chunk fails even under the same key, as its nonce
+	// prefix differs
+	_, other := sealedChunks(encrypt(t, plaintext, testKey(1), chunkSize))
+	if _, err := decrypt(join(chunks[0], other[1], chunks[2]), testKey(1)); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("chunk from another stream: error = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestTreeRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":          "a",
+		"empty":          "",
+		"sub/deep/b.txt": string(bytes.Repeat([]byte("b"), chunkSize+1)),
+	}
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	encrypted := filepath.Join(t.TempDir(), "encrypted")
+	if err := EncryptTree(src, encrypted, testKey(1)); err != nil {
+		t.Fatalf("EncryptTree failed: %v", err)
+	}
+	if err := DecryptTree(encrypted, filepath.Join(t.TempDir(), "wrong"), testKey(2)); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("DecryptTree with the wrong key: error = %v, want ErrDecrypt", err)
+	}
+
+	decrypted := filepath.Join(t.TempDir(), "decrypted")
+	if err := DecryptTree(encrypted, decrypted, testKey(1)); err != nil {
+		t.Fatalf("DecryptTree failed: %v", err)
+	}
+	for name, content := range files {
+		sealed, err := os.ReadFile(filepath.Join(encrypted, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != "" && bytes.Contains(sealed, []byte(content)) {
+			t.Errorf("%s is stored in plaintext", name)
+		}
+		got, err := os.ReadFile(filepath.Join(decrypted, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("%s decrypted to %d bytes, want %d", name, len(got), len(content))
+		}
+	}
+}
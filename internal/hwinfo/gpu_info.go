@@ -7,40 +7,143 @@ import (
 	"strings"
 )
 
-// GetNvidiaGPUInfo executes nvidia-smi to get GPU model and VRAM
-func GetNvidiaGPUInfo() (gpuModel string, vramMiB uint64, err error) {
-	cmd := exec.Command("nvidia-smi", "--query-gpu=gpu_name,memory.total", "--format=csv,noheader")
+// gpuQueryFields are the nvidia-smi fields queried for each GPU, in column order
+var gpuQueryFields = []string{
+	"index",
+	"uuid",
+	"name",
+	"memory.total",
+	"memory.free",
+	"driver_version",
+	"compute_cap",
+	"pci.bus_id",
+}
+
+// GPU describes a single NVIDIA GPU detected on the node
+type GPU struct {
+	Index             int    `json:"index"`
+	UUID              string `json:"uuid"`
+	Name              string `json:"name"`
+	MemoryTotalMiB    uint64 `json:"memory_total_mib"`
+	MemoryFreeMiB     uint64 `json:"memory_free_mib"`
+	DriverVersion     string `json:"driver_version"`
+	ComputeCapability string `json:"compute_capability"`
+	PCIBusID          string `json:"pci_bus_id"`
+}
+
+// GetNvidiaGPUs executes nvidia-smi to get the inventory of all GPUs on the node
+func GetNvidiaGPUs() ([]GPU, error) {
+	cmd := exec.Command("nvidia-smi",
+		"--query-gpu="+strings.Join(gpuQueryFields, ","),
+		"--format=csv,noheader,nounits")
 	output, err := cmd.Output()
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to execute nvidia-smi: %w", err)
+		return nil, fmt.Errorf("failed to execute nvidia-smi: %w", err)
+	}
+
+	return parseGPUInventory(string(output))
+}
+
+// parseGPUInventory parses nvidia-smi CSV output into one record per GPU
+func parseGPUInventory(output string) ([]GPU, error) {
+	var gpus []GPU
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.Split(line, ",")
+		if len(parts) != len(gpuQueryFields) {
+			return nil, fmt.Errorf("unexpected nvidia-smi output format: %s", line)
+		}
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+			if notAvailable(parts[i]) {
+				parts[i] = ""
+			}
+		}
+
+		index, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GPU index %q: %w", parts[0], err)
+		}
+		memoryTotal, err := parseMiB(parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse total memory of GPU %d: %w", index, err)
+		}
+		// Free memory is not reported for MIG and vGPU devices
+		var memoryFree uint64
+		if parts[4] != "" {
+			memoryFree, err = parseMiB(parts[4])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse free memory of GPU %d: %w", index, err)
+			}
+		}
+
+		gpus = append(gpus, GPU{
+			Index:             index,
+			UUID:              parts[1],
+			Name:              parts[2],
+			MemoryTotalMiB:    memoryTotal,
+			MemoryFreeMiB:     memoryFree,
+			DriverVersion:     parts[5],
+			ComputeCapability: parts[6],
+			PCIBusID:          parts[7],
+		})
 	}
 
-	// Parse the output
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) == 0 {
-		return "", 0, fmt.Errorf("no GPU information found")
+	if len(gpus) == 0 {
+		return nil, fmt.Errorf("no GPU information found")
 	}
 
-	// Take the first GPU (assuming single GPU setup)
-	line := strings.TrimSpace(lines[0])
-	parts := strings.Split(line, ",")
-	if len(parts) != 2 {
-		return "", 0, fmt.Errorf("unexpected nvidia-smi output format: %s", line)
+	return gpus, nil
+}
+
+// notAvailable reports whether nvidia-smi left a field out, as it does for
+// values a device does not support
+func notAvailable(value string) bool {
+	switch value {
+	case "[N/A]", "N/A", "[Not Supported]":
+		return true
 	}
+	return false
+}
 
-	gpuModel = strings.TrimSpace(parts[0])
-	memoryStr := strings.TrimSpace(parts[1])
+// parseMiB parses a memory value reported in MiB, with or without the unit suffix
+func parseMiB(value string) (uint64, error) {
+	value = strings.TrimSpace(strings.TrimSuffix(value, "MiB"))
+	return strconv.ParseUint(value, 10, 64)
+}
 
-	// Parse memory (format: "8192 MiB")
-	memoryParts := strings.Fields(memoryStr)
-	if len(memoryParts) != 2 || memoryParts[1] != "MiB" {
-		return "", 0, fmt.Errorf("unexpected memory format: %s", memoryStr)
+// Summarize returns the model and per-GPU VRAM used to register the node.
+// Nodes with several GPUs of the same model report it as "<count>x <model>".
+// The VRAM is that of the smallest GPU, the most a job can count on from any
+// one GPU; it is never the sum across GPUs.
+func Summarize(gpus []GPU) (gpuModel string, vramMiB uint64) {
+	if len(gpus) == 0 {
+		return "", 0
 	}
 
-	vramMiB, err = strconv.ParseUint(memoryParts[0], 10, 64)
-	if err != nil {
-		return "", 0, fmt.Errorf("failed to parse VRAM value: %w", err)
+	var names []string
+	seen := make(map[string]int)
+	vramMiB = gpus[0].MemoryTotalMiB
+	for _, gpu := range gpus {
+		vramMiB = min(vramMiB, gpu.MemoryTotalMiB)
+		if _, ok := seen[gpu.Name]; !ok {
+			names = append(names, gpu.Name)
+		}
+		seen[gpu.Name]++
+	}
+
+	models := make([]string, 0, len(names))
+	for _, name := range names {
+		if seen[name] > 1 {
+			models = append(models, fmt.Sprintf("%dx %s", seen[name], name))
+		} else {
+			models = append(models, name)
+		}
 	}
 
-	return gpuModel, vramMiB, nil
+	return strings.Join(models, ", "), vramMiB
 }
@@ -0,0 +1,159 @@
+package hwinfo
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// a100Line returns an nvidia-smi CSV line for the index'th GPU of an 8x A100 node
+func a100Line(index int) string {
+	return fmt.Sprintf("%d, GPU-a100-%d, NVIDIA A100-SXM4-80GB, 81920, 81037, 535.129.03, 8.0, 00000000:%02X:00.0",
+		index, index, 0x10+index)
+}
+
+// a100Lines returns nvidia-smi CSV output for count A100 GPUs
+func a100Lines(count int) string {
+	lines := make([]string, count)
+	for i := range lines {
+		lines[i] = a100Line(i)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestParseGPUInventory(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []GPU
+		wantErr bool
+	}{
+		{
+			name:   "one GPU",
+			output: "0, GPU-4f2c, NVIDIA GeForce RTX 4090, 24564, 23889, 550.54.14, 8.9, 00000000:01:00.0\n",
+			want: []GPU{{
+				Index: 0, UUID: "GPU-4f2c", Name: "NVIDIA GeForce RTX 4090",
+				MemoryTotalMiB: 24564, MemoryFreeMiB: 23889,
+				DriverVersion: "550.54.14", ComputeCapability: "8.9", PCIBusID: "00000000:01:00.0",
+			}},
+		},
+		{
+			name:   "units left in",
+			output: "0, GPU-4f2c, NVIDIA GeForce RTX 4090, 24564 MiB, 23889 MiB, 550.54.14, 8.9, 00000000:01:00.0",
+			want: []GPU{{
+				Index: 0, UUID: "GPU-4f2c", Name: "NVIDIA GeForce RTX 4090",
+				MemoryTotalMiB: 24564, MemoryFreeMiB: 23889,
+				DriverVersion: "550.54.14", ComputeCapability: "8.9", PCIBusID: "00000000:01:00.0",
+			}},
+		},
+		{
+			name:   "free memory and compute capability not available",
+			output: "0, GPU-vgpu, GRID A100D-40C, 40960, [N/A], 535.129.03, [N/A], 00000000:02:00.0\n",
+			want: []GPU{{
+				Index: 0, UUID: "GPU-vgpu", Name: "GRID A100D-40C",
+				MemoryTotalMiB: 40960, DriverVersion: "535.129.03", PCIBusID: "00000000:02:00.0",
+			}},
+		},
+		{
+			name:   "not supported field",
+			output: "0, GPU-mig, NVIDIA A30, 24576, [Not Supported], 535.129.03, 8.0, 00000000:03:00.0\n",
+			want: []GPU{{
+				Index: 0, UUID: "GPU-mig", Name: "NVIDIA A30",
+				MemoryTotalMiB: 24576, DriverVersion: "535.129.03", ComputeCapability: "8.0", PCIBusID: "00000000:03:00.0",
+			}},
+		},
+		{
+			name:   "blank lines",
+			output: "\n" + a100Line(0) + "\n\n",
+			want: []GPU{{
+				Index: 0, UUID: "GPU-a100-0", Name: "NVIDIA A100-SXM4-80GB",
+				MemoryTotalMiB: 81920, MemoryFreeMiB: 81037,
+				DriverVersion: "535.129.03", ComputeCapability: "8.0", PCIBusID: "00000000:10:00.0",
+			}},
+		},
+		{name: "no output", output: "\n", wantErr: true},
+		{name: "too few fields", output: "0, GPU-4f2c, NVIDIA GeForce RTX 4090, 24564\n", wantErr: true},
+		{name: "too many fields", output: a100Line(0) + ", extra\n", wantErr: true},
+		{name: "bad index", output: strings.Replace(a100Line(0), "0,", "x,", 1), wantErr: true},
+		{name: "bad total memory", output: strings.Replace(a100Line(0), "81920", "lots", 1), wantErr: true},
+		{name: "total memory not available", output: strings.Replace(a100Line(0), "81920", "[N/A]", 1), wantErr: true},
+		{name: "bad free memory", output: strings.Replace(a100Line(0), "81037", "-1", 1), wantErr: true},
+		{name: "malformed line after a good one", output: a100Line(0) + "\nnvidia-smi has failed\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gpus, err := parseGPUInventory(tt.output)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", gpus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(gpus) != len(tt.want) {
+				t.Fatalf("got %d GPUs, want %d", len(gpus), len(tt.want))
+			}
+			for i := range gpus {
+				if gpus[i] != tt.want[i] {
+					t.Errorf("GPU %d = %+v, want %+v", i, gpus[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseGPUInventoryMultiGPU(t *testing.T) {
+	for _, count := range []int{1, 4, 8} {
+		t.Run(fmt.Sprintf("%d GPUs", count), func(t *testing.T) {
+			gpus, err := parseGPUInventory(a100Lines(count))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(gpus) != count {
+				t.Fatalf("got %d GPUs, want %d", len(gpus), count)
+			}
+			for i, gpu := range gpus {
+				if gpu.Index != i || gpu.UUID != fmt.Sprintf("GPU-a100-%d", i) || gpu.MemoryTotalMiB != 81920 {
+					t.Errorf("GPU %d = %+v", i, gpu)
+				}
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	eight, err := parseGPUInventory(a100Lines(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mixed := []GPU{
+		{Name: "NVIDIA GeForce RTX 4090", MemoryTotalMiB: 24564},
+		{Name: "NVIDIA GeForce RTX 3090", MemoryTotalMiB: 24576},
+		{Name: "NVIDIA GeForce RTX 4090", MemoryTotalMiB: 24564},
+		{Name: "NVIDIA RTX A2000", MemoryTotalMiB: 6138},
+	}
+
+	tests := []struct {
+		name      string
+		gpus      []GPU
+		wantModel string
+		wantVRAM  uint64
+	}{
+		{name: "no GPUs"},
+		{name: "one GPU", gpus: eight[:1], wantModel: "NVIDIA A100-SXM4-80GB", wantVRAM: 81920},
+		{name: "eight of a model", gpus: eight, wantModel: "8x NVIDIA A100-SXM4-80GB", wantVRAM: 81920},
+		{name: "mixed models", gpus: mixed, wantModel: "2x NVIDIA GeForce RTX 4090, NVIDIA GeForce RTX 3090, NVIDIA RTX A2000", wantVRAM: 6138},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model, vram := Summarize(tt.gpus)
+			if model != tt.wantModel || vram != tt.wantVRAM {
+				t.Errorf("Summarize = (%q, %d), want (%q, %d)", model, vram, tt.wantModel, tt.wantVRAM)
+			}
+		})
+	}
+}
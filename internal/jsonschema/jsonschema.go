@@ -0,0 +1,122 @@
+// Package jsonschema derives JSON Schemas from the Go types of the agent's
+// messages, so the published schemas cannot drift from what is sent
+package jsonschema
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Draft is the JSON Schema dialect generated
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is a JSON Schema document or subschema
+type Schema map[string]any
+
+// Enum is implemented by string types with a closed set of values. Adding
+// a value changes the message version.
+type Enum interface {
+	Enum() []string
+}
+
+var (
+	enumType = reflect.TypeOf((*Enum)(nil)).Elem()
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// Generate returns the schema of v's type, which must be a struct. Fields
+// follow their json tags; fields without omitempty are required. Objects may
+// carry properties the schema does not list, so consumers of an older
+// schema still accept newer messages. A field's allowed values come from its
+// type's Enum method or an `enum` tag listing them separated by commas, and
+// are a closed enum.
+func Generate(v any, title string) Schema {
+	schema := forType(reflect.TypeOf(v))
+	schema["$schema"] = Draft
+	schema["title"] = title
+	return schema
+}
+
+// forType returns the schema of t
+func forType(t reflect.Type) Schema {
+	if t.Implements(enumType) && t.Kind() == reflect.String {
+		return enum(reflect.Zero(t).Interface().(Enum).Enum())
+	}
+
+	switch {
+	case t == timeType:
+		return Schema{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		return forType(t.Elem())
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return Schema{"type": "array", "items": forType(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": forType(t.Elem())}
+	case reflect.Struct:
+		return forStruct(t)
+	}
+	return Schema{}
+}
+
+// forStruct returns the schema of a struct type from its exported fields
+func forStruct(t reflect.Type) Schema {
+	properties := Schema{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := forType(field.Type)
+		if values := field.Tag.Get("enum"); values != "" {
+			property = enum(strings.Split(values, ","))
+		}
+		properties[name] = property
+		if !hasOption(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	return Schema{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// enum returns the schema of a string with a closed set of values
+func enum(values []string) Schema {
+	return Schema{"type": "string", "enum": values}
+}
+
+// hasOption reports whether a json tag's options include option
+func hasOption(options, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
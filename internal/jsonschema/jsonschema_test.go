@@ -0,0 +1,48 @@
+package jsonschema
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testColor string
+
+func (testColor) Enum() []string { return []string{"red", "green"} }
+
+type testNested struct {
+	Name string `json:"name"`
+}
+
+type testMessage struct {
+	Color  testColor         `json:"color"`
+	Result string            `json:"result" enum:"accepted,rejected"`
+	Nested *testNested       `json:"nested,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func TestGenerateIsOpen(t *testing.T) {
+	schema := Generate(testMessage{}, "Test")
+	properties := schema["properties"].(Schema)
+
+	// Objects accept fields they do not list
+	for name, object := range map[string]Schema{"message": schema, "nested": properties["nested"].(Schema)} {
+		if _, ok := object["additionalProperties"]; ok {
+			t.Errorf("%s: additionalProperties = %v, want it unset", name, object["additionalProperties"])
+		}
+	}
+	if labels := properties["labels"].(Schema); !reflect.DeepEqual(labels["additionalProperties"], Schema{"type": "string"}) {
+		t.Errorf("labels: additionalProperties = %v, want string values", labels["additionalProperties"])
+	}
+
+	// Allowed values are a closed set
+	for name, want := range map[string][]string{"color": {"red", "green"}, "result": {"accepted", "rejected"}} {
+		property := properties[name].(Schema)
+		if !reflect.DeepEqual(property["enum"], want) || property["type"] != "string" {
+			t.Errorf("%s = %v, want a string enum of %v", name, property, want)
+		}
+	}
+
+	if required := schema["required"]; !reflect.DeepEqual(required, []string{"color", "result"}) {
+		t.Errorf("required = %v, want [color result]", required)
+	}
+}
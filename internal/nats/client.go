@@ -4,39 +4,126 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
 )
 
 // Client defines the interface for NATS operations
 type Client interface {
-	SubscribeToJobs(ctx context.Context, subject string, handler func(msg []byte)) error
-	PublishStatusUpdate(ctx context.Context, status []byte) error
+	SubscribeToJobs(ctx context.Context, subject string, handler func(job JobDelivery)) error
+	SubscribeToCancellations(ctx context.Context, subject string, handler func(msg []byte) []byte) error
+	PublishStatusUpdate(ctx context.Context, subject string, status []byte) error
+	PublishLogChunk(ctx context.Context, subject string, chunk []byte) error
+	PublishPresence(ctx context.Context, subject string, presence []byte) error
+	// OnReconnect registers a handler called after each reconnect to NATS
+	OnReconnect(handler func())
 	Close()
 }
 
+// JobDelivery is a received job message. The agent settles it once the job
+// has a final status; settling only has an effect with JetStream, where an
+// unsettled job is delivered again.
+type JobDelivery interface {
+	Data() []byte
+	// Ack marks the job as done so it is not delivered again
+	Ack()
+	// Nak asks for the job to be delivered again after delay
+	Nak(delay time.Duration)
+	// Term drops the job without delivering it again
+	Term()
+	// Respond answers the dispatcher, if the job message asked for a reply
+	Respond(reply []byte)
+	// Sequence identifies a stored job message and is the same on every
+	// delivery of it; it is 0 for messages that are not stored
+	Sequence() uint64
+	// Redeliverable reports whether Nak delivers the job again
+	Redeliverable() bool
+	// Release stops tracking the job without settling it, once a later
+	// delivery of the same message has taken over
+	Release()
+}
+
+// coreDelivery is a job received through core NATS, which has no
+// acknowledgements; a job sent as a request is answered on its reply subject
+type coreDelivery struct {
+	msg *nats.Msg
+}
+
+func (d coreDelivery) Data() []byte        { return d.msg.Data }
+func (d coreDelivery) Ack()                {}
+func (d coreDelivery) Nak(time.Duration)   {}
+func (d coreDelivery) Term()               {}
+func (d coreDelivery) Sequence() uint64    { return 0 }
+func (d coreDelivery) Redeliverable() bool { return false }
+func (d coreDelivery) Release()            {}
+
+func (d coreDelivery) Respond(reply []byte) {
+	if d.msg.Reply == "" {
+		return
+	}
+	if err := d.msg.Respond(reply); err != nil {
+		log.Printf("Failed to reply to job message: %v", err)
+	}
+}
+
 // natsClient implements Client using NATS
 type natsClient struct {
 	conn *nats.Conn
+
+	mu                sync.Mutex
+	reconnectHandlers []func()
 }
 
 // NewNatsClient creates a new NATS client
-func NewNatsClient(url string) (Client, error) {
-	conn, err := nats.Connect(url)
+func NewNatsClient(url string, opts ConnectOptions) (Client, error) {
+	n := &natsClient{}
+	if err := n.connect(url, opts); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// connect opens the client's connection, which reconnects on its own
+func (n *natsClient) connect(url string, opts ConnectOptions) error {
+	options, err := opts.natsOptions(n.reconnected)
+	if err != nil {
+		return err
+	}
+	conn, err := nats.Connect(url, options...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		return fmt.Errorf("failed to connect to NATS: %w", err)
 	}
+	n.conn = conn
+	log.Printf("Connected to NATS at %s", conn.ConnectedUrlRedacted())
+	return nil
+}
 
-	return &natsClient{
-		conn: conn,
-	}, nil
+// OnReconnect registers a handler called after each reconnect to NATS
+func (n *natsClient) OnReconnect(handler func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.reconnectHandlers = append(n.reconnectHandlers, handler)
 }
 
-// SubscribeToJobs subscribes to a NATS subject for job messages
-func (n *natsClient) SubscribeToJobs(ctx context.Context, subject string, handler func(msg []byte)) error {
+// reconnected runs the reconnect handlers
+func (n *natsClient) reconnected() {
+	n.mu.Lock()
+	handlers := append([]func(){}, n.reconnectHandlers...)
+	n.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+// SubscribeToJobs subscribes to a NATS subject for job messages. Jobs sent
+// while the agent is not subscribed are lost.
+func (n *natsClient) SubscribeToJobs(ctx context.Context, subject string, handler func(job JobDelivery)) error {
 	subscription, err := n.conn.Subscribe(subject, func(msg *nats.Msg) {
 		log.Printf("Received job message on subject: %s", subject)
-		handler(msg.Data)
+		handler(coreDelivery{msg: msg})
 	})
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to subject %s: %w", subject, err)
@@ -52,10 +139,36 @@ func (n *natsClient) SubscribeToJobs(ctx context.Context, subject string, handle
 	return nil
 }
 
-// PublishStatusUpdate publishes a status update to NATS
-func (n *natsClient) PublishStatusUpdate(ctx context.Context, status []byte) error {
-	// Publish to a status topic
-	subject := "agent.status"
+// SubscribeToCancellations subscribes to a NATS subject for job cancellation
+// requests. The handler's return value is sent as the reply when the
+// request carries a reply subject.
+func (n *natsClient) SubscribeToCancellations(ctx context.Context, subject string, handler func(msg []byte) []byte) error {
+	subscription, err := n.conn.Subscribe(subject, func(msg *nats.Msg) {
+		log.Printf("Received cancellation request on subject: %s", subject)
+		reply := handler(msg.Data)
+		if msg.Reply == "" || reply == nil {
+			return
+		}
+		if err := msg.Respond(reply); err != nil {
+			log.Printf("Failed to reply to cancellation request: %v", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to subject %s: %w", subject, err)
+	}
+
+	// Handle context cancellation
+	go func() {
+		<-ctx.Done()
+		subscription.Unsubscribe()
+		log.Printf("Unsubscribed from subject: %s", subject)
+	}()
+
+	return nil
+}
+
+// PublishStatusUpdate publishes a status update to NATS on subject
+func (n *natsClient) PublishStatusUpdate(ctx context.Context, subject string, status []byte) error {
 	err := n.conn.Publish(subject, status)
 	if err != nil {
 		return fmt.Errorf("failed to publish status update: %w", err)
@@ -65,6 +178,24 @@ func (n *natsClient) PublishStatusUpdate(ctx context.Context, status []byte) err
 	return nil
 }
 
+// PublishLogChunk publishes a chunk of a running job's logs. It does not log
+// each publish, since a job streams many chunks.
+func (n *natsClient) PublishLogChunk(ctx context.Context, subject string, chunk []byte) error {
+	if err := n.conn.Publish(subject, chunk); err != nil {
+		return fmt.Errorf("failed to publish log chunk: %w", err)
+	}
+	return nil
+}
+
+// PublishPresence publishes the agent's presence on subject
+func (n *natsClient) PublishPresence(ctx context.Context, subject string, presence []byte) error {
+	if err := n.conn.Publish(subject, presence); err != nil {
+		return fmt.Errorf("failed to publish presence: %w", err)
+	}
+	log.Printf("Published presence to subject: %s", subject)
+	return nil
+}
+
 // Close closes the NATS connection
 func (n *natsClient) Close() {
 	if n.conn != nil {
@@ -0,0 +1,122 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ConnectOptions configures how the agent connects and authenticates to NATS.
+// At most one of user/password, token, NKey seed and credentials file may be
+// set; a TLS client certificate can be combined with any of them.
+type ConnectOptions struct {
+	User     string
+	Password string
+	Token    string
+	// NKeySeedFile holds an NKey seed used to sign the server's nonce
+	NKeySeedFile string
+	// CredentialsFile is a .creds file holding a user JWT and its NKey seed
+	CredentialsFile string
+
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSCAFile verifies the server's certificate instead of the system roots
+	TLSCAFile string
+
+	// ReconnectWait is the first delay between reconnect attempts; it doubles
+	// with each failed attempt up to MaxReconnectWait
+	ReconnectWait    time.Duration
+	MaxReconnectWait time.Duration
+}
+
+// natsOptions turns opts into nats.go options. Reconnects are attempted
+// forever, with backoff, and connection events are logged; reconnected is
+// called after each successful reconnect.
+func (opts ConnectOptions) natsOptions(reconnected func()) ([]nats.Option, error) {
+	options := []nats.Option{
+		nats.Name("lamda_node_agent"),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(opts.reconnectDelay),
+		nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("Disconnected from NATS: %v", err)
+			} else {
+				log.Printf("Disconnected from NATS")
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Printf("Reconnected to NATS at %s", conn.ConnectedUrlRedacted())
+			reconnected()
+		}),
+		nats.ClosedHandler(func(conn *nats.Conn) {
+			log.Printf("NATS connection closed")
+		}),
+		nats.ErrorHandler(func(conn *nats.Conn, sub *nats.Subscription, err error) {
+			if sub != nil {
+				log.Printf("NATS error on subject %s: %v", sub.Subject, err)
+			} else {
+				log.Printf("NATS error: %v", err)
+			}
+		}),
+	}
+
+	methods := 0
+	if opts.User != "" || opts.Password != "" {
+		methods++
+		options = append(options, nats.UserInfo(opts.User, opts.Password))
+	}
+	if opts.Token != "" {
+		methods++
+		options = append(options, nats.Token(opts.Token))
+	}
+	if opts.NKeySeedFile != "" {
+		methods++
+		option, err := nats.NkeyOptionFromSeed(opts.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load NATS NKey seed: %w", err)
+		}
+		options = append(options, option)
+	}
+	if opts.CredentialsFile != "" {
+		methods++
+		options = append(options, nats.UserCredentials(opts.CredentialsFile))
+	}
+	if methods > 1 {
+		return nil, errors.New("only one of NATS user/password, token, NKey seed and credentials file may be set")
+	}
+
+	switch {
+	case opts.TLSCertFile != "" && opts.TLSKeyFile != "":
+		options = append(options, nats.ClientCert(opts.TLSCertFile, opts.TLSKeyFile))
+	case opts.TLSCertFile != "" || opts.TLSKeyFile != "":
+		return nil, errors.New("a NATS TLS client certificate needs both a certificate and a key file")
+	}
+	if opts.TLSCAFile != "" {
+		options = append(options, nats.RootCAs(opts.TLSCAFile))
+	}
+	return options, nil
+}
+
+// reconnectDelay doubles the wait with each attempt up to MaxReconnectWait,
+// adding up to a quarter of jitter so agents do not reconnect in lockstep
+func (opts ConnectOptions) reconnectDelay(attempts int) time.Duration {
+	delay := opts.ReconnectWait
+	if delay <= 0 {
+		delay = time.Second
+	}
+	maxDelay := opts.MaxReconnectWait
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/4+1))
+}
@@ -0,0 +1,210 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ReplyToHeader names the subject a job stored in JetStream is answered on.
+// Replies cannot use the message's own reply subject, which JetStream uses
+// for acknowledgements.
+const ReplyToHeader = "Lamda-Reply-To"
+
+// JetStreamOptions configures durable job delivery
+type JetStreamOptions struct {
+	// Stream holds job messages. It is created, capturing jobs.dispatch.>
+	// as a work queue, if it does not exist.
+	Stream string
+	// AckWait is how long a delivered job may go without an acknowledgement
+	// or heartbeat before it is delivered again
+	AckWait time.Duration
+	// MaxDeliver bounds how often a job is delivered; 0 means no limit
+	MaxDeliver int
+}
+
+// jetStreamClient implements Client like natsClient, but receives jobs from a
+// durable JetStream pull consumer, so jobs sent while the agent is offline
+// are delivered when it returns
+type jetStreamClient struct {
+	natsClient
+	js   jetstream.JetStream
+	opts JetStreamOptions
+}
+
+// NewJetStreamClient creates a NATS client that receives jobs through JetStream
+func NewJetStreamClient(url string, connOpts ConnectOptions, opts JetStreamOptions) (Client, error) {
+	if opts.Stream == "" {
+		return nil, errors.New("a JetStream stream name is required")
+	}
+	if opts.AckWait <= 0 {
+		return nil, errors.New("the JetStream ack wait must be positive")
+	}
+
+	j := &jetStreamClient{opts: opts}
+	if err := j.connect(url, connOpts); err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(j.conn)
+	if err != nil {
+		j.conn.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	j.js = js
+	return j, nil
+}
+
+// SubscribeToJobs consumes job messages on subject through a durable pull
+// consumer named after the subject. Each job must be settled; until then a
+// heartbeat keeps it from being delivered again.
+func (j *jetStreamClient) SubscribeToJobs(ctx context.Context, subject string, handler func(job JobDelivery)) error {
+	stream, err := j.js.Stream(ctx, j.opts.Stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		log.Printf("Creating JetStream stream %s for job messages", j.opts.Stream)
+		stream, err = j.js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:      j.opts.Stream,
+			Subjects:  []string{"jobs.dispatch.>"},
+			Retention: jetstream.WorkQueuePolicy,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open JetStream stream %s: %w", j.opts.Stream, err)
+	}
+
+	maxDeliver := j.opts.MaxDeliver
+	if maxDeliver <= 0 {
+		maxDeliver = -1
+	}
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       durableName(subject),
+		FilterSubject: subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       j.opts.AckWait,
+		MaxDeliver:    maxDeliver,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream consumer for %s: %w", subject, err)
+	}
+
+	consumeCtx, err := consumer.Consume(func(msg jetstream.Msg) {
+		log.Printf("Received job message on subject: %s", subject)
+		handler(newJetStreamDelivery(j.conn, msg, j.opts.AckWait/2, j.opts.MaxDeliver))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to consume from %s: %w", subject, err)
+	}
+
+	// Handle context cancellation
+	go func() {
+		<-ctx.Done()
+		consumeCtx.Stop()
+		log.Printf("Stopped consuming from subject: %s", subject)
+	}()
+
+	return nil
+}
+
+// durableName derives a consumer name from a subject; names cannot hold dots
+func durableName(subject string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(subject)
+}
+
+// jetStreamDelivery is a job received through JetStream. It sends InProgress
+// heartbeats until it is settled, so long jobs are not delivered twice.
+type jetStreamDelivery struct {
+	conn          *nats.Conn
+	msg           jetstream.Msg
+	sequence      uint64 // the message's stream sequence
+	redeliverable bool   // false on the consumer's last delivery
+	once          sync.Once
+	done          chan struct{}
+}
+
+// newJetStreamDelivery wraps msg and starts its heartbeat. maxDeliver is the
+// consumer's delivery limit; 0 means none.
+func newJetStreamDelivery(conn *nats.Conn, msg jetstream.Msg, heartbeat time.Duration, maxDeliver int) *jetStreamDelivery {
+	d := &jetStreamDelivery{conn: conn, msg: msg, redeliverable: true, done: make(chan struct{})}
+	if meta, err := msg.Metadata(); err == nil {
+		d.sequence = meta.Sequence.Stream
+		d.redeliverable = maxDeliver <= 0 || meta.NumDelivered < uint64(maxDeliver)
+	} else {
+		log.Printf("Failed to read job message metadata: %v", err)
+	}
+	go d.heartbeat(heartbeat)
+	return d
+}
+
+// heartbeat extends the ack deadline every interval until the job is settled
+func (d *jetStreamDelivery) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.msg.InProgress(); err != nil {
+				log.Printf("Failed to send job heartbeat, stopping: %v", err)
+				return
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *jetStreamDelivery) Data() []byte {
+	return d.msg.Data()
+}
+
+func (d *jetStreamDelivery) Ack() {
+	d.settle("ack", d.msg.Ack)
+}
+
+func (d *jetStreamDelivery) Nak(delay time.Duration) {
+	d.settle("nak", func() error { return d.msg.NakWithDelay(delay) })
+}
+
+func (d *jetStreamDelivery) Term() {
+	d.settle("term", d.msg.Term)
+}
+
+func (d *jetStreamDelivery) Sequence() uint64 {
+	return d.sequence
+}
+
+func (d *jetStreamDelivery) Redeliverable() bool {
+	return d.redeliverable
+}
+
+// Release stops the heartbeat without settling the message
+func (d *jetStreamDelivery) Release() {
+	d.once.Do(func() { close(d.done) })
+}
+
+// Respond publishes reply to the subject in the message's ReplyToHeader
+func (d *jetStreamDelivery) Respond(reply []byte) {
+	subject := d.msg.Headers().Get(ReplyToHeader)
+	if subject == "" {
+		return
+	}
+	if err := d.conn.Publish(subject, reply); err != nil {
+		log.Printf("Failed to reply to job message: %v", err)
+	}
+}
+
+// settle stops the heartbeat and sends the first acknowledgement made
+func (d *jetStreamDelivery) settle(kind string, send func() error) {
+	d.once.Do(func() {
+		close(d.done)
+		if err := send(); err != nil {
+			log.Printf("Failed to %s job message: %v", kind, err)
+		}
+	})
+}
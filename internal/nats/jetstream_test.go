@@ -0,0 +1,256 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	testStream  = "JOBS"
+	testSubject = "jobs.dispatch.agent"
+)
+
+// runJetStreamServer starts an embedded NATS server with JetStream enabled
+func runJetStreamServer(t *testing.T) *server.Server {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(func() {
+		s.Shutdown()
+		s.WaitForShutdown()
+	})
+	return s
+}
+
+// consumeJobs subscribes a new JetStream client to testSubject and returns
+// the deliveries it receives. Cancelling the context and closing the client
+// stops it as an agent shutting down would.
+func consumeJobs(t *testing.T, s *server.Server, opts JetStreamOptions) (Client, context.CancelFunc, <-chan JobDelivery) {
+	t.Helper()
+	opts.Stream = testStream
+	client, err := NewJetStreamClient(s.ClientURL(), ConnectOptions{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+	})
+
+	deliveries := make(chan JobDelivery, 10)
+	if err := client.SubscribeToJobs(ctx, testSubject, func(job JobDelivery) { deliveries <- job }); err != nil {
+		t.Fatal(err)
+	}
+	return client, cancel, deliveries
+}
+
+// testJetStream connects to the server as a dispatcher would
+func testJetStream(t *testing.T, s *server.Server) jetstream.JetStream {
+	t.Helper()
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+// publishJob stores a job message in the stream
+func publishJob(t *testing.T, js jetstream.JetStream, data string) uint64 {
+	t.Helper()
+	ack, err := js.Publish(context.Background(), testSubject, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ack.Sequence
+}
+
+// nextDelivery waits for a delivery
+func nextDelivery(t *testing.T, deliveries <-chan JobDelivery, timeout time.Duration) JobDelivery {
+	t.Helper()
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(timeout):
+		t.Fatalf("no job delivered within %s", timeout)
+		return nil
+	}
+}
+
+// expectNoDelivery fails if a job is delivered within wait
+func expectNoDelivery(t *testing.T, deliveries <-chan JobDelivery, wait time.Duration) {
+	t.Helper()
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("job %q was delivered again", delivery.Data())
+	case <-time.After(wait):
+	}
+}
+
+// expectStreamEmpty waits for the work queue to drop every message, which it
+// does once they are acknowledged or terminated
+func expectStreamEmpty(t *testing.T, js jetstream.JetStream) {
+	t.Helper()
+	stream, err := js.Stream(context.Background(), testStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := stream.Info(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.State.Msgs == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream still holds %d message(s)", info.State.Msgs)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestJetStreamAckSettlesJob(t *testing.T) {
+	s := runJetStreamServer(t)
+	_, _, deliveries := consumeJobs(t, s, JetStreamOptions{AckWait: 500 * time.Millisecond, MaxDeliver: 3})
+	js := testJetStream(t, s)
+
+	sequence := publishJob(t, js, "job-1")
+	delivery := nextDelivery(t, deliveries, 5*time.Second)
+	if string(delivery.Data()) != "job-1" {
+		t.Errorf("Data() = %q, want job-1", delivery.Data())
+	}
+	if delivery.Sequence() != sequence {
+		t.Errorf("Sequence() = %d, want %d", delivery.Sequence(), sequence)
+	}
+	if !delivery.Redeliverable() {
+		t.Error("the first of 3 deliveries is not redeliverable")
+	}
+
+	delivery.Ack()
+	expectStreamEmpty(t, js)
+	expectNoDelivery(t, deliveries, 1500*time.Millisecond)
+}
+
+func TestJetStreamNakDeliversAgainAfterDelay(t *testing.T) {
+	s := runJetStreamServer(t)
+	_, _, deliveries := consumeJobs(t, s, JetStreamOptions{AckWait: 5 * time.Second, MaxDeliver: 2})
+	js := testJetStream(t, s)
+
+	sequence := publishJob(t, js, "job-1")
+	first := nextDelivery(t, deliveries, 5*time.Second)
+	const delay = 500 * time.Millisecond
+	naked := time.Now()
+	first.Nak(delay)
+
+	second := nextDelivery(t, deliveries, 5*time.Second)
+	if elapsed := time.Since(naked); elapsed < delay {
+		t.Errorf("job was delivered again after %s, before the %s delay", elapsed, delay)
+	}
+	if string(second.Data()) != "job-1" || second.Sequence() != sequence {
+		t.Errorf("second delivery is %q at sequence %d, want job-1 at %d", second.Data(), second.Sequence(), sequence)
+	}
+	if second.Redeliverable() {
+		t.Error("the last of 2 deliveries is redeliverable")
+	}
+
+	// Naking the last delivery does not deliver the job a third time
+	second.Nak(time.Millisecond)
+	expectNoDelivery(t, deliveries, time.Second)
+}
+
+func TestJetStreamTermDropsJob(t *testing.T) {
+	s := runJetStreamServer(t)
+	_, _, deliveries := consumeJobs(t, s, JetStreamOptions{AckWait: 500 * time.Millisecond, MaxDeliver: 3})
+	js := testJetStream(t, s)
+
+	publishJob(t, js, "job-1")
+	nextDelivery(t, deliveries, 5*time.Second).Term()
+
+	expectStreamEmpty(t, js)
+	expectNoDelivery(t, deliveries, 1500*time.Millisecond)
+}
+
+func TestJetStreamHeartbeatHoldsJobPastAckWait(t *testing.T) {
+	s := runJetStreamServer(t)
+	const ackWait = 500 * time.Millisecond
+	_, _, deliveries := consumeJobs(t, s, JetStreamOptions{AckWait: ackWait, MaxDeliver: 3})
+	js := testJetStream(t, s)
+
+	publishJob(t, js, "job-1")
+	delivery := nextDelivery(t, deliveries, 5*time.Second)
+
+	// The job runs for several ack waits; heartbeats keep it from coming back
+	expectNoDelivery(t, deliveries, 4*ackWait)
+	delivery.Ack()
+	expectStreamEmpty(t, js)
+	expectNoDelivery(t, deliveries, 2*ackWait)
+}
+
+func TestJetStreamRedeliversUnsettledJobAfterRestart(t *testing.T) {
+	s := runJetStreamServer(t)
+	opts := JetStreamOptions{AckWait: 500 * time.Millisecond, MaxDeliver: 3}
+	client, cancel, deliveries := consumeJobs(t, s, opts)
+	js := testJetStream(t, s)
+
+	sequence := publishJob(t, js, "job-1")
+	nextDelivery(t, deliveries, 5*time.Second)
+
+	// The agent stops without settling the job, as if it crashed
+	cancel()
+	client.Close()
+
+	_, _, restarted := consumeJobs(t, s, opts)
+	delivery := nextDelivery(t, restarted, 5*time.Second)
+	if string(delivery.Data()) != "job-1" || delivery.Sequence() != sequence {
+		t.Errorf("after restart, got %q at sequence %d, want job-1 at %d", delivery.Data(), delivery.Sequence(), sequence)
+	}
+	if !delivery.Redeliverable() {
+		t.Error("the second of 3 deliveries is not redeliverable")
+	}
+	delivery.Ack()
+	expectStreamEmpty(t, js)
+}
+
+func TestJetStreamReleaseLeavesJobUnsettled(t *testing.T) {
+	s := runJetStreamServer(t)
+	const ackWait = 500 * time.Millisecond
+	_, _, deliveries := consumeJobs(t, s, JetStreamOptions{AckWait: ackWait, MaxDeliver: 3})
+	js := testJetStream(t, s)
+
+	sequence := publishJob(t, js, "job-1")
+	first := nextDelivery(t, deliveries, 5*time.Second)
+
+	// Without its heartbeat the job comes back once the ack wait runs out
+	first.Release()
+	second := nextDelivery(t, deliveries, 5*time.Second)
+	if second.Sequence() != sequence {
+		t.Errorf("redelivered sequence %d, want %d", second.Sequence(), sequence)
+	}
+	second.Ack()
+	expectStreamEmpty(t, js)
+}
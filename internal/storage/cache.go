@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// cacheContentName is the file or directory holding an entry's content
+const cacheContentName = "content"
+
+// cacheCIDName is the file holding the CID an entry was first fetched by
+const cacheCIDName = "cid"
+
+// cacheTempPrefix marks entries still being downloaded
+const cacheTempPrefix = "tmp-"
+
+// CacheStats are the input cache's counters
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	SizeBytes int64
+	MaxBytes  int64
+}
+
+// CachedInput is a verified input held in the cache. It must be released
+// when the job no longer needs it so it can be evicted.
+type CachedInput struct {
+	Path  string // file or directory with the input's content; read-only
+	IsDir bool
+
+	cache *inputCache
+	entry *cacheEntry
+	once  sync.Once
+}
+
+// Release drops the job's reference to the input
+func (c *CachedInput) Release() {
+	c.once.Do(func() {
+		c.cache.release(c.entry)
+	})
+}
+
+// CopyTo copies the cached content to dest, for jobs that need a writable copy
+func (c *CachedInput) CopyTo(dest string) error {
+	if !c.IsDir {
+		return copyLocalFile(c.Path, dest, nil)
+	}
+
+	files, err := collectFiles(c.Path, "input")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		destPath := filepath.Join(dest, filepath.FromSlash(file.name))
+		if file.isDir {
+			if err := os.MkdirAll(destPath, 0755); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			continue
+		}
+		if err := copyLocalFile(file.path, destPath, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheEntry is one cached input
+type cacheEntry struct {
+	key   string
+	cid   string // the CID the input was fetched by; empty for entries cached before CIDs were recorded
+	dir   string
+	isDir bool
+	size  int64
+	refs  int
+	elem  *list.Element // position in the LRU list while the entry is cached
+}
+
+// inputCache keeps content-addressed inputs on disk, keyed by the multihash
+// of their root CID. Entries are evicted least recently used first once the
+// cache is over its size limit, but never while a job holds a reference.
+type inputCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	entries  map[string]*cacheEntry
+	lru      *list.List // front is most recently used
+	fetching map[string]chan struct{}
+	stats    CacheStats
+}
+
+// newInputCache opens the cache in dir, keeping entries left by a previous run
+func newInputCache(dir string, maxBytes int64) (*inputCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create input cache directory: %w", err)
+	}
+
+	c := &inputCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*cacheEntry),
+		lru:      list.New(),
+		fetching: make(map[string]chan struct{}),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.evict()
+	return c, nil
+}
+
+// load indexes the entries already on disk and removes interrupted downloads
+func (c *inputCache) load() error {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read input cache directory: %w", err)
+	}
+
+	for _, dirEntry := range dirEntries {
+		entryDir := filepath.Join(c.dir, dirEntry.Name())
+		if strings.HasPrefix(dirEntry.Name(), cacheTempPrefix) {
+			os.RemoveAll(entryDir)
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(entryDir, cacheContentName))
+		if err != nil {
+			os.RemoveAll(entryDir)
+			continue
+		}
+		size, err := diskUsage(entryDir)
+		if err != nil {
+			return err
+		}
+
+		entry := &cacheEntry{key: dirEntry.Name(), dir: entryDir, isDir: info.IsDir(), size: size}
+		if cid, err := os.ReadFile(filepath.Join(entryDir, cacheCIDName)); err == nil {
+			entry.cid = strings.TrimSpace(string(cid))
+		}
+		entry.elem = c.lru.PushBack(entry)
+		c.entries[entry.key] = entry
+		c.size += size
+	}
+
+	if len(c.entries) > 0 {
+		log.Printf("Input cache holds %d entries (%d bytes)", len(c.entries), c.size)
+	}
+	return nil
+}
+
+// Acquire returns the cached input for key, calling fetch to download it into
+// the cache on a miss and recording cid as its CID. Concurrent requests for
+// the same key share one download.
+func (c *inputCache) Acquire(ctx context.Context, key, cid string, fetch func(dest func(isDir bool) string) error) (*CachedInput, error) {
+	for {
+		c.mu.Lock()
+		if entry, ok := c.entries[key]; ok {
+			entry.refs++
+			c.lru.MoveToFront(entry.elem)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return c.handle(entry), nil
+		}
+
+		// Wait for another job downloading the same input, then look again
+		if done, ok := c.fetching[key]; ok {
+			c.mu.Unlock()
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		done := make(chan struct{})
+		c.fetching[key] = done
+		c.stats.Misses++
+		c.mu.Unlock()
+
+		entry, err := c.download(key, cid, fetch)
+
+		c.mu.Lock()
+		delete(c.fetching, key)
+		close(done)
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		entry.refs = 1
+		entry.elem = c.lru.PushFront(entry)
+		c.entries[key] = entry
+		c.size += entry.size
+		c.mu.Unlock()
+
+		c.evict()
+		return c.handle(entry), nil
+	}
+}
+
+// download fetches an input into a temporary directory and moves it into place
+func (c *inputCache) download(key, cid string, fetch func(dest func(isDir bool) string) error) (*cacheEntry, error) {
+	tempDir, err := os.MkdirTemp(c.dir, cacheTempPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create input cache entry: %w", err)
+	}
+
+	var isDir bool
+	err = fetch(func(dir bool) string {
+		isDir = dir
+		return filepath.Join(tempDir, cacheContentName)
+	})
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(tempDir, cacheCIDName), []byte(cid+"\n"), 0644); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("failed to record input cache entry CID: %w", err)
+	}
+
+	// MkdirTemp creates the directory 0700; the job's non-root user must read it
+	if err := os.Chmod(tempDir, 0755); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("failed to set input cache entry permissions: %w", err)
+	}
+	size, err := diskUsage(tempDir)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+
+	entryDir := filepath.Join(c.dir, key)
+	os.RemoveAll(entryDir)
+	if err := os.Rename(tempDir, entryDir); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("failed to store input cache entry: %w", err)
+	}
+
+	return &cacheEntry{key: key, cid: cid, dir: entryDir, isDir: isDir, size: size}, nil
+}
+
+// handle wraps an entry the caller holds a reference to
+func (c *inputCache) handle(entry *cacheEntry) *CachedInput {
+	return &CachedInput{
+		Path:  filepath.Join(entry.dir, cacheContentName),
+		IsDir: entry.isDir,
+		cache: c,
+		entry: entry,
+	}
+}
+
+// release drops a reference to an entry and evicts entries if over the limit
+func (c *inputCache) release(entry *cacheEntry) {
+	c.mu.Lock()
+	entry.refs--
+	c.mu.Unlock()
+
+	c.evict()
+}
+
+// evict removes unreferenced entries, least recently used first, until the
+// cache fits its size limit
+func (c *inputCache) evict() {
+	c.mu.Lock()
+	var evicted []*cacheEntry
+	for elem := c.lru.Back(); elem != nil && c.size > c.maxBytes; {
+		entry := elem.Value.(*cacheEntry)
+		prev := elem.Prev()
+		if entry.refs == 0 {
+			c.lru.Remove(elem)
+			delete(c.entries, entry.key)
+			c.size -= entry.size
+			c.stats.Evictions++
+			evicted = append(evicted, entry)
+		}
+		elem = prev
+	}
+	c.mu.Unlock()
+
+	// Remove from disk outside the lock; the entries are no longer reachable
+	for _, entry := range evicted {
+		log.Printf("Evicting input %s from the cache (%d bytes)", entry.key, entry.size)
+		if err := os.RemoveAll(entry.dir); err != nil {
+			log.Printf("Warning: failed to remove cached input: %v", err)
+		}
+	}
+}
+
+// Stats returns the cache's counters
+func (c *inputCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.SizeBytes = c.size
+	stats.MaxBytes = c.maxBytes
+	return stats
+}
+
+// CIDs returns the CIDs of the cached inputs, most recently used first
+func (c *inputCache) CIDs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cids := make([]string, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		if entry := elem.Value.(*cacheEntry); entry.cid != "" {
+			cids = append(cids, entry.cid)
+		}
+	}
+	return cids
+}
+
+// diskUsage sums the sizes of the regular files under dir
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %w", dir, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fetchContent returns a fetch function writing content as a single file
+func fetchContent(content string) func(dest func(isDir bool) string) error {
+	return func(dest func(isDir bool) string) error {
+		return os.WriteFile(dest(false), []byte(content), 0644)
+	}
+}
+
+// cachedKeys returns the keys of the cache's entries, most recently used first
+func cachedKeys(c *inputCache) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*cacheEntry).key)
+	}
+	return keys
+}
+
+func TestInputCacheEviction(t *testing.T) {
+	tests := []struct {
+		name          string
+		pinned        []string // inputs still held by a job
+		wantKeys      []string
+		wantEvictions uint64
+	}{
+		{name: "least recently used first", wantKeys: []string{"c", "b"}, wantEvictions: 1},
+		{name: "pinned input kept", pinned: []string{"a"}, wantKeys: []string{"c", "a"}, wantEvictions: 1},
+		{name: "over the limit while all are pinned", pinned: []string{"a", "b", "c"}, wantKeys: []string{"c", "b", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The cache holds two inputs: each takes 10 bytes with its CID file
+			cache, err := newInputCache(t.TempDir(), 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := []string{"a", "b", "c"}
+			held := map[string]*CachedInput{}
+			for _, key := range keys {
+				input, err := cache.Acquire(context.Background(), key, "cid-"+key, fetchContent("data"))
+				if err != nil {
+					t.Fatalf("Acquire(%s) failed: %v", key, err)
+				}
+				held[key] = input
+			}
+			for _, key := range keys {
+				if !slices.Contains(tt.pinned, key) {
+					held[key].Release()
+				}
+			}
+
+			if got := cachedKeys(cache); !slices.Equal(got, tt.wantKeys) {
+				t.Errorf("cached inputs = %v, want %v", got, tt.wantKeys)
+			}
+			if got := cache.Stats().Evictions; got != tt.wantEvictions {
+				t.Errorf("evictions = %d, want %d", got, tt.wantEvictions)
+			}
+			for _, key := range tt.pinned {
+				if _, err := os.Stat(held[key].Path); err != nil {
+					t.Errorf("pinned input %s was removed: %v", key, err)
+				}
+			}
+
+			// Once released, the pinned inputs are evicted down to the limit
+			for _, key := range tt.pinned {
+				held[key].Release()
+			}
+			if stats := cache.Stats(); stats.SizeBytes > stats.MaxBytes {
+				t.Errorf("cache holds %d bytes after release, over its %d byte limit", stats.SizeBytes, stats.MaxBytes)
+			}
+		})
+	}
+}
+
+func TestInputCacheAcquireSharesDownload(t *testing.T) {
+	cache, err := newInputCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const jobs = 8
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func(dest func(isDir bool) string) error {
+		fetches.Add(1)
+		<-release
+		return fetchContent("data")(dest)
+	}
+
+	var wg sync.WaitGroup
+	paths := make([]string, jobs)
+	for i := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			input, err := cache.Acquire(context.Background(), "a", "cid-a", fetch)
+			if err != nil {
+				t.Errorf("Acquire failed: %v", err)
+				return
+			}
+			defer input.Release()
+			paths[i] = input.Path
+		}()
+	}
+
+	// Let the other jobs start waiting for the first one's download
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("input fetched %d times, want once", n)
+	}
+	for _, path := range paths[1:] {
+		if path != paths[0] {
+			t.Errorf("jobs got different paths %s and %s", paths[0], path)
+		}
+	}
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Hits != jobs-1 {
+		t.Errorf("%d hit(s) and %d miss(es), want %d and 1", stats.Hits, stats.Misses, jobs-1)
+	}
+}
+
+func TestInputCacheFailedFetchIsNotCached(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newInputCache(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errFetch := errors.New("gateway unavailable")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	failing := func(dest func(isDir bool) string) error {
+		os.WriteFile(dest(false), []byte("partial"), 0644)
+		close(started)
+		<-release
+		return errFetch
+	}
+
+	// A job waiting on the failing download fetches the input itself
+	failed := make(chan error)
+	go func() {
+		_, err := cache.Acquire(context.Background(), "a", "cid-a", failing)
+		failed <- err
+	}()
+	<-started
+	waiting := make(chan *CachedInput)
+	go func() {
+		input, err := cache.Acquire(context.Background(), "a", "cid-a", fetchContent("data"))
+		if err != nil {
+			t.Errorf("Acquire after a failed download failed: %v", err)
+		}
+		waiting <- input
+	}()
+
+	close(release)
+	if err := receive(t, failed); !errors.Is(err, errFetch) {
+		t.Fatalf("Acquire error = %v, want the fetch error", err)
+	}
+	input := receive(t, waiting)
+	if input == nil {
+		t.FailNow()
+	}
+	defer input.Release()
+
+	content, err := os.ReadFile(input.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "data" {
+		t.Errorf("cached content = %q, want %q", content, "data")
+	}
+	if stats := cache.Stats(); stats.Misses != 2 || stats.Entries != 1 {
+		t.Errorf("%d miss(es) and %d entries, want 2 and 1", stats.Misses, stats.Entries)
+	}
+
+	// Nothing of the failed download is left behind
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirEntries) != 1 || filepath.Join(dir, dirEntries[0].Name()) != filepath.Dir(input.Path) {
+		t.Errorf("cache directory holds %v, want only the cached input", dirEntries)
+	}
+}
+
+// receive waits for a value from ch, failing the test if none arrives
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a value")
+		var zero T
+		return zero
+	}
+}
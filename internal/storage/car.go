@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// carMediaType is the Content-Type of a CAR stream
+const carMediaType = "application/vnd.ipld.car"
+
+// maxCARSectionSize bounds a single CAR header or block. IPFS limits blocks
+// to 2 MiB in practice, so anything far larger is a malformed stream.
+const maxCARSectionSize = 8 * 1024 * 1024
+
+// blockStore keeps verified blocks on disk so large inputs are not held in
+// memory. The blocks it holds may total at most maxBytes; 0 means no limit.
+type blockStore struct {
+	dir      string
+	maxBytes int64
+	size     int64
+}
+
+// newBlockStore creates an empty block store in a temporary directory
+func newBlockStore(maxBytes int64) (*blockStore, error) {
+	dir, err := os.MkdirTemp("", "lamda_blocks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create block store: %w", err)
+	}
+	return &blockStore{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// Put stores a block that has already been checked against its CID. A block
+// that is already stored is not stored or counted again.
+func (b *blockStore) Put(c cid, data []byte) error {
+	path := filepath.Join(b.dir, c.String())
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if b.maxBytes > 0 && int64(len(data)) > b.maxBytes-b.size {
+		return tooLarge(b.maxBytes)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to store block: %w", err)
+	}
+	b.size += int64(len(data))
+	return nil
+}
+
+// Get returns a block. Identity CIDs carry their data inline.
+func (b *blockStore) Get(c cid) ([]byte, error) {
+	if c.hashCode == hashIdentity {
+		return c.digest, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(b.dir, c.String()))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: block %s is missing from the CAR", ErrIntegrity, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block: %w", err)
+	}
+	return data, nil
+}
+
+// Close deletes the stored blocks
+func (b *blockStore) Close() {
+	os.RemoveAll(b.dir)
+}
+
+// carLimit is the most CAR bytes accepted for a DAG that unpacks to at most
+// maxBytes. On top of the file data, blocks carry CIDs, UnixFS framing and
+// directory entries, which the allowance covers. 0 means no limit.
+func carLimit(maxBytes int64) int64 {
+	if maxBytes <= 0 {
+		return 0
+	}
+	return maxBytes + maxBytes/64 + 16*1024*1024
+}
+
+// readCAR reads a CARv1 stream into the block store, checking every block
+// against its CID so a faulty gateway cannot substitute content
+func readCAR(r io.Reader, store *blockStore) error {
+	return (&carReader{store: store}).read(r)
+}
+
+// carReader reads a CARv1 stream into a block store. It counts the bytes of
+// the complete sections read, so an interrupted stream can be continued from
+// the next section. The header is skipped: the agent already knows the root
+// it asked for, and walking from it fails if the CAR does not contain it.
+type carReader struct {
+	store         *blockStore
+	offset        int64 // bytes of complete sections read
+	deterministic bool  // the last response's block order is the same on every request
+}
+
+// read continues reading the stream at offset; r must start there
+func (c *carReader) read(r io.Reader) error {
+	reader := bufio.NewReader(r)
+
+	if c.offset == 0 {
+		_, n, err := readCARSection(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read CAR header: %w", err)
+		}
+		c.offset += n
+	}
+
+	for {
+		section, n, err := readCARSection(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read CAR block: %w", err)
+		}
+
+		sectionReader := bytes.NewReader(section)
+		blockCID, err := readCID(sectionReader)
+		if err != nil {
+			return err
+		}
+		data := section[len(section)-sectionReader.Len():]
+
+		if err := blockCID.verify(data); err != nil {
+			return fmt.Errorf("block %s: %w", blockCID, err)
+		}
+		if err := c.store.Put(blockCID, data); err != nil {
+			return err
+		}
+		c.offset += n
+	}
+}
+
+func (c *carReader) kept() int64 { return c.offset }
+
+// resumable is true only for a CAR the gateway says is in depth-first order
+// with duplicate blocks included, which IPIP-412 makes the same on every
+// request. Gateways may order other CARs differently every time, so those
+// start over after an interruption; blocks already read stay in the store.
+func (c *carReader) resumable() bool { return c.deterministic }
+
+func (c *carReader) reset() error {
+	c.offset = 0
+	return nil
+}
+
+func (c *carReader) consume(resp *http.Response, body io.Reader) error {
+	c.deterministic = isDeterministicCAR(resp.Header.Get("Content-Type"))
+	if c.offset > 0 && !c.deterministic {
+		// The rest of the stream may not line up with what was read
+		c.reset()
+		return errors.New("cannot resume CAR download: the gateway no longer declares a deterministic block order")
+	}
+	return c.read(body)
+}
+
+// isDeterministicCAR reports whether a CAR's Content-Type declares
+// depth-first block order with duplicates included
+func isDeterministicCAR(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == carMediaType && params["order"] == "dfs" && params["dups"] == "y"
+}
+
+// readCARSection reads one varint length-prefixed section of a CAR and
+// returns it with the number of bytes it took up in the stream. It returns
+// io.EOF only at a clean end of the stream.
+func readCARSection(r *bufio.Reader) ([]byte, int64, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if length == 0 || length > maxCARSectionSize {
+		return nil, 0, fmt.Errorf("invalid section length %d", length)
+	}
+
+	section := make([]byte, length)
+	if _, err := io.ReadFull(r, section); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, 0, fmt.Errorf("truncated section: %w", io.ErrUnexpectedEOF)
+		}
+		return nil, 0, err
+	}
+	return section, int64(binary.PutUvarint(make([]byte, binary.MaxVarintLen64), length)) + int64(length), nil
+}
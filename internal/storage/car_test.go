@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReadCARRejectsTamperedFixtures(t *testing.T) {
+	tests := []struct {
+		name   string
+		car    string
+		root   string
+		tamper func(sections [][]byte) [][]byte
+	}{
+		{
+			name:   "corrupted leaf",
+			car:    "chunked_v1.car",
+			root:   "bafybeiaivyeesn3f5mhz52xshlpvkj7e5sqsfjrwi3t3fu6hzgjvqvaume",
+			tamper: corruptSection(3),
+		},
+		{
+			name:   "corrupted root",
+			car:    "dir_v0.car",
+			root:   "QmX8E8fzhagdikyyzkhJnn4auSdWKQ4ozainXGc8jJ9VtY",
+			tamper: corruptSection(1),
+		},
+		{
+			name:   "missing leaf",
+			car:    "chunked_v0.car",
+			root:   "QmUVgV3NNFzrvVUdbZphPbRnHM4YetoTe3jPoCYBZga27J",
+			tamper: dropSection(4),
+		},
+		{
+			name:   "missing root",
+			car:    "dir_v1.car",
+			root:   "bafybeichyt4ac6fdhxtwq7uu5omz6a7yavhjmsnllksds4ndye5iq5lwea",
+			tamper: dropSection(1),
+		},
+		{
+			name:   "missing shard entry",
+			car:    "hamt_v1.car",
+			root:   "bafybeicmn6jbnvgzqwuanqg26ckysdnoxih4a2hfa7zpjsiyjrs2ppuflm",
+			tamper: func(sections [][]byte) [][]byte { return sections[:len(sections)-1] },
+		},
+		{
+			name:   "CAR of another root",
+			car:    "file_v1.car",
+			root:   "QmYcWdVFeczWfNqZ5vUhV4iFUdRzpTaW62Q5bdWhsjazHq",
+			tamper: func(sections [][]byte) [][]byte { return sections },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := parseCID(tt.root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			car := buildCAR(tt.tamper(carSections(t, readFixture(t, tt.car))))
+
+			_, err = unpackCAR(t, car, root, 0)
+			if !errors.Is(err, ErrIntegrity) {
+				t.Fatalf("error = %v, want ErrIntegrity", err)
+			}
+		})
+	}
+}
+
+func TestReadCARTruncated(t *testing.T) {
+	car := readFixture(t, "chunked_v1.car")
+	store, err := newBlockStore(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	err = readCAR(bytes.NewReader(car[:len(car)-10]), store)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestReadCARStopsAtLimit(t *testing.T) {
+	car := readFixture(t, "chunked_v1.car")
+	tests := []struct {
+		name    string
+		limit   int64
+		wantErr error
+	}{
+		{name: "at the limit", limit: int64(len(car))},
+		{name: "over the limit", limit: int64(len(car)) - 1, wantErr: errTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := newBlockStore(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			err = readCAR(&cappedReader{r: bytes.NewReader(car), remaining: tt.limit, limit: tt.limit}, store)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && isRetryable(err) {
+				t.Error("an oversized CAR is reported as retryable")
+			}
+		})
+	}
+}
+
+func TestBlockStoreLimitsSize(t *testing.T) {
+	var car testCAR
+	first, err := readCID(bytes.NewReader(car.add(codecRaw, []byte("first block"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := readCID(bytes.NewReader(car.add(codecRaw, []byte("second block"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newBlockStore(int64(len("first block")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// A block stored twice counts once
+	for range 2 {
+		if err := store.Put(first, []byte("first block")); err != nil {
+			t.Fatalf("Put(first) failed: %v", err)
+		}
+	}
+	if err := store.Put(second, []byte("second block")); !errors.Is(err, errTooLarge) {
+		t.Fatalf("Put(second) error = %v, want errTooLarge", err)
+	}
+	if _, err := store.Get(second); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Get(second) error = %v, want the refused block to be missing", err)
+	}
+}
+
+// readFixture reads a file from testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// carSections splits a CAR into its header and block sections
+func carSections(t *testing.T, car []byte) [][]byte {
+	t.Helper()
+	reader := bufio.NewReader(bytes.NewReader(car))
+	var sections [][]byte
+	for {
+		section, _, err := readCARSection(reader)
+		if err == io.EOF {
+			return sections
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections = append(sections, section)
+	}
+}
+
+// buildCAR joins sections into a CAR
+func buildCAR(sections [][]byte) []byte {
+	var car []byte
+	for _, section := range sections {
+		car = binary.AppendUvarint(car, uint64(len(section)))
+		car = append(car, section...)
+	}
+	return car
+}
+
+// corruptSection flips the last byte of the i'th section, which is block data
+func corruptSection(i int) func([][]byte) [][]byte {
+	return func(sections [][]byte) [][]byte {
+		sections[i] = bytes.Clone(sections[i])
+		sections[i][len(sections[i])-1] ^= 0xff
+		return sections
+	}
+}
+
+// dropSection removes the i'th section
+func dropSection(i int) func([][]byte) [][]byte {
+	return func(sections [][]byte) [][]byte {
+		return slices.Delete(sections, i, i+1)
+	}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+)
+
+// Multicodec codes for the IPLD codecs and hash functions the agent handles
+const (
+	codecRaw     = 0x55
+	codecDagPB   = 0x70
+	hashSHA256   = 0x12
+	hashSHA512   = 0x13
+	hashIdentity = 0x00
+)
+
+// cid is a parsed IPFS content identifier
+type cid struct {
+	codec     uint64
+	multihash []byte // hash code, digest length and digest
+	hashCode  uint64
+	digest    []byte
+}
+
+// String returns the multihash in hex, which identifies a block's content
+// regardless of the CID version or codec it was referenced with
+func (c cid) String() string {
+	return fmt.Sprintf("%x", c.multihash)
+}
+
+// parseCID parses a CIDv0 ("Qm...") or a base32 CIDv1 ("bafy...")
+func parseCID(s string) (cid, error) {
+	if len(s) == 46 && strings.HasPrefix(s, "Qm") {
+		raw, err := decodeBase58(s)
+		if err != nil {
+			return cid{}, fmt.Errorf("invalid CID %s: %w", s, err)
+		}
+		return readCID(bytes.NewReader(raw))
+	}
+
+	if !strings.HasPrefix(s, "b") {
+		return cid{}, fmt.Errorf("unsupported CID encoding: %s", s)
+	}
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s[1:]))
+	if err != nil {
+		return cid{}, fmt.Errorf("invalid CID %s: %w", s, err)
+	}
+	return readCID(bytes.NewReader(raw))
+}
+
+// readCID reads a binary CID, as found in CAR sections and dag-pb links
+func readCID(r io.ByteReader) (cid, error) {
+	first, err := binary.ReadUvarint(r)
+	if err != nil {
+		return cid{}, fmt.Errorf("failed to read CID: %w", err)
+	}
+
+	// A CIDv0 is a bare sha2-256 multihash of a dag-pb block
+	if first == hashSHA256 {
+		mh, code, digest, err := readMultihash(r, first)
+		if err != nil {
+			return cid{}, err
+		}
+		return cid{codec: codecDagPB, multihash: mh, hashCode: code, digest: digest}, nil
+	}
+
+	if first != 1 {
+		return cid{}, fmt.Errorf("unsupported CID version %d", first)
+	}
+	codec, err := binary.ReadUvarint(r)
+	if err != nil {
+		return cid{}, fmt.Errorf("failed to read CID codec: %w", err)
+	}
+	hashCode, err := binary.ReadUvarint(r)
+	if err != nil {
+		return cid{}, fmt.Errorf("failed to read CID hash: %w", err)
+	}
+	mh, code, digest, err := readMultihash(r, hashCode)
+	if err != nil {
+		return cid{}, err
+	}
+	return cid{codec: codec, multihash: mh, hashCode: code, digest: digest}, nil
+}
+
+// readMultihash reads the digest of a multihash whose code has already been read
+func readMultihash(r io.ByteReader, code uint64) ([]byte, uint64, []byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to read multihash length: %w", err)
+	}
+	if length > 128 {
+		return nil, 0, nil, fmt.Errorf("multihash digest of %d bytes is too long", length)
+	}
+
+	digest := make([]byte, length)
+	for i := range digest {
+		if digest[i], err = r.ReadByte(); err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to read multihash digest: %w", err)
+		}
+	}
+
+	mh := binary.AppendUvarint(nil, code)
+	mh = binary.AppendUvarint(mh, length)
+	mh = append(mh, digest...)
+	return mh, code, digest, nil
+}
+
+// verify checks that data hashes to the CID's digest
+func (c cid) verify(data []byte) error {
+	var sum []byte
+	switch c.hashCode {
+	case hashSHA256:
+		digest := sha256.Sum256(data)
+		sum = digest[:]
+	case hashSHA512:
+		digest := sha512.Sum512(data)
+		sum = digest[:]
+	case hashIdentity:
+		sum = data
+	default:
+		return fmt.Errorf("unsupported multihash code 0x%x", c.hashCode)
+	}
+
+	if !bytes.Equal(sum, c.digest) {
+		return fmt.Errorf("%w: block does not match its CID", ErrIntegrity)
+	}
+	return nil
+}
+
+// base58Alphabet is the Bitcoin alphabet used by CIDv0
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// decodeBase58 decodes a base58btc string
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, r := range s {
+		index := strings.IndexRune(base58Alphabet, r)
+		if index < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(index)))
+	}
+
+	// Leading '1's encode leading zero bytes
+	leadingZeros := len(s) - len(strings.TrimLeft(s, "1"))
+	return append(make([]byte, leadingZeros), n.Bytes()...), nil
+}
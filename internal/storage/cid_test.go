@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestParseCID(t *testing.T) {
+	tests := []struct {
+		name      string
+		cid       string
+		wantCodec uint64
+		wantErr   bool
+	}{
+		{name: "CIDv0", cid: "QmYcWdVFeczWfNqZ5vUhV4iFUdRzpTaW62Q5bdWhsjazHq", wantCodec: codecDagPB},
+		{name: "CIDv1 raw", cid: "bafkreigmpufwazzzslye2nddwsajihpqukc3szfqcsvkmtdarxkz63vhcm", wantCodec: codecRaw},
+		{name: "CIDv1 dag-pb", cid: "bafybeichyt4ac6fdhxtwq7uu5omz6a7yavhjmsnllksds4ndye5iq5lwea", wantCodec: codecDagPB},
+		{name: "CIDv0 with a character outside base58", cid: "QmYcWdVFeczWfNqZ5vUhV4iFUdRzpTaW62Q5bdWhsjaz0l", wantErr: true},
+		{name: "base58 CIDv1", cid: "zb2rhe5P4gXftAwvA4eXQ5HJwsER2owDyS9sKaQRRVQPn93bA", wantErr: true},
+		{name: "truncated CIDv1", cid: "bafybeichyt4ac6fdhxtwq7uu5omz6a7", wantErr: true},
+		{name: "empty", cid: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCID(tt.cid)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.codec != tt.wantCodec || c.hashCode != hashSHA256 || len(c.digest) != sha256.Size {
+				t.Errorf("parseCID = codec 0x%x, hash 0x%x, %d byte digest", c.codec, c.hashCode, len(c.digest))
+			}
+		})
+	}
+}
+
+func TestCIDVerify(t *testing.T) {
+	// The raw CIDv1 of file_v1.car addresses the file's bytes directly
+	c, err := parseCID("bafkreigmpufwazzzslye2nddwsajihpqukc3szfqcsvkmtdarxkz63vhcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verify([]byte(helloContent)); err != nil {
+		t.Errorf("verify of the right content failed: %v", err)
+	}
+	if err := c.verify([]byte("Hello from someone else\n")); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("verify of the wrong content: error = %v, want ErrIntegrity", err)
+	}
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gatewayBackend fetches IPFS content from HTTP gateways and uploads it
+// through a Pinata-compatible pinFileToIPFS API
+type gatewayBackend struct {
+	client      *http.Client
+	gatewayURLs []string
+	pinningURL  string
+	pinningJWT  string
+	retry       RetryPolicy
+	maxBytes    int64 // unpacked size limit of a fetched DAG; 0 means none
+}
+
+// PinataResponse represents the response from Pinata API
+type PinataResponse struct {
+	IpfsHash  string `json:"IpfsHash"`
+	PinSize   int    `json:"PinSize"`
+	Timestamp string `json:"Timestamp"`
+}
+
+// newGatewayBackend creates a gateway backend. Downloads try gatewayURLs in
+// order, retrying each according to retry before failing over to the next.
+// Fetched DAGs may unpack to at most maxBytes; 0 means no limit.
+func newGatewayBackend(client *http.Client, gatewayURLs []string, pinningURL, pinningJWT string, retry RetryPolicy, maxBytes int64) (*gatewayBackend, error) {
+	if pinningJWT == "" {
+		return nil, errors.New("PINATA_JWT is required for the gateway storage backend")
+	}
+
+	var urls []string
+	for _, gatewayURL := range gatewayURLs {
+		if gatewayURL = strings.TrimSuffix(strings.TrimSpace(gatewayURL), "/"); gatewayURL != "" {
+			urls = append(urls, gatewayURL)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("IPFS_GATEWAY_URLS must list at least one gateway")
+	}
+
+	return &gatewayBackend{
+		client:      client,
+		gatewayURLs: urls,
+		pinningURL:  pinningURL,
+		pinningJWT:  pinningJWT,
+		retry:       retry,
+		maxBytes:    maxBytes,
+	}, nil
+}
+
+// Fetch downloads a CID as a CAR, checks every block against its CID and
+// writes the UnixFS file or directory tree. Each gateway is tried in turn,
+// and the error returned joins every gateway's failure.
+func (g *gatewayBackend) Fetch(ctx context.Context, ref *url.URL, dest func(isDir bool) string) error {
+	root, err := ipfsRoot(ref)
+	if err != nil {
+		return err
+	}
+
+	failures := make([]error, len(g.gatewayURLs))
+	allNotFound := true
+	for i, gatewayURL := range g.gatewayURLs {
+		err := g.fetchFrom(ctx, gatewayURL, ref.Host, root, dest)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("Failed to download %s from gateway %s: %v", ref.Host, gatewayURL, err)
+		failures[i] = err
+		allNotFound = allNotFound && errors.Is(err, ErrNotFound)
+	}
+
+	// Content is only reported missing when no gateway had it; one that
+	// failed transiently might have served it
+	errs := make([]error, len(failures))
+	for i, err := range failures {
+		if errors.Is(err, ErrNotFound) && !allNotFound {
+			errs[i] = fmt.Errorf("%s: %v", g.gatewayURLs[i], err)
+		} else {
+			errs[i] = fmt.Errorf("%s: %w", g.gatewayURLs[i], err)
+		}
+	}
+	return fmt.Errorf("failed to download %s from IPFS: %w", ref.Host, errors.Join(errs...))
+}
+
+// fetchFrom streams the CAR from one gateway into a block store, checking
+// every block as it arrives, then unpacks it
+func (g *gatewayBackend) fetchFrom(ctx context.Context, gatewayURL, cidStr string, root cid, dest func(isDir bool) string) error {
+	limit := carLimit(g.maxBytes)
+	store, err := newBlockStore(limit)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// Request a verifiable CAR of the whole DAG, in an order that lets an
+	// interrupted download resume where the gateway supports it
+	carURL := fmt.Sprintf("%s/ipfs/%s?format=car", gatewayURL, cidStr)
+	header := http.Header{"Accept": {carMediaType + "; order=dfs; dups=y"}}
+	if err := g.retry.download(ctx, g.client, getRequest(carURL, header), &carReader{store: store}, false, limit, redactURL(carURL)); err != nil {
+		return err
+	}
+	return unpackDAG(store, root, dest, g.maxBytes)
+}
+
+// Store uploads a directory to the pinning service in a single streamed
+// request and returns its CID
+func (g *gatewayBackend) Store(ctx context.Context, u upload) (string, error) {
+	if u.dest != nil {
+		return "", fmt.Errorf("IPFS uploads are content-addressed and cannot be sent to %s", u.dest)
+	}
+
+	progress := progressFrom(ctx)
+	body, contentType := streamMultipart(func(writer *multipart.Writer) error {
+		for _, file := range u.files {
+			if file.isDir {
+				continue
+			}
+			part, err := writer.CreateFormFile("file", u.name+"/"+file.name)
+			if err != nil {
+				return fmt.Errorf("failed to create form file: %w", err)
+			}
+			if err := copyFileToPart(part, file.path, progress); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer body.Close()
+
+	// Create HTTP request to the pinning API
+	req, err := http.NewRequestWithContext(ctx, "POST", g.pinningURL, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("Authorization", "Bearer "+g.pinningJWT)
+	req.Header.Set("Content-Type", contentType)
+
+	// Make the request
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload to Pinata: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check if the request was successful
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to upload to Pinata: HTTP %d - %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	// Parse the response
+	var pinataResp PinataResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pinataResp); err != nil {
+		return "", fmt.Errorf("failed to parse Pinata response: %w", err)
+	}
+
+	return pinataResp.IpfsHash, nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRetry retries quickly so tests of failures do not wait
+var testRetry = RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+// carGateway serves CARs by CID the way a trustless gateway does
+func carGateway(t *testing.T, cars map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Accept"), "application/vnd.ipld.car") || r.URL.Query().Get("format") != "car" {
+			t.Errorf("request for %s does not ask for a CAR", r.URL)
+		}
+		car, ok := cars[strings.TrimPrefix(r.URL.Path, "/ipfs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+		w.Write(car)
+	}))
+}
+
+func TestGatewayBackendFetch(t *testing.T) {
+	const root = "QmX8E8fzhagdikyyzkhJnn4auSdWKQ4ozainXGc8jJ9VtY"
+
+	// The first gateway does not have the content, the second does
+	empty := carGateway(t, nil)
+	defer empty.Close()
+	full := carGateway(t, map[string][]byte{root: readFixture(t, "dir_v0.car")})
+	defer full.Close()
+
+	backend, err := newGatewayBackend(full.Client(), []string{empty.URL, full.URL + "/"}, "", "jwt", testRetry, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "input")
+	if err := backend.Fetch(context.Background(), &url.URL{Scheme: "ipfs", Host: root}, func(bool) string { return dest }); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	assertTree(t, dest, fixtureDir())
+
+	// Content no gateway has is reported as not found
+	missing := &url.URL{Scheme: "ipfs", Host: "bafkreigmpufwazzzslye2nddwsajihpqukc3szfqcsvkmtdarxkz63vhcm"}
+	if err := backend.Fetch(context.Background(), missing, func(bool) string { return dest }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch of missing content: error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestGatewayBackendRetriesInterruptedCAR(t *testing.T) {
+	const root = "bafybeiaivyeesn3f5mhz52xshlpvkj7e5sqsfjrwi3t3fu6hzgjvqvaume"
+	car := readFixture(t, "chunked_v1.car")
+
+	// The CAR is cut after its header and the first two blocks
+	sections := carSections(t, car)
+	complete := len(buildCAR(sections[:3]))
+	cut := complete + 10
+
+	// Without a declared order, the second response may order the blocks
+	// differently, so appending its tail to the first response's head would
+	// corrupt the CAR
+	slices.Reverse(sections[1:])
+	reordered := buildCAR(sections)
+
+	tests := []struct {
+		name        string
+		contentType string
+		second      []byte
+		wantRange   string
+	}{
+		{name: "restarted", contentType: "application/vnd.ipld.car; version=1", second: reordered},
+		{name: "resumed", contentType: "application/vnd.ipld.car; version=1; order=dfs; dups=y", second: car, wantRange: fmt.Sprintf("bytes=%d-", complete)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				w.Header().Set("Content-Type", tt.contentType)
+				if len(ranges) == 1 {
+					w.Header().Set("Content-Length", strconv.Itoa(len(car)))
+					w.Write(car[:cut])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(tt.second))
+			}))
+			defer server.Close()
+
+			backend, err := newGatewayBackend(server.Client(), []string{server.URL}, "", "jwt", testRetry, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(t.TempDir(), "input")
+			if err := backend.Fetch(context.Background(), &url.URL{Scheme: "ipfs", Host: root}, func(bool) string { return dest }); err != nil {
+				t.Fatalf("Fetch failed: %v", err)
+			}
+			if want := []string{"", tt.wantRange}; !slices.Equal(ranges, want) {
+				t.Errorf("Range headers = %q, want %q", ranges, want)
+			}
+			assertTree(t, dest, map[string]string{"": string(randomBytes(10000, 1))})
+		})
+	}
+}
+
+func TestGatewayBackendRefusesOversizedCAR(t *testing.T) {
+	const root = "bafybeiaivyeesn3f5mhz52xshlpvkj7e5sqsfjrwi3t3fu6hzgjvqvaume"
+
+	// The gateway declares a CAR larger than any input of 1 MiB can need
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", strconv.FormatInt(carLimit(1024*1024)+1, 10))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	backend, err := newGatewayBackend(server.Client(), []string{server.URL}, "", "jwt", testRetry, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "input")
+	err = backend.Fetch(context.Background(), &url.URL{Scheme: "ipfs", Host: root}, func(bool) string { return dest })
+	if !errors.Is(err, errTooLarge) {
+		t.Fatalf("Fetch error = %v, want errTooLarge", err)
+	}
+	if requests != 1 {
+		t.Errorf("gateway received %d requests, want 1", requests)
+	}
+}
+
+func TestGatewayBackendStore(t *testing.T) {
+	var files []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/pinning/pinFileToIPFS" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret-jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Fatalf("request is not multipart: %v", err)
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(part)
+			files = append(files, params["name"]+" "+params["filename"]+": "+string(content))
+		}
+
+		json.NewEncoder(w).Encode(PinataResponse{IpfsHash: "QmPinnedRoot", PinSize: 3})
+	}))
+	defer server.Close()
+
+	dir := writeTestTree(t, map[string]string{"a.txt": "a", "sub/b.txt": "bb"})
+	backend, err := newGatewayBackend(server.Client(), []string{server.URL}, server.URL+"/pinning/pinFileToIPFS", "secret-jwt", testRetry, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid, err := backend.Store(context.Background(), testUpload(t, "job-1", "logs", dir))
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if cid != "QmPinnedRoot" {
+		t.Errorf("Store returned %q, want QmPinnedRoot", cid)
+	}
+
+	// Files are sent under one directory named after the upload
+	sort.Strings(files)
+	want := []string{"file logs/a.txt: a", "file logs/sub/b.txt: bb"}
+	if strings.Join(files, "\n") != strings.Join(want, "\n") {
+		t.Errorf("files = %q, want %q", files, want)
+	}
+
+	// A rejected token is an error
+	backend.pinningJWT = "wrong"
+	if _, err := backend.Store(context.Background(), testUpload(t, "job-1", "logs", dir)); err == nil {
+		t.Error("Store with a rejected token succeeded")
+	}
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// httpBackend downloads single files from https:// URLs. It cannot store.
+type httpBackend struct {
+	client   *http.Client
+	retry    RetryPolicy
+	maxBytes int64 // size limit of a downloaded file; 0 means none
+}
+
+// newHTTPBackend creates a download-only HTTP backend. Job URLs are
+// untrusted, so client should be one from newPublicHTTPClient. Downloads may
+// be at most maxBytes long; 0 means no limit.
+func newHTTPBackend(client *http.Client, retry RetryPolicy, maxBytes int64) *httpBackend {
+	return &httpBackend{client: client, retry: retry, maxBytes: maxBytes}
+}
+
+// checkRef accepts https:// URLs that do not name a non-public IP address.
+// Host names are checked when they are resolved.
+func (h *httpBackend) checkRef(ref *url.URL) error {
+	if ref.Scheme != "https" {
+		return fmt.Errorf("only https:// URLs are allowed, got %s", ref.Redacted())
+	}
+	if ref.Hostname() == "" {
+		return fmt.Errorf("URL %s has no host", ref.Redacted())
+	}
+	if addr, err := netip.ParseAddr(ref.Hostname()); err == nil && !isPublicAddr(addr) {
+		return fmt.Errorf("URL %s names a non-public address", ref.Redacted())
+	}
+	return nil
+}
+
+// Fetch downloads the URL to a single file, resuming it after transient failures
+func (h *httpBackend) Fetch(ctx context.Context, ref *url.URL, dest func(isDir bool) string) error {
+	if err := h.checkRef(ref); err != nil {
+		return err
+	}
+
+	path := dest(false)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if _, err := h.retry.downloadFile(ctx, h.client, getRequest(ref.String(), nil), path, true, false, h.maxBytes, ref.Redacted()); err != nil {
+		return fmt.Errorf("failed to download %s: %w", ref.Redacted(), err)
+	}
+	return nil
+}
+
+// Store is not supported for HTTP URLs
+func (h *httpBackend) Store(ctx context.Context, u upload) (string, error) {
+	return "", errUploadUnsupported
+}
+
+// newPublicHTTPClient returns a client for URLs from jobs. It only connects to
+// public addresses, so jobs cannot reach the node's loopback interface, its
+// private networks or cloud metadata services, and it only follows redirects
+// to https:// URLs. Proxies are not used, as they would hide the destination.
+func newPublicHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublicOnly,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to non-https URL %s", req.URL.Redacted())
+			}
+			return nil
+		},
+	}
+}
+
+// dialPublicOnly refuses connections to non-public addresses. It runs after
+// name resolution, so names that resolve to private addresses are refused too.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("connection to non-public address %s refused", addrPort.Addr())
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, where some clouds run
+// their metadata services
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublicAddr reports whether addr is a globally routable unicast address
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() &&
+		!addr.IsPrivate() &&
+		!addr.IsLoopback() &&
+		!addr.IsLinkLocalUnicast() &&
+		!sharedAddressSpace.Contains(addr)
+}
+
+// writeFile writes r to path, creating its parent directories
+func writeFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("failed to copy data to local file: %w", err)
+	}
+	return nil
+}
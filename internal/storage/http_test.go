@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPBackendCheckRef(t *testing.T) {
+	backend := newHTTPBackend(newPublicHTTPClient(), RetryPolicy{}, 0)
+
+	tests := []struct {
+		ref     string
+		wantErr bool
+	}{
+		{ref: "https://example.com/data.bin"},
+		{ref: "https://93.184.216.34/data.bin"},
+		{ref: "https://[2606:2800:220:1:248:1893:25c8:1946]/data.bin"},
+		{ref: "http://example.com/data.bin", wantErr: true},
+		{ref: "https:///data.bin", wantErr: true},
+		{ref: "https://127.0.0.1/data.bin", wantErr: true},
+		{ref: "https://[::1]/data.bin", wantErr: true},
+		{ref: "https://169.254.169.254/latest/meta-data/", wantErr: true},
+		{ref: "https://[fe80::1]/data.bin", wantErr: true},
+		{ref: "https://10.0.0.1/data.bin", wantErr: true},
+		{ref: "https://172.16.5.4/data.bin", wantErr: true},
+		{ref: "https://192.168.1.1/data.bin", wantErr: true},
+		{ref: "https://[fd00::1]/data.bin", wantErr: true},
+		{ref: "https://100.100.100.200/latest/meta-data/", wantErr: true},
+		{ref: "https://[::ffff:127.0.0.1]/data.bin", wantErr: true},
+		{ref: "https://0.0.0.0/data.bin", wantErr: true},
+		{ref: "https://224.0.0.1/data.bin", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			u, err := url.Parse(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = backend.checkRef(u)
+			if tt.wantErr && err == nil {
+				t.Error("checkRef succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("checkRef failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestPublicHTTPClientRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached the local server: %s", r.URL)
+	}))
+	defer server.Close()
+
+	// Host names are checked once resolved, so "localhost" is refused too
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := *serverURL
+	byName.Host = "localhost:" + serverURL.Port()
+
+	client := newPublicHTTPClient()
+	for _, target := range []string{server.URL, byName.String()} {
+		resp, err := client.Get(target)
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("GET %s succeeded, want the connection refused", target)
+		} else if !strings.Contains(err.Error(), "non-public address") {
+			t.Errorf("GET %s: error = %v, want a non-public address error", target, err)
+		}
+	}
+}
+
+func TestPublicHTTPClientRedirects(t *testing.T) {
+	client := newPublicHTTPClient()
+	via := []*http.Request{httptest.NewRequest("GET", "https://example.com/a", nil)}
+
+	if err := client.CheckRedirect(httptest.NewRequest("GET", "https://example.org/b", nil), via); err != nil {
+		t.Errorf("redirect to https refused: %v", err)
+	}
+	if err := client.CheckRedirect(httptest.NewRequest("GET", "http://example.org/b", nil), via); err == nil {
+		t.Error("redirect to http allowed")
+	}
+}
+
+func TestHTTPBackendFetchRefusesPrivateAddress(t *testing.T) {
+	backend := newHTTPBackend(newPublicHTTPClient(), RetryPolicy{Attempts: 1}, 0)
+	u, err := url.Parse("https://192.168.0.10/data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "input")
+	if err := backend.Fetch(context.Background(), u, func(bool) string { return dest }); err == nil {
+		t.Error("Fetch succeeded, want an error")
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"1.1.1.1":            true,
+		"2001:4860::8888":    true,
+		"127.0.0.53":         false,
+		"169.254.0.1":        false,
+		"100.64.0.1":         false,
+		"::ffff:10.1.2.3":    false,
+		"::":                 false,
+		"ff02::1":            false,
+		"fe80::abcd%eth0":    false,
+		"::ffff:203.0.113.5": true,
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestHTTPBackendFetchLimitsSize(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(randomBytes(10000, 1))
+	}))
+	defer server.Close()
+
+	// Send requests for example.com, a public name, to the test server
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	client.Transport = transport
+	u, err := url.Parse("https://example.com/data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, maxBytes := range []int64{0, 10000} {
+		dest := filepath.Join(t.TempDir(), "input")
+		if err := newHTTPBackend(client, testRetry, maxBytes).Fetch(context.Background(), u, func(bool) string { return dest }); err != nil {
+			t.Errorf("Fetch with a limit of %d bytes failed: %v", maxBytes, err)
+		}
+	}
+	dest := filepath.Join(t.TempDir(), "input")
+	if err := newHTTPBackend(client, testRetry, 9999).Fetch(context.Background(), u, func(bool) string { return dest }); !errors.Is(err, errTooLarge) {
+		t.Errorf("Fetch over the limit: error = %v, want errTooLarge", err)
+	}
+}
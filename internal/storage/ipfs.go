@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+)
+
+// ipfsRoot returns the CID of an ipfs:// reference
+func ipfsRoot(ref *url.URL) (cid, error) {
+	if ref.Path != "" && ref.Path != "/" {
+		return cid{}, fmt.Errorf("paths inside IPFS references are not supported: %s", ref)
+	}
+	return parseCID(ref.Host)
+}
+
+// writeDAG reads a CAR of root's DAG, checks every block against its CID and
+// writes the UnixFS file or directory tree to the path chosen by dest. The
+// files written may total at most maxBytes, and the CAR at most
+// carLimit(maxBytes); 0 means no limit.
+func writeDAG(car io.Reader, root cid, dest func(isDir bool) string, maxBytes int64) error {
+	limit := carLimit(maxBytes)
+	store, err := newBlockStore(limit)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if limit > 0 {
+		car = &cappedReader{r: car, remaining: limit, limit: limit}
+	}
+	if err := readCAR(car, store); err != nil {
+		return err
+	}
+	return unpackDAG(store, root, dest, maxBytes)
+}
+
+// unpackDAG writes the UnixFS file or directory tree of root from verified
+// blocks to the path chosen by dest. The files written may total at most
+// maxBytes; 0 means no limit.
+func unpackDAG(store *blockStore, root cid, dest func(isDir bool) string, maxBytes int64) error {
+	writer := &dagWriter{store: store, maxBytes: maxBytes, maxNodes: maxDAGNodes}
+	isDir, err := writer.isDirectory(root)
+	if err != nil {
+		return err
+	}
+	return writer.writeEntry(root, dest(isDir), 0)
+}
+
+// streamMultipart returns a multipart body that is written by writeParts as
+// it is read, so large uploads are streamed from disk rather than buffered
+func streamMultipart(writeParts func(writer *multipart.Writer) error) (io.ReadCloser, string) {
+	bodyReader, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+
+	go func() {
+		if err := writeParts(writer); err != nil {
+			bodyWriter.CloseWithError(err)
+			return
+		}
+		bodyWriter.CloseWithError(writer.Close())
+	}()
+
+	return bodyReader, writer.FormDataContentType()
+}
+
+// copyFileToPart copies a local file into a multipart part, counting the
+// bytes read as upload progress
+func copyFileToPart(part io.Writer, localFile string, progress *progressTracker) error {
+	file, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", localFile, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(part, progress.reader(file)); err != nil {
+		return fmt.Errorf("failed to copy file to form: %w", err)
+	}
+	return nil
+}
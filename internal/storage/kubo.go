@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// kuboBackend stores content on a Kubo (go-ipfs) node through its HTTP RPC API
+type kuboBackend struct {
+	client   *http.Client
+	apiURL   string
+	maxBytes int64 // unpacked size limit of a fetched DAG; 0 means none
+}
+
+// kuboAddResponse is one line of the newline-delimited JSON returned by /api/v0/add
+type kuboAddResponse struct {
+	Name string `json:"Name"`
+	Hash string `json:"Hash"`
+}
+
+// newKuboBackend creates a backend for the Kubo RPC API at apiURL. Fetched
+// DAGs may unpack to at most maxBytes; 0 means no limit.
+func newKuboBackend(client *http.Client, apiURL string, maxBytes int64) *kuboBackend {
+	return &kuboBackend{
+		client:   client,
+		apiURL:   strings.TrimSuffix(apiURL, "/"),
+		maxBytes: maxBytes,
+	}
+}
+
+// Fetch exports a CID's DAG from the node as a CAR, checks every block against
+// its CID and writes the UnixFS file or directory tree
+func (k *kuboBackend) Fetch(ctx context.Context, ref *url.URL, dest func(isDir bool) string) error {
+	root, err := ipfsRoot(ref)
+	if err != nil {
+		return err
+	}
+
+	// The Kubo RPC API only accepts POST
+	exportURL := fmt.Sprintf("%s/api/v0/dag/export?arg=%s", k.apiURL, url.QueryEscape(ref.Host))
+	req, err := http.NewRequestWithContext(ctx, "POST", exportURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export from Kubo: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to export from Kubo: HTTP %d - %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	progress := progressFrom(ctx)
+	progress.expect(resp.ContentLength)
+	if err := writeDAG(progress.reader(resp.Body), root, dest, k.maxBytes); err != nil {
+		return fmt.Errorf("failed to download %s from Kubo: %w", ref.Host, err)
+	}
+	return nil
+}
+
+// Store adds and pins a directory on the node and returns its CID
+func (k *kuboBackend) Store(ctx context.Context, u upload) (string, error) {
+	if u.dest != nil {
+		return "", fmt.Errorf("IPFS uploads are content-addressed and cannot be sent to %s", u.dest)
+	}
+
+	// Kubo expects every directory as its own part, before its contents
+	progress := progressFrom(ctx)
+	body, contentType := streamMultipart(func(writer *multipart.Writer) error {
+		if _, err := createKuboPart(writer, u.name, true); err != nil {
+			return err
+		}
+		for _, file := range u.files {
+			part, err := createKuboPart(writer, u.name+"/"+file.name, file.isDir)
+			if err != nil {
+				return err
+			}
+			if file.isDir {
+				continue
+			}
+			if err := copyFileToPart(part, file.path, progress); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer body.Close()
+
+	addURL := fmt.Sprintf("%s/api/v0/add?pin=true&cid-version=1", k.apiURL)
+	req, err := http.NewRequestWithContext(ctx, "POST", addURL, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to add to Kubo: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to add to Kubo: HTTP %d - %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	// One line is returned per added file and directory; keep the root's CID
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var added kuboAddResponse
+		if err := decoder.Decode(&added); err != nil {
+			return "", fmt.Errorf("failed to parse Kubo response: %w", err)
+		}
+		if added.Name == u.name {
+			return added.Hash, nil
+		}
+	}
+
+	return "", fmt.Errorf("Kubo did not return a CID for %s", u.name)
+}
+
+// createKuboPart starts a multipart part for a file or directory. Kubo reads
+// part file names URL-escaped.
+func createKuboPart(writer *multipart.Writer, name string, isDir bool) (io.Writer, error) {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, url.QueryEscape(name)))
+	if isDir {
+		header.Set("Content-Type", "application/x-directory")
+	} else {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create form file: %w", err)
+	}
+	return part, nil
+}
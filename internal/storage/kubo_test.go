@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestKuboBackendFetch(t *testing.T) {
+	const root = "bafybeichyt4ac6fdhxtwq7uu5omz6a7yavhjmsnllksds4ndye5iq5lwea"
+	car := readFixture(t, "dir_v1.car")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v0/dag/export" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("arg") != root {
+			http.Error(w, "block not found", http.StatusInternalServerError)
+			return
+		}
+		w.Write(car)
+	}))
+	defer server.Close()
+
+	backend := newKuboBackend(server.Client(), server.URL+"/", 0)
+	dest := filepath.Join(t.TempDir(), "input")
+	if err := backend.Fetch(context.Background(), &url.URL{Scheme: "ipfs", Host: root}, func(bool) string { return dest }); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	assertTree(t, dest, fixtureDir())
+
+	// Kubo's errors are passed on
+	other := &url.URL{Scheme: "ipfs", Host: "bafkreigmpufwazzzslye2nddwsajihpqukc3szfqcsvkmtdarxkz63vhcm"}
+	if err := backend.Fetch(context.Background(), other, func(bool) string { return dest }); err == nil {
+		t.Error("Fetch of content Kubo does not have succeeded")
+	}
+}
+
+func TestKuboBackendStore(t *testing.T) {
+	var parts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v0/add" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("pin") != "true" || r.URL.Query().Get("cid-version") != "1" {
+			t.Errorf("add query = %s, want pin=true and cid-version=1", r.URL.RawQuery)
+		}
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Fatalf("request is not multipart: %v", err)
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts = append(parts, describeKuboPart(t, part))
+		}
+
+		// One line per file and directory, the root last
+		fmt.Fprintln(w, `{"Name":"output/a.txt","Hash":"bafkreia"}`)
+		fmt.Fprintln(w, `{"Name":"output/sub/b.txt","Hash":"bafkreib"}`)
+		fmt.Fprintln(w, `{"Name":"output/sub","Hash":"bafybeisub"}`)
+		fmt.Fprintln(w, `{"Name":"output","Hash":"bafybeiroot"}`)
+	}))
+	defer server.Close()
+
+	backend := newKuboBackend(server.Client(), server.URL, 0)
+	dir := writeTestTree(t, map[string]string{"a.txt": "a", "sub/b.txt": "bb"})
+	cid, err := backend.Store(context.Background(), testUpload(t, "job-1", "output", dir))
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if cid != "bafybeiroot" {
+		t.Errorf("Store returned %q, want the root's CID", cid)
+	}
+
+	// Directories come before their contents
+	want := []string{
+		"output (application/x-directory)",
+		"output/a.txt (application/octet-stream): a",
+		"output/sub (application/x-directory)",
+		"output/sub/b.txt (application/octet-stream): bb",
+	}
+	if fmt.Sprint(parts) != fmt.Sprint(want) {
+		t.Errorf("parts = %q, want %q", parts, want)
+	}
+}
+
+// describeKuboPart returns a part's unescaped file name, content type and content
+func describeKuboPart(t *testing.T, part *multipart.Part) string {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := url.QueryUnescape(params["filename"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentType := part.Header.Get("Content-Type")
+	if contentType == "application/x-directory" {
+		return fmt.Sprintf("%s (%s)", name, contentType)
+	}
+	content, err := io.ReadAll(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s (%s): %s", name, contentType, content)
+}
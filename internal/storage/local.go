@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// localBackend stores content in a directory on the agent's filesystem. It is
+// meant for development; file:// references are confined to its root.
+type localBackend struct {
+	root string
+}
+
+// newLocalBackend creates a filesystem backend rooted at root
+func newLocalBackend(root string) (*localBackend, error) {
+	if root == "" {
+		return nil, errors.New("LOCAL_STORAGE_DIR is required for the local storage backend")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create local storage directory: %w", err)
+	}
+	return &localBackend{root: root}, nil
+}
+
+// Fetch copies a file or directory tree from under the root
+func (l *localBackend) Fetch(ctx context.Context, ref *url.URL, dest func(isDir bool) string) error {
+	source, err := l.resolve(ref)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", ref, err)
+	}
+	progress := progressFrom(ctx)
+	if !info.IsDir() {
+		progress.expect(info.Size())
+		return copyLocalFile(source, dest(false), progress)
+	}
+
+	files, err := collectFiles(source, "input")
+	if err != nil {
+		return err
+	}
+	progress.expect(totalSize(files))
+	target := dest(true)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		destPath := filepath.Join(target, filepath.FromSlash(file.name))
+		if file.isDir {
+			if err := os.MkdirAll(destPath, 0755); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			continue
+		}
+		if err := copyLocalFile(file.path, destPath, progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store copies a directory under the root, by default to <root>/<job_id>/<name>,
+// and returns its file:// reference
+func (l *localBackend) Store(ctx context.Context, u upload) (string, error) {
+	ref := u.dest
+	if ref == nil {
+		ref = &url.URL{Scheme: "file", Path: "/" + path.Join(u.jobID, u.name)}
+	}
+	target, err := l.resolve(ref)
+	if err != nil {
+		return "", err
+	}
+
+	progress := progressFrom(ctx)
+	for _, file := range u.files {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		destPath := filepath.Join(target, filepath.FromSlash(file.name))
+		if file.isDir {
+			if err := os.MkdirAll(destPath, 0755); err != nil {
+				return "", fmt.Errorf("failed to create directory: %w", err)
+			}
+			continue
+		}
+		if err := copyLocalFile(file.path, destPath, progress); err != nil {
+			return "", err
+		}
+	}
+
+	return ref.String(), nil
+}
+
+// checkRef checks that a file:// reference is under the root
+func (l *localBackend) checkRef(ref *url.URL) error {
+	_, err := l.resolve(ref)
+	return err
+}
+
+// resolve maps a file:// reference to a path under the root
+func (l *localBackend) resolve(ref *url.URL) (string, error) {
+	if ref.Host != "" && ref.Host != "localhost" {
+		return "", fmt.Errorf("file:// references must not name a host: %s", ref)
+	}
+
+	rel := strings.TrimPrefix(ref.Path, "/")
+	if rel == "" || !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("file:// reference %s is outside the local storage directory", ref)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(rel)), nil
+}
+
+// copyLocalFile copies a regular file, creating the destination's parents.
+// progress may be nil.
+func copyLocalFile(source, dest string, progress *progressTracker) error {
+	file, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", source, err)
+	}
+	defer file.Close()
+
+	return writeFile(dest, progress.reader(file))
+}
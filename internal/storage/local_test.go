@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalBackendConfinesReferences(t *testing.T) {
+	backend, err := newLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{
+		"file:///../escape",
+		"file:///job-1/../../escape",
+		"file:///",
+		"file://other-host/job-1",
+		"file:///%2e%2e/escape",
+	} {
+		t.Run(ref, func(t *testing.T) {
+			u, err := url.Parse(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(t.TempDir(), "input")
+			if err := backend.Fetch(context.Background(), u, func(bool) string { return dest }); err == nil {
+				t.Error("Fetch succeeded, want an error")
+			}
+
+			u2 := testUpload(t, "job-1", "output", writeTestTree(t, map[string]string{"a.txt": "a"}))
+			u2.dest = u
+			if _, err := backend.Store(context.Background(), u2); err == nil {
+				t.Error("Store succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestLocalBackendRoundTrip(t *testing.T) {
+	backend, err := newLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "b"}
+
+	ref, err := backend.Store(context.Background(), testUpload(t, "job-1", "output", writeTestTree(t, files)))
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if ref != "file:///job-1/output" {
+		t.Errorf("Store returned %q, want file:///job-1/output", ref)
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "input")
+	if err := backend.Fetch(context.Background(), u, func(bool) string { return dest }); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	assertTree(t, dest, files)
+}
@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"lamda_node_agent/internal/config"
+)
+
+// Manager defines the interface for storage operations. Inputs and outputs
+// are referenced by URI (ipfs://, s3://, file://, https://); a bare CID is
+// treated as ipfs://.
+type Manager interface {
+	// CheckRef reports whether a reference can be handled by a configured backend
+	CheckRef(ref string) error
+	DownloadInput(ctx context.Context, ref string, localPath string) error
+	DownloadTo(ctx context.Context, ref string, destPath string) error
+	// UploadOutput stores localPath at destination, or in the default
+	// backend when destination is not a URI
+	UploadOutput(ctx context.Context, jobID, localPath, destination string) (string, error)
+	UploadLogs(ctx context.Context, jobID, localPath string) (string, error)
+
+	// AcquireInput returns a content-addressed input from the local cache,
+	// downloading it on a miss. It returns nil when the reference is not
+	// content-addressed or the cache is disabled.
+	AcquireInput(ctx context.Context, ref string) (*CachedInput, error)
+	CacheStats() CacheStats
+	// CachedCIDs lists the CIDs held in the input cache, most recently used first
+	CachedCIDs() []string
+}
+
+// Backend stores job inputs and outputs in one kind of storage
+type Backend interface {
+	// Fetch writes the file or directory at ref to the path chosen by dest
+	Fetch(ctx context.Context, ref *url.URL, dest func(isDir bool) string) error
+
+	// Store uploads a directory and returns a reference to it
+	Store(ctx context.Context, u upload) (string, error)
+}
+
+// ErrEmptyOutput is returned when a job finished without writing any output
+var ErrEmptyOutput = errors.New("job produced no output files")
+
+// ErrIntegrity is returned when downloaded content does not match the CID it
+// was requested by, or blocks of its DAG are missing
+var ErrIntegrity = errors.New("content integrity check failed")
+
+// refChecker is implemented by backends that only accept some of the
+// references of their scheme
+type refChecker interface {
+	checkRef(ref *url.URL) error
+}
+
+// errUploadUnsupported is returned by backends that can only fetch
+var errUploadUnsupported = errors.New("storage backend does not support uploads")
+
+// upload is a directory of a job to store
+type upload struct {
+	jobID string
+	name  string       // "output" or "logs"
+	files []uploadFile // in lexical order, directories before their contents
+	dest  *url.URL     // explicit destination, or nil for the backend's default
+}
+
+// uploadFile is a local file or directory and its path relative to the
+// uploaded directory
+type uploadFile struct {
+	name  string
+	path  string
+	isDir bool
+	size  int64
+}
+
+// router implements Manager by routing each reference to the backend for
+// its URI scheme
+type router struct {
+	backends      map[string]Backend
+	defaultScheme string
+	cache         *inputCache // nil when the input cache is disabled
+}
+
+// NewManager creates a storage manager with the backends enabled in the
+// configuration. STORAGE_BACKEND selects where outputs and logs are stored
+// by default, and which IPFS backend serves ipfs:// references.
+func NewManager(cfg *config.Config) (Manager, error) {
+	client := &http.Client{}
+	retry := RetryPolicy{
+		Attempts:    cfg.DownloadAttempts,
+		IdleTimeout: cfg.DownloadIdleTimeout,
+		BaseDelay:   cfg.DownloadBackoffBase,
+		MaxDelay:    cfg.DownloadBackoffMax,
+	}
+	maxInputBytes := cfg.MaxInputSizeMB * 1024 * 1024
+	r := &router{
+		backends: map[string]Backend{},
+	}
+	if cfg.AllowHTTPInputs {
+		r.backends["https"] = newHTTPBackend(newPublicHTTPClient(), retry, maxInputBytes)
+	}
+
+	switch cfg.StorageBackend {
+	case "gateway":
+		gateway, err := newGatewayBackend(client, cfg.IPFSGatewayURLs, cfg.IPFSPinningURL, cfg.PinataJWT, retry, maxInputBytes)
+		if err != nil {
+			return nil, err
+		}
+		r.backends["ipfs"] = gateway
+		r.defaultScheme = "ipfs"
+	case "kubo":
+		r.backends["ipfs"] = newKuboBackend(client, cfg.KuboAPIURL, maxInputBytes)
+		r.defaultScheme = "ipfs"
+	case "s3":
+		r.defaultScheme = "s3"
+	case "local":
+		r.defaultScheme = "file"
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+
+	// S3 and the local filesystem are also available for job references
+	// whenever they are configured
+	if cfg.S3Bucket != "" || cfg.StorageBackend == "s3" {
+		s3, err := newS3Backend(client, cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3Prefix, cfg.S3AccessKeyID, cfg.S3SecretAccessKey, cfg.S3AllowedPrefixes, retry, maxInputBytes)
+		if err != nil {
+			return nil, err
+		}
+		r.backends["s3"] = s3
+	}
+	if cfg.LocalStorageDir != "" || cfg.StorageBackend == "local" {
+		local, err := newLocalBackend(cfg.LocalStorageDir)
+		if err != nil {
+			return nil, err
+		}
+		r.backends["file"] = local
+	}
+
+	if cfg.InputCacheSizeMB > 0 {
+		cache, err := newInputCache(cfg.InputCacheDir, cfg.InputCacheSizeMB*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+		r.cache = cache
+	}
+
+	return r, nil
+}
+
+// CheckRef reports whether a reference can be handled by a configured backend
+func (r *router) CheckRef(ref string) error {
+	u, backend, err := r.resolve(ref)
+	if err != nil {
+		return err
+	}
+
+	// IPFS content is verified against its CID, so the CID must be one the
+	// agent can parse
+	if u.Scheme == "ipfs" {
+		_, err = ipfsRoot(u)
+	}
+	if checker, ok := backend.(refChecker); ok && err == nil {
+		err = checker.checkRef(u)
+	}
+	return err
+}
+
+// DownloadInput downloads input data for a job. A directory is rebuilt under
+// localPath; a single file is written to localPath/input.
+func (r *router) DownloadInput(ctx context.Context, ref string, localPath string) error {
+	u, backend, err := r.resolve(ref)
+	if err != nil {
+		return err
+	}
+	return backend.Fetch(ctx, u, func(isDir bool) string {
+		if isDir {
+			return localPath
+		}
+		return filepath.Join(localPath, "input")
+	})
+}
+
+// DownloadTo downloads a file or directory to destPath
+func (r *router) DownloadTo(ctx context.Context, ref string, destPath string) error {
+	u, backend, err := r.resolve(ref)
+	if err != nil {
+		return err
+	}
+	return backend.Fetch(ctx, u, func(bool) string {
+		return destPath
+	})
+}
+
+// UploadOutput uploads a job's whole output directory and returns a reference
+// to it. It returns ErrEmptyOutput when the job wrote no files.
+func (r *router) UploadOutput(ctx context.Context, jobID, localPath, destination string) (string, error) {
+	u := upload{jobID: jobID, name: "output"}
+	backend := r.backends[r.defaultScheme]
+	if strings.Contains(destination, "://") {
+		dest, destBackend, err := r.resolve(destination)
+		if err != nil {
+			return "", err
+		}
+		u.dest, backend = dest, destBackend
+	}
+
+	files, err := collectFiles(localPath, u.name)
+	if err != nil {
+		return "", err
+	}
+	if !hasRegularFile(files) {
+		return "", ErrEmptyOutput
+	}
+	u.files = files
+
+	progressFrom(ctx).expect(totalSize(files))
+	return backend.Store(ctx, u)
+}
+
+// UploadLogs uploads a job's log files to the default backend
+func (r *router) UploadLogs(ctx context.Context, jobID, localPath string) (string, error) {
+	files, err := collectFiles(localPath, "logs")
+	if err != nil {
+		return "", err
+	}
+	if !hasRegularFile(files) {
+		return "", fmt.Errorf("no log files in %s", localPath)
+	}
+
+	return r.backends[r.defaultScheme].Store(ctx, upload{jobID: jobID, name: "logs", files: files})
+}
+
+// AcquireInput returns an IPFS input from the cache, downloading it on a miss
+func (r *router) AcquireInput(ctx context.Context, ref string) (*CachedInput, error) {
+	u, backend, err := r.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache == nil || u.Scheme != "ipfs" {
+		return nil, nil
+	}
+
+	// Key by multihash so CIDv0 and CIDv1 references share an entry
+	root, err := ipfsRoot(u)
+	if err != nil {
+		return nil, err
+	}
+	return r.cache.Acquire(ctx, root.String(), u.Host, func(dest func(isDir bool) string) error {
+		return backend.Fetch(ctx, u, dest)
+	})
+}
+
+// CacheStats returns the input cache's counters; they are zero when the
+// cache is disabled
+func (r *router) CacheStats() CacheStats {
+	if r.cache == nil {
+		return CacheStats{}
+	}
+	return r.cache.Stats()
+}
+
+// CachedCIDs lists the CIDs held in the input cache; it is empty when the
+// cache is disabled
+func (r *router) CachedCIDs() []string {
+	if r.cache == nil {
+		return nil
+	}
+	return r.cache.CIDs()
+}
+
+// resolve parses a reference and finds the backend for its scheme
+func (r *router) resolve(ref string) (*url.URL, Backend, error) {
+	u, err := parseRef(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backend, ok := r.backends[u.Scheme]
+	if !ok {
+		return nil, nil, fmt.Errorf("no storage backend configured for %s:// references", u.Scheme)
+	}
+	return u, backend, nil
+}
+
+// parseRef parses a storage reference. A bare CID is an ipfs:// reference.
+func parseRef(ref string) (*url.URL, error) {
+	if ref == "" {
+		return nil, errors.New("empty storage reference")
+	}
+	if !strings.Contains(ref, "://") {
+		ref = "ipfs://" + ref
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage reference %q: %w", ref, err)
+	}
+	return u, nil
+}
+
+// collectFiles lists the directories and regular files under root in lexical
+// order. Symlinks are skipped: output is written by untrusted containers and
+// could link to files on the host.
+func collectFiles(root, dirName string) ([]uploadFile, error) {
+	var files []uploadFile
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || !(entry.IsDir() || entry.Type().IsRegular()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		file := uploadFile{
+			name:  filepath.ToSlash(rel),
+			path:  path,
+			isDir: entry.IsDir(),
+		}
+		if !file.isDir {
+			file.size = info.Size()
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s directory: %w", dirName, err)
+	}
+
+	return files, nil
+}
+
+// totalSize sums the sizes of files
+func totalSize(files []uploadFile) int64 {
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+	return size
+}
+
+// hasRegularFile reports whether any of files is not a directory
+func hasRegularFile(files []uploadFile) bool {
+	for _, file := range files {
+		if !file.isDir {
+			return true
+		}
+	}
+	return false
+}
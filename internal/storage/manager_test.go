@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lamda_node_agent/internal/config"
+)
+
+func TestRouterCheckRef(t *testing.T) {
+	base := config.Config{
+		StorageBackend:    "local",
+		LocalStorageDir:   t.TempDir(),
+		S3Endpoint:        "https://s3.example.com",
+		S3Region:          "us-east-1",
+		S3Bucket:          "lamda",
+		S3Prefix:          "jobs",
+		S3AccessKeyID:     "AKIDEXAMPLE",
+		S3SecretAccessKey: "secret",
+	}
+
+	tests := []struct {
+		name    string
+		cfg     func(cfg *config.Config)
+		ref     string
+		wantErr bool
+	}{
+		{name: "local path", ref: "file:///job-1/input.txt"},
+		{name: "local path outside the root", ref: "file:///../etc/passwd", wantErr: true},
+		{name: "s3 under the prefix", ref: "s3://lamda/jobs/job-1/input"},
+		{name: "s3 outside the prefix", ref: "s3://lamda/secrets/key", wantErr: true},
+		{name: "s3 in another bucket", ref: "s3://someone-else/jobs/job-1", wantErr: true},
+		{
+			name: "s3 in an allowed bucket",
+			cfg:  func(cfg *config.Config) { cfg.S3AllowedPrefixes = []string{"datasets"} },
+			ref:  "s3://datasets/imagenet/train",
+		},
+		{
+			name:    "s3 default location once others are allowed",
+			cfg:     func(cfg *config.Config) { cfg.S3AllowedPrefixes = []string{"datasets"} },
+			ref:     "s3://lamda/jobs/job-1/input",
+			wantErr: true,
+		},
+		{name: "https when disabled", ref: "https://example.com/data.bin", wantErr: true},
+		{
+			name: "https when enabled",
+			cfg:  func(cfg *config.Config) { cfg.AllowHTTPInputs = true },
+			ref:  "https://example.com/data.bin",
+		},
+		{
+			name:    "http when https is enabled",
+			cfg:     func(cfg *config.Config) { cfg.AllowHTTPInputs = true },
+			ref:     "http://example.com/data.bin",
+			wantErr: true,
+		},
+		{
+			name:    "https to the metadata service",
+			cfg:     func(cfg *config.Config) { cfg.AllowHTTPInputs = true },
+			ref:     "https://169.254.169.254/latest/meta-data/",
+			wantErr: true,
+		},
+		{name: "ipfs without a backend", ref: "ipfs://bafkreigmpufwazzzslye2nddwsajihpqukc3szfqcsvkmtdarxkz63vhcm", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			manager, err := NewManager(&cfg)
+			if err != nil {
+				t.Fatalf("NewManager failed: %v", err)
+			}
+
+			err = manager.CheckRef(tt.ref)
+			if tt.wantErr && err == nil {
+				t.Errorf("CheckRef(%q) succeeded, want an error", tt.ref)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("CheckRef(%q) failed: %v", tt.ref, err)
+			}
+		})
+	}
+}
+
+// writeTestTree creates files, keyed by slash-separated relative path, in a
+// temporary directory
+func writeTestTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// testUpload returns an upload of the directory at root
+func testUpload(t *testing.T, jobID, name, root string) upload {
+	t.Helper()
+	files, err := collectFiles(root, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upload{jobID: jobID, name: name, files: files}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Progress is how far the transfers of one context have got
+type Progress struct {
+	Bytes int64 // transferred so far
+	Total int64 // expected size, or 0 while any transfer's size is unknown
+}
+
+// ProgressFunc receives transfer progress. It is called from the goroutine
+// doing the transfer, after every read, so it must be cheap.
+type ProgressFunc func(Progress)
+
+// progressKey is the context key of a *progressTracker
+type progressKey struct{}
+
+// WithProgress returns a context whose downloads and uploads report their
+// progress to fn. Transfers made with the context add up: each adds its size
+// to the total once the size is known.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, &progressTracker{fn: fn})
+}
+
+// progressTracker accumulates the progress of a context's transfers. A nil
+// tracker ignores every call, so backends need not check for one.
+type progressTracker struct {
+	mu      sync.Mutex
+	fn      ProgressFunc
+	bytes   int64
+	total   int64
+	unknown bool // some transfer's size is unknown
+}
+
+// progressFrom returns the context's tracker, or nil
+func progressFrom(ctx context.Context) *progressTracker {
+	tracker, _ := ctx.Value(progressKey{}).(*progressTracker)
+	return tracker
+}
+
+// expect adds a transfer's size to the total; a negative size is unknown
+func (t *progressTracker) expect(size int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if size < 0 {
+		t.unknown = true
+	} else {
+		t.total += size
+	}
+	t.mu.Unlock()
+	t.report()
+}
+
+// add records n bytes transferred; a negative n takes back bytes of a
+// transfer that restarted
+func (t *progressTracker) add(n int64) {
+	if t == nil || n == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.bytes += n
+	t.mu.Unlock()
+	t.report()
+}
+
+// report passes the current progress to the callback
+func (t *progressTracker) report() {
+	t.mu.Lock()
+	p := Progress{Bytes: t.bytes}
+	if !t.unknown {
+		p.Total = t.total
+	}
+	t.mu.Unlock()
+	t.fn(p)
+}
+
+// reader counts the bytes read from r
+func (t *progressTracker) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &progressReader{r: r, tracker: t}
+}
+
+// progressReader is an io.Reader that records what it reads
+type progressReader struct {
+	r       io.Reader
+	tracker *progressTracker
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.tracker.add(int64(n))
+	return n, err
+}
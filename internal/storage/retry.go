@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ErrNotFound is returned when a source does not have the requested content
+var ErrNotFound = errors.New("content not found")
+
+// RetryPolicy controls how HTTP downloads are retried
+type RetryPolicy struct {
+	Attempts    int           // attempts per source, at least 1
+	IdleTimeout time.Duration // longest wait for data before an attempt fails; 0 means none
+	BaseDelay   time.Duration // backoff before the second attempt
+	MaxDelay    time.Duration // backoff cap
+}
+
+// permanentError marks a failure that retrying the same source cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent marks err as not worth retrying
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isRetryable reports whether a failed download may succeed if repeated.
+// Network errors, timeouts, 5xx and 429 responses are retryable; missing
+// content and integrity failures are not.
+func isRetryable(err error) bool {
+	var p *permanentError
+	return !errors.As(err, &p) && !errors.Is(err, ErrIntegrity)
+}
+
+// errTooLarge is returned for downloads over the input size limit
+var errTooLarge = errors.New("input is larger than the size limit")
+
+// tooLarge reports a download over limit bytes; retrying cannot fix it
+func tooLarge(limit int64) error {
+	return permanent(fmt.Errorf("%w of %d bytes", errTooLarge, limit))
+}
+
+// downloadSink receives the body of a download. It keeps what it has read
+// across attempts, so a retry may continue where the previous one stopped.
+type downloadSink interface {
+	// kept returns how many bytes of the download the sink has kept
+	kept() int64
+	// resumable reports whether a retry may continue from kept with a
+	// Range request
+	resumable() bool
+	// reset discards everything kept, so the download starts over
+	reset() error
+	// consume reads a response body that continues from kept
+	consume(resp *http.Response, body io.Reader) error
+}
+
+// getRequest returns a function building GET requests for rawURL
+func getRequest(rawURL string, header http.Header) func(ctx context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		return req, nil
+	}
+}
+
+// downloadFile downloads the requests made by newRequest to path, retrying
+// retryable failures with exponential backoff, and returns the size of the
+// file. When resume is set, retries resume from the bytes already written
+// using a Range request, and a source that ignores Range is downloaded from
+// the start. Otherwise every retry starts from the start, which responses
+// whose bytes may differ between requests need. The file may be at most
+// maxBytes long; 0 means no limit. Progress is reported to the context's
+// tracker; sized is set when the caller has already added the file's size.
+func (p RetryPolicy) downloadFile(ctx context.Context, client *http.Client, newRequest func(ctx context.Context) (*http.Request, error), path string, resume, sized bool, maxBytes int64, name string) (int64, error) {
+	// Start from an empty file; only bytes from this download are resumed
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, permanent(fmt.Errorf("failed to create local file: %w", err))
+	}
+	defer file.Close()
+
+	sink := &fileSink{file: file, resume: resume}
+	err = p.download(ctx, client, newRequest, sink, sized, maxBytes, name)
+	return sink.written, err
+}
+
+// download runs the requests made by newRequest into sink, retrying
+// retryable failures with exponential backoff. A download may be at most
+// maxBytes long; 0 means no limit. sized is set when the caller has already
+// added the download's size to the progress. name identifies it in the log.
+func (p RetryPolicy) download(ctx context.Context, client *http.Client, newRequest func(ctx context.Context) (*http.Request, error), sink downloadSink, sized bool, maxBytes int64, name string) error {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	progress := progressFrom(ctx)
+	for attempt := 1; ; attempt++ {
+		err := p.downloadAttempt(ctx, client, newRequest, sink, maxBytes, progress, &sized)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !isRetryable(err) || attempt >= attempts {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		log.Printf("Download attempt %d/%d of %s failed, retrying in %s: %v", attempt, attempts, name, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// downloadAttempt makes one attempt at the download, continuing from what
+// sink has kept when it is resumable. The attempt fails once no data has
+// arrived for IdleTimeout, however long the download as a whole takes. The
+// download's size is added to progress by the first attempt to learn it,
+// which sets sized.
+func (p RetryPolicy) downloadAttempt(ctx context.Context, client *http.Client, newRequest func(ctx context.Context) (*http.Request, error), sink downloadSink, maxBytes int64, progress *progressTracker, sized *bool) (err error) {
+	var idle *time.Timer
+	if p.IdleTimeout > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		errIdle := fmt.Errorf("no data received for %s", p.IdleTimeout)
+		idle = time.AfterFunc(p.IdleTimeout, func() { cancel(errIdle) })
+		defer idle.Stop()
+
+		// Report the stall rather than the cancellation it caused
+		defer func() {
+			if err != nil && context.Cause(ctx) == errIdle {
+				err = errIdle
+			}
+		}()
+	}
+
+	offset := sink.kept()
+	if offset > 0 && !sink.resumable() {
+		if err := restartDownload(sink, offset, progress); err != nil {
+			return err
+		}
+		offset = 0
+	}
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		return permanent(fmt.Errorf("failed to create HTTP request: %w", err))
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	size := int64(-1)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			if err := restartDownload(sink, offset, progress); err != nil {
+				return err
+			}
+			return fmt.Errorf("cannot resume download: unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		if resp.ContentLength >= 0 {
+			size = offset + resp.ContentLength
+		}
+	case resp.StatusCode == http.StatusOK:
+		// The source ignored the Range header, or this attempt starts over
+		if offset > 0 {
+			if err := restartDownload(sink, offset, progress); err != nil {
+				return err
+			}
+			offset = 0
+		}
+		size = resp.ContentLength
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		if err := restartDownload(sink, offset, progress); err != nil {
+			return err
+		}
+		return fmt.Errorf("cannot resume download: HTTP %d", resp.StatusCode)
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return permanent(fmt.Errorf("%w: HTTP %d", ErrNotFound, resp.StatusCode))
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	default:
+		return permanent(fmt.Errorf("HTTP %d", resp.StatusCode))
+	}
+
+	// Refuse a download that says up front it is too large
+	if maxBytes > 0 && size > maxBytes {
+		return tooLarge(maxBytes)
+	}
+	if !*sized {
+		progress.expect(size)
+		*sized = true
+	}
+
+	var body io.Reader = resp.Body
+	if maxBytes > 0 {
+		body = &cappedReader{r: body, remaining: maxBytes - offset, limit: maxBytes}
+	}
+	if idle != nil {
+		body = &idleReader{r: body, timer: idle, timeout: p.IdleTimeout}
+	}
+	counted := &countingReader{r: body}
+	err = sink.consume(resp, progress.reader(counted))
+
+	// Take back progress for bytes the sink read but did not keep, which a
+	// resumed attempt reads again
+	progress.add(sink.kept() - offset - counted.n)
+	return err
+}
+
+// restartDownload discards offset bytes the sink kept so the download
+// starts over
+func restartDownload(sink downloadSink, offset int64, progress *progressTracker) error {
+	if err := sink.reset(); err != nil {
+		return permanent(fmt.Errorf("failed to reset download: %w", err))
+	}
+	progress.add(-offset)
+	return nil
+}
+
+// fileSink writes a download to a file
+type fileSink struct {
+	file    *os.File
+	written int64
+	resume  bool
+}
+
+func (f *fileSink) kept() int64     { return f.written }
+func (f *fileSink) resumable() bool { return f.resume }
+
+func (f *fileSink) reset() error {
+	if err := f.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.written = 0
+	return nil
+}
+
+func (f *fileSink) consume(_ *http.Response, body io.Reader) error {
+	n, err := io.Copy(f.file, body)
+	f.written += n
+	if err != nil {
+		return fmt.Errorf("download interrupted: %w", err)
+	}
+	return nil
+}
+
+// cappedReader fails once more than limit bytes have been read in total;
+// remaining is what is left of the limit
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit to tell a stream that ends there from
+	// one that goes on
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	if int64(n) > c.remaining {
+		n = int(c.remaining)
+		c.remaining = 0
+		return n, tooLarge(c.limit)
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// idleReader restarts timer whenever data arrives
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if n > 0 {
+		i.timer.Reset(i.timeout)
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// backoff returns the delay before the next attempt: exponential from
+// BaseDelay, capped at MaxDelay, with up to half of it randomized so agents
+// do not retry in lockstep
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// redactURL hides any password in a URL for logging
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "URL"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileRetries(t *testing.T) {
+	content := randomBytes(10000, 1)
+	tests := []struct {
+		name        string
+		resume      bool
+		ignoreRange bool
+		wantRanges  []string
+	}{
+		{name: "resumed", resume: true, wantRanges: []string{"", "bytes=5000-"}},
+		{name: "source ignores Range", resume: true, ignoreRange: true, wantRanges: []string{"", "bytes=5000-"}},
+		{name: "restarted", resume: false, wantRanges: []string{"", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				if len(ranges) == 1 {
+					// Fail halfway through the first response
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+					w.Write(content[:len(content)/2])
+					panic(http.ErrAbortHandler)
+				}
+				if tt.ignoreRange {
+					r.Header.Del("Range")
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			}))
+			defer server.Close()
+
+			path := filepath.Join(t.TempDir(), "download")
+			if _, err := testRetry.downloadFile(context.Background(), server.Client(), getRequest(server.URL, nil), path, tt.resume, false, 0, "test"); err != nil {
+				t.Fatalf("downloadFile failed: %v", err)
+			}
+			if fmt.Sprint(ranges) != fmt.Sprint(tt.wantRanges) {
+				t.Errorf("Range headers = %q, want %q", ranges, tt.wantRanges)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("downloaded %d bytes that differ from the %d served", len(got), len(content))
+			}
+		})
+	}
+}
+
+func TestDownloadFileStopsAtLimit(t *testing.T) {
+	content := randomBytes(10000, 1)
+	tests := []struct {
+		name     string
+		maxBytes int64
+		chunked  bool
+		wantErr  error
+	}{
+		{name: "at the limit", maxBytes: 10000},
+		{name: "declared over the limit", maxBytes: 9999, wantErr: errTooLarge},
+		{name: "streamed over the limit", maxBytes: 9999, chunked: true, wantErr: errTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if tt.chunked {
+					// Flushing before the body is written leaves out Content-Length
+					w.WriteHeader(http.StatusOK)
+					w.(http.Flusher).Flush()
+				}
+				w.Write(content)
+			}))
+			defer server.Close()
+
+			path := filepath.Join(t.TempDir(), "download")
+			n, err := testRetry.downloadFile(context.Background(), server.Client(), getRequest(server.URL, nil), path, false, false, tt.maxBytes, "test")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("downloadFile error = %v, want %v", err, tt.wantErr)
+			}
+			if requests != 1 {
+				t.Errorf("server received %d requests, want 1", requests)
+			}
+			if n > tt.maxBytes {
+				t.Errorf("kept %d bytes of a download limited to %d", n, tt.maxBytes)
+			}
+		})
+	}
+}
+
+func TestDownloadFileIdleTimeout(t *testing.T) {
+	content := randomBytes(10000, 1)
+	retry := testRetry
+	retry.IdleTimeout = 100 * time.Millisecond
+
+	tests := []struct {
+		name         string
+		stall        bool
+		wantRequests int
+	}{
+		// Slow but steady downloads may take longer than the idle timeout
+		{name: "slow", wantRequests: 1},
+		{name: "stalled", stall: true, wantRequests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if tt.stall && requests == 1 {
+					w.Write(content[:1000])
+					w.(http.Flusher).Flush()
+					<-r.Context().Done()
+					return
+				}
+				for chunk := range slices.Chunk(content, 1000) {
+					w.Write(chunk)
+					w.(http.Flusher).Flush()
+					time.Sleep(20 * time.Millisecond)
+				}
+			}))
+			defer server.Close()
+
+			path := filepath.Join(t.TempDir(), "download")
+			if _, err := retry.downloadFile(context.Background(), server.Client(), getRequest(server.URL, nil), path, false, false, 0, "test"); err != nil {
+				t.Fatalf("downloadFile failed: %v", err)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("server received %d requests, want %d", requests, tt.wantRequests)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("downloaded %d bytes that differ from the %d served", len(got), len(content))
+			}
+		})
+	}
+}
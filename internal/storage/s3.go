@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3UnsignedPayload lets object bodies be streamed without hashing them first
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Backend stores content in S3-compatible object storage. Requests use
+// path-style URLs and AWS Signature Version 4, so MinIO and other
+// S3-compatible services work as well as AWS.
+type s3Backend struct {
+	client    *http.Client
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	retry     RetryPolicy
+	maxBytes  int64 // size limit of a fetched object or directory; 0 means none
+
+	// allowed are the locations s3:// references may name
+	allowed []s3Location
+}
+
+// s3Location is a bucket, or a key prefix within one
+type s3Location struct {
+	bucket string
+	prefix string // without leading or trailing slashes; empty for the whole bucket
+}
+
+// contains reports whether key in bucket is within the location
+func (l s3Location) contains(bucket, key string) bool {
+	if bucket != l.bucket {
+		return false
+	}
+	return l.prefix == "" || key == l.prefix || strings.HasPrefix(key, l.prefix+"/")
+}
+
+// s3Object is an object listed by ListObjectsV2
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+// s3ListResult is the part of a ListObjectsV2 response the agent uses
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// newS3Backend creates an S3 backend. bucket and prefix set where outputs and
+// logs go by default, as <bucket>/<prefix>/<job_id>/<name>. Job references
+// are confined to allowedPrefixes, each "<bucket>" or "<bucket>/<prefix>", or
+// to <bucket>/<prefix> when none are given: the node's credentials must not
+// reach other buckets on a job's say-so. Fetched objects may total at most
+// maxBytes; 0 means no limit.
+func newS3Backend(client *http.Client, endpoint, region, bucket, prefix, accessKey, secretKey string, allowedPrefixes []string, retry RetryPolicy, maxBytes int64) (*s3Backend, error) {
+	if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, errors.New("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for the S3 storage backend")
+	}
+	endpointURL, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+
+	s := &s3Backend{
+		client:    client,
+		endpoint:  endpointURL,
+		region:    region,
+		bucket:    bucket,
+		prefix:    strings.Trim(prefix, "/"),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		retry:     retry,
+		maxBytes:  maxBytes,
+	}
+
+	for _, allowed := range allowedPrefixes {
+		allowedBucket, allowedPrefix, _ := strings.Cut(strings.Trim(strings.TrimSpace(allowed), "/"), "/")
+		if allowedBucket == "" {
+			continue
+		}
+		s.allowed = append(s.allowed, s3Location{bucket: allowedBucket, prefix: strings.Trim(allowedPrefix, "/")})
+	}
+	if len(s.allowed) == 0 {
+		s.allowed = []s3Location{{bucket: s.bucket, prefix: s.prefix}}
+	}
+	return s, nil
+}
+
+// checkRef checks that an s3:// reference is within an allowed location
+func (s *s3Backend) checkRef(ref *url.URL) error {
+	bucket, key := ref.Host, strings.Trim(ref.Path, "/")
+	if bucket == "" {
+		return fmt.Errorf("s3:// reference %s has no bucket", ref)
+	}
+	// S3 keys are not paths, but some S3-compatible services clean them
+	if key != "" && path.Clean(key) != key {
+		return fmt.Errorf("s3:// reference %s has an unclean key", ref)
+	}
+	for _, location := range s.allowed {
+		if location.contains(bucket, key) {
+			return nil
+		}
+	}
+	return fmt.Errorf("s3:// reference %s is outside the locations this node may access", ref)
+}
+
+// Fetch downloads an object, or every object under a key prefix as a
+// directory. The listed sizes are checked against the size limit before
+// anything is downloaded.
+func (s *s3Backend) Fetch(ctx context.Context, ref *url.URL, dest func(isDir bool) string) error {
+	if err := s.checkRef(ref); err != nil {
+		return err
+	}
+	bucket, key := ref.Host, strings.Trim(ref.Path, "/")
+
+	objects, err := s.list(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	progress := progressFrom(ctx)
+
+	// An exact match is a single object; otherwise the key is a directory
+	for _, object := range objects {
+		if object.Key == key && key != "" {
+			if s.maxBytes > 0 && object.Size > s.maxBytes {
+				return fmt.Errorf("failed to download %s: %w", ref, tooLarge(s.maxBytes))
+			}
+			progress.expect(object.Size)
+			_, err := s.download(ctx, bucket, key, dest(false), s.maxBytes)
+			return err
+		}
+	}
+
+	dirPrefix := key + "/"
+	if key == "" {
+		dirPrefix = ""
+	}
+	var files []s3Object
+	var total int64
+	for _, object := range objects {
+		rel, ok := strings.CutPrefix(object.Key, dirPrefix)
+		if !ok || rel == "" || strings.HasSuffix(rel, "/") {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return fmt.Errorf("invalid object key %q under %s", object.Key, ref)
+		}
+		files = append(files, object)
+		total += object.Size
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no objects found at %s", ref)
+	}
+	if s.maxBytes > 0 && total > s.maxBytes {
+		return fmt.Errorf("failed to download %s: %w", ref, tooLarge(s.maxBytes))
+	}
+	progress.expect(total)
+
+	// Objects may have grown since they were listed, so each is limited to
+	// what is left of the limit. Objects listed as empty are created without
+	// downloading them.
+	target := dest(true)
+	remaining := s.maxBytes
+	for _, object := range files {
+		path := filepath.Join(target, filepath.FromSlash(strings.TrimPrefix(object.Key, dirPrefix)))
+		if object.Size == 0 {
+			if err := writeFile(path, strings.NewReader("")); err != nil {
+				return err
+			}
+			continue
+		}
+		if s.maxBytes > 0 && remaining <= 0 {
+			return fmt.Errorf("failed to download %s: %w", ref, tooLarge(s.maxBytes))
+		}
+		n, err := s.download(ctx, bucket, object.Key, path, remaining)
+		if err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// Store uploads every file of a directory as an object and returns the
+// s3:// reference of the directory
+func (s *s3Backend) Store(ctx context.Context, u upload) (string, error) {
+	bucket, prefix := s.bucket, path.Join(s.prefix, u.jobID, u.name)
+	if u.dest != nil {
+		if err := s.checkRef(u.dest); err != nil {
+			return "", err
+		}
+		bucket, prefix = u.dest.Host, strings.Trim(u.dest.Path, "/")
+	}
+
+	for _, file := range u.files {
+		if file.isDir {
+			continue
+		}
+		if err := s.upload(ctx, bucket, path.Join(prefix, file.name), file.path); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("s3://%s/%s", bucket, prefix), nil
+}
+
+// list returns every object whose key starts with prefix
+func (s *s3Backend) list(ctx context.Context, bucket, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := s.do(ctx, "GET", bucket, "", query, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", bucket, prefix, err)
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse S3 list response: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// download writes an object to a local file and returns its size. The
+// object may be at most maxBytes long; 0 means no limit. Failures are
+// retried like other downloads, and retries resume with a Range request.
+func (s *s3Backend) download(ctx context.Context, bucket, key, dest string, maxBytes int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	name := fmt.Sprintf("s3://%s/%s", bucket, key)
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return s.request(ctx, "GET", bucket, key, nil, nil, 0)
+	}
+	n, err := s.retry.downloadFile(ctx, s.client, newRequest, dest, true, true, maxBytes, name)
+	if err != nil {
+		return n, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// upload streams a local file to an object
+func (s *s3Backend) upload(ctx context.Context, bucket, key, localFile string) error {
+	file, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", localFile, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", localFile, err)
+	}
+
+	resp, err := s.do(ctx, "PUT", bucket, key, nil, progressFrom(ctx).reader(file), info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to upload s3://%s/%s: %w", bucket, key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request and returns the response if it succeeded
+func (s *s3Backend) do(ctx context.Context, method, bucket, key string, query url.Values, body io.Reader, contentLength int64) (*http.Response, error) {
+	req, err := s.request(ctx, method, bucket, key, query, body, contentLength)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP %d - %s", resp.StatusCode, string(bodyBytes))
+	}
+	return resp, nil
+}
+
+// request builds a signed request for an object, or for a bucket when key
+// is empty. Headers added afterwards, such as Range, are not signed.
+func (s *s3Backend) request(ctx context.Context, method, bucket, key string, query url.Values, body io.Reader, contentLength int64) (*http.Request, error) {
+	objectPath := "/" + bucket
+	if key != "" {
+		objectPath += "/" + key
+	}
+
+	requestURL := *s.endpoint
+	requestURL.Path = s.endpoint.Path + objectPath
+	requestURL.RawPath = s.endpoint.EscapedPath() + s3Escape(objectPath, false)
+	requestURL.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+	}
+	s.sign(req, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds AWS Signature Version 4 headers to a request
+func (s *s3Backend) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + s3UnsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// hmacSHA256 computes HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes a query string the way Signature Version 4
+// expects: sorted by key, with every value escaped
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and slashes
+// unless escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testS3Region    = "eu-west-1"
+)
+
+// fakeS3 is an in-memory S3 service that checks each request's Signature
+// Version 4 signature and lists at most two keys per page
+type fakeS3 struct {
+	t        *testing.T
+	mu       sync.Mutex
+	objects  map[string]string // "<bucket>/<key>" to content
+	listed   map[string]int64  // sizes listed instead of the content's
+	failures int               // object downloads still to fail with HTTP 503
+	requests int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	if err := verifySigV4(r); err != nil {
+		f.t.Errorf("%s %s: %v", r.Method, r.URL, err)
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		f.list(w, bucket, r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token"))
+	case r.Method == http.MethodGet:
+		content, ok := f.objects[bucket+"/"+key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		if f.failures > 0 {
+			f.failures--
+			http.Error(w, "SlowDown", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, content)
+	case r.Method == http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		f.objects[bucket+"/"+key] = string(content)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+// list answers ListObjectsV2, continuing after the key index in token
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix, token string) {
+	var keys []string
+	for name := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(token)
+	end := min(start+2, len(keys))
+	result := s3ListResult{}
+	for _, key := range keys[start:end] {
+		size, ok := f.listed[bucket+"/"+key]
+		if !ok {
+			size = int64(len(f.objects[bucket+"/"+key]))
+		}
+		result.Contents = append(result.Contents, s3Object{Key: key, Size: size})
+	}
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// verifySigV4 checks a request's signature the way S3 does, from the request
+// as it arrived
+func verifySigV4(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != testS3AccessKey || credential[2] != testS3Region || credential[3] != "s3" {
+		return fmt.Errorf("unexpected credential %q", fields["Credential"])
+	}
+
+	// Canonical query: keys sorted, keys and values URI-encoded
+	query := r.URL.Query()
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+
+	var headers []string
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers = append(headers, name+":"+strings.TrimSpace(value)+"\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(pairs, "&"),
+		strings.Join(headers, ""),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" +
+		strings.Join(credential[1:], "/") + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + testS3SecretKey)
+	for _, part := range append(credential[1:], stringToSign) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if want := hex.EncodeToString(key); fields["Signature"] != want {
+		return fmt.Errorf("signature %s, want %s", fields["Signature"], want)
+	}
+	return nil
+}
+
+// uriEncode encodes s as Signature Version 4 requires
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// newTestS3 starts a fake S3 service and a backend using it for the bucket
+// "lamda" with the prefix "jobs"
+func newTestS3(t *testing.T, allowedPrefixes ...string) (*fakeS3, *s3Backend) {
+	t.Helper()
+	fake := &fakeS3{t: t, objects: map[string]string{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	backend, err := newS3Backend(server.Client(), server.URL+"/", testS3Region, "lamda", "/jobs/", testS3AccessKey, testS3SecretKey, allowedPrefixes, testRetry, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, backend
+}
+
+func TestS3BackendRoundTrip(t *testing.T) {
+	fake, backend := newTestS3(t)
+	files := map[string]string{
+		"a.txt":              "a",
+		"sub/b.txt":          "bb",
+		"sub/with space.txt": "spaced",
+		"ü/ünïcode+plus.txt": "unicode",
+	}
+
+	ref, err := backend.Store(context.Background(), testUpload(t, "job-1", "output", writeTestTree(t, files)))
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if ref != "s3://lamda/jobs/job-1/output" {
+		t.Errorf("Store returned %q, want s3://lamda/jobs/job-1/output", ref)
+	}
+	if got := fake.objects["lamda/jobs/job-1/output/sub/with space.txt"]; got != "spaced" {
+		t.Errorf("stored object = %q, want %q", got, "spaced")
+	}
+
+	// The listing takes two pages
+	u, err := url.Parse(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "input")
+	if err := backend.Fetch(context.Background(), u, func(bool) string { return dest }); err != nil {
+		t.Fatalf("Fetch of a directory failed: %v", err)
+	}
+	assertTree(t, dest, files)
+
+	// A key naming an object fetches just that object
+	u.Path += "/sub/b.txt"
+	dest = filepath.Join(t.TempDir(), "input")
+	if err := backend.Fetch(context.Background(), u, func(bool) string { return dest }); err != nil {
+		t.Fatalf("Fetch of an object failed: %v", err)
+	}
+	assertTree(t, dest, map[string]string{"": "bb"})
+}
+
+func TestS3BackendFetchRetries(t *testing.T) {
+	fake, backend := newTestS3(t)
+	fake.objects["lamda/jobs/input/a.txt"] = "a"
+	fake.failures = 1
+
+	u, err := url.Parse("s3://lamda/jobs/input/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "input")
+	if err := backend.Fetch(context.Background(), u, func(bool) string { return dest }); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	assertTree(t, dest, map[string]string{"": "a"})
+}
+
+func TestS3BackendFetchLimitsSize(t *testing.T) {
+	// The backend accepts inputs of up to 10 bytes
+	objects := map[string]string{
+		"lamda/jobs/input/a.txt": "aaaa",
+		"lamda/jobs/input/b.txt": "bbbbbb",
+		"lamda/jobs/input/empty": "",
+		"lamda/jobs/large.txt":   "large object",
+	}
+	tests := []struct {
+		name         string
+		ref          string
+		listed       map[string]int64
+		wantErr      error
+		wantRequests int
+	}{
+		{name: "directory at the limit", ref: "s3://lamda/jobs/input", wantRequests: 4},
+		{name: "object over the limit", ref: "s3://lamda/jobs/large.txt", wantErr: errTooLarge, wantRequests: 1},
+		{name: "directory over the limit", ref: "s3://lamda/jobs", wantErr: errTooLarge, wantRequests: 2},
+		{
+			name:         "object grown since it was listed",
+			ref:          "s3://lamda/jobs/large.txt",
+			listed:       map[string]int64{"lamda/jobs/large.txt": 5},
+			wantErr:      errTooLarge,
+			wantRequests: 2,
+		},
+		{
+			name:         "directory grown since it was listed",
+			ref:          "s3://lamda/jobs",
+			listed:       map[string]int64{"lamda/jobs/input/b.txt": 1, "lamda/jobs/large.txt": 5},
+			wantErr:      errTooLarge,
+			wantRequests: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, backend := newTestS3(t)
+			backend.maxBytes = 10
+			maps.Copy(fake.objects, objects)
+			fake.listed = tt.listed
+			u, err := url.Parse(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(t.TempDir(), "input")
+			err = backend.Fetch(context.Background(), u, func(bool) string { return dest })
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Fetch error = %v, want %v", err, tt.wantErr)
+			}
+			if fake.requests != tt.wantRequests {
+				t.Errorf("S3 received %d requests, want %d", fake.requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestS3BackendConfinesReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		ref     string
+		wantErr bool
+	}{
+		{name: "under the default prefix", ref: "s3://lamda/jobs/job-1/input"},
+		{name: "the default prefix itself", ref: "s3://lamda/jobs"},
+		{name: "sibling of the default prefix", ref: "s3://lamda/jobs-old/input", wantErr: true},
+		{name: "rest of the bucket", ref: "s3://lamda/secrets/key", wantErr: true},
+		{name: "whole bucket", ref: "s3://lamda", wantErr: true},
+		{name: "other bucket", ref: "s3://other/jobs/job-1", wantErr: true},
+		{name: "no bucket", ref: "s3:///jobs/job-1", wantErr: true},
+		{name: "dot segments", ref: "s3://lamda/jobs/../secrets/key", wantErr: true},
+		{name: "allowed bucket", allowed: []string{"datasets"}, ref: "s3://datasets/anything"},
+		{name: "allowed prefix", allowed: []string{" datasets/public/ ", "models"}, ref: "s3://datasets/public/imagenet"},
+		{name: "outside allowed prefix", allowed: []string{"datasets/public"}, ref: "s3://datasets/private/x", wantErr: true},
+		{name: "default prefix replaced by the list", allowed: []string{"datasets"}, ref: "s3://lamda/jobs/job-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, backend := newTestS3(t, tt.allowed...)
+			u, err := url.Parse(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = backend.checkRef(u)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("checkRef failed: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("checkRef succeeded, want an error")
+			}
+
+			// Neither a fetch nor an upload reaches S3
+			dest := filepath.Join(t.TempDir(), "input")
+			if err := backend.Fetch(context.Background(), u, func(bool) string { return dest }); err == nil {
+				t.Error("Fetch succeeded, want an error")
+			}
+			upload := testUpload(t, "job-1", "output", writeTestTree(t, map[string]string{"a.txt": "a"}))
+			upload.dest = u
+			if _, err := backend.Store(context.Background(), upload); err == nil {
+				t.Error("Store succeeded, want an error")
+			}
+			if fake.requests != 0 {
+				t.Errorf("%d request(s) were sent to S3", fake.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UnixFS node types
+const (
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+	unixfsMetadata  = 3
+	unixfsSymlink   = 4
+	unixfsHAMTShard = 5
+)
+
+// maxDAGDepth bounds recursion through a DAG so a malicious input cannot
+// exhaust the stack
+const maxDAGDepth = 256
+
+// maxDAGNodes bounds the nodes visited while writing a DAG. Nodes may be
+// linked any number of times, so a small CAR can describe a far larger tree.
+const maxDAGNodes = 1 << 22
+
+// pbLink is a link in a dag-pb node
+type pbLink struct {
+	cid  cid
+	name string
+}
+
+// unixfsNode is a decoded dag-pb node with its UnixFS metadata
+type unixfsNode struct {
+	kind     uint64
+	data     []byte
+	filesize uint64
+	fanout   uint64
+	links    []pbLink
+}
+
+// size returns the number of bytes of the file a node is the root of
+func (n *unixfsNode) size() uint64 {
+	if n.kind == unixfsRaw {
+		return uint64(len(n.data))
+	}
+	return n.filesize
+}
+
+// decodeNode decodes a block into a UnixFS node. Raw blocks are file data.
+func decodeNode(c cid, block []byte) (*unixfsNode, error) {
+	switch c.codec {
+	case codecRaw:
+		return &unixfsNode{kind: unixfsRaw, data: block}, nil
+	case codecDagPB:
+	default:
+		return nil, fmt.Errorf("unsupported IPLD codec 0x%x in block %s", c.codec, c)
+	}
+
+	node := &unixfsNode{}
+	var unixfsData []byte
+	err := forEachField(block, func(field uint64, value []byte) error {
+		switch field {
+		case 1: // Data
+			unixfsData = value
+		case 2: // Links
+			link, err := decodeLink(value)
+			if err != nil {
+				return err
+			}
+			node.links = append(node.links, link)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid dag-pb block %s: %w", c, err)
+	}
+
+	err = forEachField(unixfsData, func(field uint64, value []byte) error {
+		switch field {
+		case 1: // Type
+			node.kind = decodeVarintField(value)
+		case 2: // Data
+			node.data = value
+		case 3: // filesize
+			node.filesize = decodeVarintField(value)
+		case 6: // fanout
+			node.fanout = decodeVarintField(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid UnixFS data in block %s: %w", c, err)
+	}
+
+	return node, nil
+}
+
+// decodeLink decodes a dag-pb PBLink
+func decodeLink(b []byte) (pbLink, error) {
+	var link pbLink
+	var hash []byte
+	err := forEachField(b, func(field uint64, value []byte) error {
+		switch field {
+		case 1: // Hash
+			hash = value
+		case 2: // Name
+			link.name = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return pbLink{}, err
+	}
+	if hash == nil {
+		return pbLink{}, fmt.Errorf("link has no hash")
+	}
+
+	link.cid, err = readCID(bytes.NewReader(hash))
+	return link, err
+}
+
+// forEachField walks the fields of a protobuf message. Varint values are
+// passed re-encoded as varints; fixed-width values are skipped.
+func forEachField(b []byte, fn func(field uint64, value []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		b = b[n:]
+		field, wireType := key>>3, key&7
+
+		var value []byte
+		switch wireType {
+		case 0: // varint
+			_, n := binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint in field %d", field)
+			}
+			value, b = b[:n], b[n:]
+		case 1: // fixed64
+			if len(b) < 8 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			b = b[8:]
+			continue
+		case 2: // length-delimited
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			value, b = b[n:n+int(length)], b[n+int(length):]
+		case 5: // fixed32
+			if len(b) < 4 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			b = b[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+
+		if err := fn(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeVarintField decodes the value of a varint field
+func decodeVarintField(value []byte) uint64 {
+	v, _ := binary.Uvarint(value)
+	return v
+}
+
+// dagWriter rebuilds UnixFS files and directories from a block store
+type dagWriter struct {
+	store *blockStore
+
+	// maxBytes caps the bytes written across all files; 0 means no cap
+	maxBytes int64
+	written  int64
+
+	// maxNodes caps the nodes loaded, counting each time a node is linked
+	maxNodes int
+	nodes    int
+}
+
+// isDirectory reports whether the node at c is a UnixFS directory
+func (w *dagWriter) isDirectory(c cid) (bool, error) {
+	node, err := w.load(c)
+	if err != nil {
+		return false, err
+	}
+	return node.kind == unixfsDirectory || node.kind == unixfsHAMTShard, nil
+}
+
+// load reads and decodes a node, counting it against maxNodes
+func (w *dagWriter) load(c cid) (*unixfsNode, error) {
+	w.nodes++
+	if w.nodes > w.maxNodes {
+		return nil, fmt.Errorf("DAG expands to more than %d nodes", w.maxNodes)
+	}
+
+	block, err := w.store.Get(c)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(c, block)
+}
+
+// writeEntry writes the file or directory at c to dest
+func (w *dagWriter) writeEntry(c cid, dest string, depth int) error {
+	if depth > maxDAGDepth {
+		return fmt.Errorf("DAG is nested more than %d levels deep", maxDAGDepth)
+	}
+
+	node, err := w.load(c)
+	if err != nil {
+		return err
+	}
+
+	switch node.kind {
+	case unixfsDirectory, unixfsHAMTShard:
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		return w.writeDirectory(node, dest, depth)
+	case unixfsFile, unixfsRaw:
+		return w.writeFile(node, dest)
+	case unixfsSymlink:
+		// Symlinks could point outside the job's input directory
+		log.Printf("Warning: skipping symlink %s in input", dest)
+		return nil
+	default:
+		return fmt.Errorf("unsupported UnixFS node type %d at %s", node.kind, dest)
+	}
+}
+
+// writeDirectory writes a directory's entries under dest, descending into
+// HAMT shards of large directories
+func (w *dagWriter) writeDirectory(node *unixfsNode, dest string, depth int) error {
+	prefixLen := 0
+	if node.kind == unixfsHAMTShard {
+		if node.fanout < 2 {
+			return fmt.Errorf("invalid HAMT fanout %d at %s", node.fanout, dest)
+		}
+		prefixLen = len(fmt.Sprintf("%X", node.fanout-1))
+	}
+
+	for _, link := range node.links {
+		if len(link.name) < prefixLen {
+			return fmt.Errorf("invalid HAMT link name %q at %s", link.name, dest)
+		}
+		name := link.name[prefixLen:]
+
+		// A HAMT link with only a prefix is a nested shard of the same directory
+		if node.kind == unixfsHAMTShard && name == "" {
+			child, err := w.load(link.cid)
+			if err != nil {
+				return err
+			}
+			if child.kind != unixfsHAMTShard {
+				return fmt.Errorf("HAMT link %q at %s is not a shard", link.name, dest)
+			}
+			if err := w.writeDirectory(child, dest, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := validateEntryName(name); err != nil {
+			return err
+		}
+		if err := w.writeEntry(link.cid, filepath.Join(dest, name), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile writes a UnixFS file, concatenating its chunks in order. The
+// file must be exactly its declared size, which must fit in what is left of
+// maxBytes.
+func (w *dagWriter) writeFile(node *unixfsNode, dest string) error {
+	size := node.size()
+	if w.maxBytes > 0 && size > uint64(w.maxBytes-w.written) {
+		return tooLarge(w.maxBytes)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer file.Close()
+
+	remaining := size
+	if err := w.copyFileData(file, node, &remaining, 0); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+	if remaining != 0 {
+		return fmt.Errorf("%w: %s is shorter than its declared size of %d bytes", ErrIntegrity, dest, size)
+	}
+	return nil
+}
+
+// copyFileData writes a file node's inline data followed by its chunks,
+// failing once more than remaining bytes would be written
+func (w *dagWriter) copyFileData(out io.Writer, node *unixfsNode, remaining *uint64, depth int) error {
+	if depth > maxDAGDepth {
+		return fmt.Errorf("file is nested more than %d levels deep", maxDAGDepth)
+	}
+	if node.kind != unixfsFile && node.kind != unixfsRaw {
+		return fmt.Errorf("unexpected UnixFS node type %d in file", node.kind)
+	}
+
+	if uint64(len(node.data)) > *remaining {
+		return fmt.Errorf("%w: file is longer than its declared size", ErrIntegrity)
+	}
+	if _, err := out.Write(node.data); err != nil {
+		return err
+	}
+	*remaining -= uint64(len(node.data))
+	w.written += int64(len(node.data))
+
+	for _, link := range node.links {
+		child, err := w.load(link.cid)
+		if err != nil {
+			return err
+		}
+		if err := w.copyFileData(out, child, remaining, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateEntryName rejects directory entry names that would escape the
+// directory being written
+func validateEntryName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid directory entry name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The CARs in testdata were made with boxo's UnixFS importer, the code
+// behind Kubo's "ipfs add", using 1 KiB chunks ("--chunker=size-1024"), and
+// exported block by block in depth-first order like "ipfs dag export". The
+// v1 fixtures use CIDv1 with raw leaves ("--cid-version=1"); the v0 fixtures
+// use Kubo's defaults. hamt_v1.car was added with sharding forced for every
+// directory. Their contents are rebuilt below.
+
+const helloContent = "Hello from lamda_node_agent\n"
+
+// randomBytes returns the pseudo-random content used in the fixtures
+func randomBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// fixtureDir is the tree in dir_v0.car and dir_v1.car
+func fixtureDir() map[string]string {
+	return map[string]string{
+		"hello.txt":              helloContent,
+		"empty":                  "",
+		"data/random.bin":        string(randomBytes(3000, 3)),
+		"data/nested/deeper.txt": "deep\n",
+	}
+}
+
+// fixtureHAMT is the tree in hamt_v1.car
+func fixtureHAMT() map[string]string {
+	files := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		files[fmt.Sprintf("file-%03d.txt", i)] = fmt.Sprintf("file %d\n", i)
+	}
+	return files
+}
+
+func TestWriteDAGFixtures(t *testing.T) {
+	tests := []struct {
+		car  string
+		root string
+		want map[string]string // relative path to content; "" is a file root
+	}{
+		{"file_v0.car", "QmYcWdVFeczWfNqZ5vUhV4iFUdRzpTaW62Q5bdWhsjazHq", map[string]string{"": helloContent}},
+		{"file_v1.car", "bafkreigmpufwazzzslye2nddwsajihpqukc3szfqcsvkmtdarxkz63vhcm", map[string]string{"": helloContent}},
+		{"chunked_v0.car", "QmUVgV3NNFzrvVUdbZphPbRnHM4YetoTe3jPoCYBZga27J", map[string]string{"": string(randomBytes(10000, 1))}},
+		{"chunked_v1.car", "bafybeiaivyeesn3f5mhz52xshlpvkj7e5sqsfjrwi3t3fu6hzgjvqvaume", map[string]string{"": string(randomBytes(10000, 1))}},
+		{"deep_v1.car", "bafybeie2d4j6gcidvomxj6fmv3erb6p6hcmn6xzanbmbptsd2crapb5cvu", map[string]string{"": string(randomBytes(20000, 2))}},
+		{"zeros_v1.car", "bafybeihulunfxalooiv2ghxen3qxxdori4n6xlwqfectpac7mb3uv6mbbm", map[string]string{"": string(make([]byte, 4096))}},
+		{"dir_v0.car", "QmX8E8fzhagdikyyzkhJnn4auSdWKQ4ozainXGc8jJ9VtY", fixtureDir()},
+		{"dir_v1.car", "bafybeichyt4ac6fdhxtwq7uu5omz6a7yavhjmsnllksds4ndye5iq5lwea", fixtureDir()},
+		{"hamt_v1.car", "bafybeicmn6jbnvgzqwuanqg26ckysdnoxih4a2hfa7zpjsiyjrs2ppuflm", fixtureHAMT()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.car, func(t *testing.T) {
+			root, err := parseCID(tt.root)
+			if err != nil {
+				t.Fatalf("parseCID failed: %v", err)
+			}
+			dest, err := unpackCAR(t, readFixture(t, tt.car), root, 0)
+			if err != nil {
+				t.Fatalf("writeDAG failed: %v", err)
+			}
+			assertTree(t, dest, tt.want)
+		})
+	}
+}
+
+func TestWriteDAGShardedDirectory(t *testing.T) {
+	car := readFixture(t, "hamt_v1.car")
+	sections := carSections(t, car)
+
+	// The first block is the root; check the fixture really is sharded
+	store, err := newBlockStore(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := readCAR(bytes.NewReader(car), store); err != nil {
+		t.Fatal(err)
+	}
+	root, err := readCID(bytes.NewReader(sections[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &dagWriter{store: store, maxNodes: maxDAGNodes}
+	node, err := writer.load(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.kind != unixfsHAMTShard || node.fanout != 256 {
+		t.Fatalf("root is UnixFS type %d with fanout %d, want a HAMT shard with fanout 256", node.kind, node.fanout)
+	}
+}
+
+func TestWriteDAGMaxBytes(t *testing.T) {
+	root, err := parseCID("bafybeiaivyeesn3f5mhz52xshlpvkj7e5sqsfjrwi3t3fu6hzgjvqvaume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	car := readFixture(t, "chunked_v1.car")
+
+	if _, err := unpackCAR(t, car, root, 10000); err != nil {
+		t.Errorf("input of exactly the limit failed: %v", err)
+	}
+	if _, err := unpackCAR(t, car, root, 9999); err == nil {
+		t.Error("input over the limit was written")
+	}
+}
+
+func TestWriteDAGDeclaredSize(t *testing.T) {
+	leaf := make([]byte, 1024)
+
+	tests := []struct {
+		name     string
+		filesize uint64
+		links    int
+	}{
+		{name: "longer than declared", filesize: 1024, links: 2},
+		{name: "shorter than declared", filesize: 3072, links: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var car testCAR
+			leafCID := car.add(codecRaw, leaf)
+			root := car.add(codecDagPB, dagPBNode(unixfsFile, tt.filesize, repeatLink(leafCID, "", tt.links)))
+
+			_, err := unpackCAR(t, car.bytes(), mustCID(t, root), 0)
+			if !errors.Is(err, ErrIntegrity) {
+				t.Fatalf("error = %v, want ErrIntegrity", err)
+			}
+		})
+	}
+}
+
+func TestWriteDAGRepeatedLinks(t *testing.T) {
+	// Three levels of 64 links to one 1 KiB block describe a 256 MiB file in
+	// a CAR of under 10 KiB
+	var file testCAR
+	leaf := file.add(codecRaw, make([]byte, 1024))
+	level1 := file.add(codecDagPB, dagPBNode(unixfsFile, 64<<10, repeatLink(leaf, "", 64)))
+	level2 := file.add(codecDagPB, dagPBNode(unixfsFile, 4<<20, repeatLink(level1, "", 64)))
+	fileRoot := file.add(codecDagPB, dagPBNode(unixfsFile, 256<<20, repeatLink(level2, "", 64)))
+
+	if _, err := unpackCAR(t, file.bytes(), mustCID(t, fileRoot), 1<<20); !errors.Is(err, errTooLarge) {
+		t.Errorf("file over the byte limit: error = %v, want errTooLarge", err)
+	}
+
+	// Directories can repeat a subtree in the same way
+	var dir testCAR
+	leaf = dir.add(codecRaw, make([]byte, 1024))
+	inner := dir.add(codecDagPB, dagPBNode(unixfsDirectory, 0, namedLinks(leaf, 64)))
+	outer := dir.add(codecDagPB, dagPBNode(unixfsDirectory, 0, namedLinks(inner, 64)))
+	dirRoot := mustCID(t, outer)
+
+	if _, err := unpackCAR(t, dir.bytes(), dirRoot, 1<<20); !errors.Is(err, errTooLarge) {
+		t.Errorf("directory over the byte limit: error = %v, want errTooLarge", err)
+	}
+
+	// Without a byte limit, the number of nodes is still capped
+	store, err := newBlockStore(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := readCAR(bytes.NewReader(dir.bytes()), store); err != nil {
+		t.Fatal(err)
+	}
+	writer := &dagWriter{store: store, maxNodes: 100}
+	if err := writer.writeEntry(dirRoot, filepath.Join(t.TempDir(), "input"), 0); err == nil || !strings.Contains(err.Error(), "nodes") {
+		t.Errorf("directory over the node limit: error = %v, want a node limit error", err)
+	}
+}
+
+// unpackCAR writes the DAG at root in car to a temporary path and returns it
+func unpackCAR(t *testing.T, car []byte, root cid, maxBytes int64) (string, error) {
+	t.Helper()
+	dest := filepath.Join(t.TempDir(), "input")
+	err := writeDAG(bytes.NewReader(car), root, func(bool) string { return dest }, maxBytes)
+	return dest, err
+}
+
+// assertTree checks that path holds exactly the files in want
+func assertTree(t *testing.T, path string, want map[string]string) {
+	t.Helper()
+	got := make(map[string]string)
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		content, err := os.ReadFile(p)
+		got[filepath.ToSlash(rel)] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("got %d files, want %d", len(got), len(want))
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("file %q has %d bytes that differ from the %d expected", name, len(got[name]), len(content))
+		}
+	}
+}
+
+// testCAR builds a CAR from hand-made blocks
+type testCAR struct {
+	sections [][]byte
+}
+
+// add appends a block and returns its binary CIDv1
+func (c *testCAR) add(codec uint64, block []byte) []byte {
+	digest := sha256.Sum256(block)
+	id := binary.AppendUvarint(nil, 1)
+	id = binary.AppendUvarint(id, codec)
+	id = append(id, hashSHA256, sha256.Size)
+	id = append(id, digest[:]...)
+	c.sections = append(c.sections, append(bytes.Clone(id), block...))
+	return id
+}
+
+// bytes returns the CAR. Its header is not valid dag-cbor, but the agent
+// never reads it.
+func (c *testCAR) bytes() []byte {
+	return buildCAR(append([][]byte{[]byte("header")}, c.sections...))
+}
+
+// testLink is a dag-pb link to a binary CID
+type testLink struct {
+	cid  []byte
+	name string
+}
+
+// repeatLink returns count links to the same block
+func repeatLink(id []byte, name string, count int) []testLink {
+	links := make([]testLink, count)
+	for i := range links {
+		links[i] = testLink{cid: id, name: name}
+	}
+	return links
+}
+
+// namedLinks returns count directory entries for the same block
+func namedLinks(id []byte, count int) []testLink {
+	links := make([]testLink, count)
+	for i := range links {
+		links[i] = testLink{cid: id, name: fmt.Sprintf("entry-%02d", i)}
+	}
+	return links
+}
+
+// dagPBNode encodes a dag-pb node holding UnixFS data of kind
+func dagPBNode(kind, filesize uint64, links []testLink) []byte {
+	var node []byte
+	for _, link := range links {
+		encoded := protoBytes(nil, 1, link.cid)
+		encoded = protoBytes(encoded, 2, []byte(link.name))
+		node = protoBytes(node, 2, encoded)
+	}
+
+	data := protoVarint(nil, 1, kind)
+	if kind == unixfsFile {
+		data = protoVarint(data, 3, filesize)
+	}
+	return protoBytes(node, 1, data)
+}
+
+// protoBytes appends a length-delimited protobuf field
+func protoBytes(b []byte, field uint64, value []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// protoVarint appends a varint protobuf field
+func protoVarint(b []byte, field, value uint64) []byte {
+	b = binary.AppendUvarint(b, field<<3)
+	return binary.AppendUvarint(b, value)
+}
+
+// mustCID parses a binary CID
+func mustCID(t *testing.T, id []byte) cid {
+	t.Helper()
+	c, err := readCID(bytes.NewReader(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}